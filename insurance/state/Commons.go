@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
-	"strings"
+	"time"
+
+	"github.com/akm4/chaincode/jsonpath"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
 
 //ArgsMap map for ars array in interface form
@@ -16,100 +18,110 @@ func getUnmarshalledArgument(args []string) (interface{}, error) {
 	var err error
 
 	if len(args) != 1 {
-		err = errors.New("Expecting one JSON event object")
+		err = newError(ERR_INVALID_ARGUMENT, "", "Expecting one JSON event object")
 		return nil, err
 	}
 	eventBytes := []byte(args[0])
 	err = json.Unmarshal(eventBytes, &event)
 	if err != nil {
-		err = fmt.Errorf("failed to unmarshal arg: %s", err)
+		err = wrapError(ERR_INVALID_ARGUMENT, "failed to unmarshal arg", err)
 		return nil, err
 	}
 	if event == nil {
-		err = fmt.Errorf("unmarshal arg created nil event")
+		err = newError(ERR_INVALID_ARGUMENT, "", "unmarshal arg created nil event")
 		return nil, err
 	}
 
 	argsMap, found := event.(map[string]interface{})
 	if !found {
-		err := fmt.Errorf("arg is not a map shape")
+		err := newError(ERR_INVALID_ARGUMENT, "", "arg is not a map shape")
 		return nil, err
 	}
 	return argsMap, nil
 }
 
 func getStringParamFromArgs(name string, args interface{}) (string, error) {
-	var result string
-	var amargs ArgsMap
-	var margs map[string]interface{}
-	var found bool
-	amargs, found = args.(ArgsMap)
-	if !found {
-		margs, found = args.(map[string]interface{})
-		if !found {
-			err := fmt.Errorf("not passed a map, type is %T", args)
+	if _, found := args.(map[string]interface{}); !found {
+		if _, found := args.(ArgsMap); !found {
+			err := newError(ERR_INVALID_ARGUMENT, "", fmt.Sprintf("not passed a map, type is %T", args))
 			return "", err
 		}
-		amargs = ArgsMap(margs)
 	}
-	result, found = getObjectAsString(amargs, name)
-	if !found {
-		// not found
-		err := errors.New(name + " is missing")
-		return "", err
+	result, err := jsonpath.GetString(args, name)
+	return result, pathError(name, err)
+}
+
+//returns path lookup error as chaincode error of field qname
+func pathError(qname string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if jsonpath.IsNotFound(err) {
+		return newError(ERR_MISSING_FIELD, qname, err.Error())
 	}
-	return result, nil
+	return newError(ERR_INVALID_FIELD, qname, err.Error())
 }
 
 func getObjectAsString(objIn interface{}, qname string) (string, bool) {
-	tbytes, found := getObject(objIn, qname)
-	if found {
-		t, found := tbytes.(string)
-		if found {
-			return t, true
-		}
-	}
-	return "", false
+	t, err := jsonpath.GetString(objIn, qname)
+	return t, err == nil
 }
 
+// Returns the object at qname, a path like a.items[2].id starting at the
+// object's root, see package jsonpath
 func getObject(objIn interface{}, qname string) (interface{}, bool) {
-	// return a copy of the selected object
-	// handles full qualified name, starting at object's root
-	obj, found := objIn.(map[string]interface{})
-	if !found {
-		objam, found := objIn.(ArgsMap)
-		if !found {
-			return nil, false
-		}
-		obj = map[string]interface{}(objam)
+	obj, err := jsonpath.Get(objIn, qname)
+	return obj, err == nil
+}
+
+func getInt(objIn interface{}, qname string) (int, error) {
+	i, err := jsonpath.GetInt(objIn, qname)
+	return i, pathError(qname, err)
+}
+
+func getBool(objIn interface{}, qname string) (bool, error) {
+	b, err := jsonpath.GetBool(objIn, qname)
+	return b, pathError(qname, err)
+}
+
+//returns time at qname, given as RFC 3339 string
+func getTime(objIn interface{}, qname string) (time.Time, error) {
+	t, err := jsonpath.GetTime(objIn, qname)
+	return t, pathError(qname, err)
+}
+
+func getStringSlice(objIn interface{}, qname string) ([]string, error) {
+	s, err := jsonpath.GetStringSlice(objIn, qname)
+	return s, pathError(qname, err)
+}
+
+// Sensitive inputs are sent in the transient map, which the peer hands to the
+// chaincode but does not write to the transaction. Each entry is named and
+// holds bytes, request entries hold a JSON object.
+
+//transient map entry of person fields, see PersonTransient
+const transientPerson = "person"
+
+//returns value of transient entry name, error if it is missing and required
+func getTransientValue(stub shim.ChaincodeStubInterface, name string, required bool) ([]byte, error) {
+	transient, err := stub.GetTransient()
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting transient map", err)
 	}
-	searchObj := map[string]interface{}(obj)
-	s := strings.Split(qname, ".")
-	// crawl the levels
-	for i, v := range s {
-		if i+1 < len(s) {
-			tmp, found := searchObj[v]
-			if found {
-				searchObj, found = tmp.(map[string]interface{})
-				if !found {
-					searchObj, found = tmp.(ArgsMap)
-					if !found {
-					}
-				}
-			} else {
-
-			}
-		} else {
-			returnObj, found := searchObj[v]
-			if !found {
-				// this debug statement is not useful normally as we must be able to
-				// handle assetID as part of iot common and as parameter on its own
-				// so we get false warnings on read functions, but do enable it if
-				// having problems with deep nested structures
-				return nil, false
-			}
-			return returnObj, true
-		}
+	value := transient[name]
+	if len(value) == 0 && required {
+		return nil, newError(ERR_MISSING_FIELD, "transient."+name, name+" is missing in the transient map")
+	}
+	return value, nil
+}
+
+// Decodes transient entry name into req, a pointer to request struct, and
+// validates it like decodeRequest; fields in errors are named
+// transient.<name>.<field>. Returns false if the entry is missing.
+func decodeTransient(stub shim.ChaincodeStubInterface, name string, req interface{}) (bool, error) {
+	value, err := getTransientValue(stub, name, false)
+	if err != nil || len(value) == 0 {
+		return false, err
 	}
-	return nil, false
+	return true, decodeRequestAs([]string{string(value)}, req, "transient."+name+".")
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Batch functions run the single person function for every item of
+// {"persons":[...], "mode":...}; items are the arguments the single function
+// takes. In BATCH_ALL_OR_NOTHING mode one failed item fails the transaction,
+// in BATCH_BEST_EFFORT mode the items that succeeded are kept.
+// Reads within a transaction do not see its own writes, so a hash can be
+// used only once per batch. The events of the items are sent together as one
+// ACTION_BATCH event, a transaction carries only one. Items can not use the
+// transient map but for the encryption keys, see encryption.go.
+// The writes and events of an item are held back until it finishes and
+// dropped when it fails, so a failed item leaves nothing behind in
+// BATCH_BEST_EFFORT mode.
+
+const (
+	BATCH_ALL_OR_NOTHING = "allOrNothing"
+	BATCH_BEST_EFFORT    = "bestEffort"
+)
+
+//type for result of one batch item
+type BatchItemResult struct {
+	Index   int             `json:"index"`
+	Hash    string          `json:"hash"`
+	OK      bool            `json:"ok"`
+	Error   json.RawMessage `json:"error,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+//type for batch response, returned as error message when the batch is not committed
+type BatchResult struct {
+	Mode      string            `json:"mode"`
+	Committed bool              `json:"committed"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Items     []BatchItemResult `json:"items"`
+}
+
+//type for payload of ACTION_BATCH event
+type BatchEvent struct {
+	Events []NamedEvent `json:"events"`
+}
+
+//type for event of one batch item
+type NamedEvent struct {
+	Name    string          `json:"name"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Stub given to the single person functions of a batch. It collects their
+// events instead of setting them, buffers the writes of the running item and
+// hides the transient map but for the encryption keys.
+type batchStub struct {
+	shim.ChaincodeStubInterface
+	events []NamedEvent
+	//writes and events of the running item
+	writes     []batchWrite
+	itemEvents []NamedEvent
+}
+
+//write of a batch item, collection is empty for public state
+type batchWrite struct {
+	collection string
+	key        string
+	value      []byte
+	isDelete   bool
+}
+
+func (s *batchStub) PutState(key string, value []byte) error {
+	s.writes = append(s.writes, batchWrite{key: key, value: value})
+	return nil
+}
+
+func (s *batchStub) DelState(key string) error {
+	s.writes = append(s.writes, batchWrite{key: key, isDelete: true})
+	return nil
+}
+
+func (s *batchStub) PutPrivateData(collection string, key string, value []byte) error {
+	s.writes = append(s.writes, batchWrite{collection: collection, key: key, value: value})
+	return nil
+}
+
+func (s *batchStub) DelPrivateData(collection string, key string) error {
+	s.writes = append(s.writes, batchWrite{collection: collection, key: key, isDelete: true})
+	return nil
+}
+
+//applies writes and keeps events of the item that succeeded
+func (s *batchStub) commitItem() error {
+	writes := s.writes
+	s.writes = nil
+	for _, w := range writes {
+		var err error
+		switch {
+		case w.collection != "" && w.isDelete:
+			err = s.ChaincodeStubInterface.DelPrivateData(w.collection, w.key)
+		case w.collection != "":
+			err = s.ChaincodeStubInterface.PutPrivateData(w.collection, w.key, w.value)
+		case w.isDelete:
+			err = s.ChaincodeStubInterface.DelState(w.key)
+		default:
+			err = s.ChaincodeStubInterface.PutState(w.key, w.value)
+		}
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error writing batch item "+w.key, err)
+		}
+	}
+	s.events = append(s.events, s.itemEvents...)
+	s.itemEvents = nil
+	return nil
+}
+
+//drops writes and events of the item that failed
+func (s *batchStub) discardItem() {
+	s.writes = nil
+	s.itemEvents = nil
+}
+
+//batch items take no transient input, the map is shared by all of them; keys are passed on
+func (s *batchStub) GetTransient() (map[string][]byte, error) {
+	transient, err := s.ChaincodeStubInterface.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string][]byte)
+	for _, name := range []string{transientEncryptionKey, transientOldEncryptionKey} {
+		if len(transient[name]) != 0 {
+			keys[name] = transient[name]
+		}
+	}
+	return keys, nil
+}
+
+func (s *batchStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return newError(ERR_INVALID_ARGUMENT, "", "event name can not be empty")
+	}
+	s.itemEvents = append(s.itemEvents, NamedEvent{Name: name, Payload: json.RawMessage(payload)})
+	return nil
+}
+
+//runs single person function for every item of the batch
+func (t *SimpleChaincode) runBatch(stub shim.ChaincodeStubInterface, args []string, single func(shim.ChaincodeStubInterface, []string) pb.Response) pb.Response {
+	var req BatchRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	mode := req.Mode
+	if mode == "" {
+		mode = BATCH_ALL_OR_NOTHING
+	}
+	items := req.Persons
+	bstub := &batchStub{ChaincodeStubInterface: stub}
+	result := &BatchResult{Mode: mode, Items: make([]BatchItemResult, 0, len(items))}
+	seen := make(map[string]int)
+	for i, item := range items {
+		itemResult := BatchItemResult{Index: i}
+		var res pb.Response
+		var key struct {
+			Hash string `json:"hash"`
+		}
+		//the single function validates the item, the hash is needed before;
+		//an item without hash is left to it
+		err = json.Unmarshal(item, &key)
+		itemResult.Hash = key.Hash
+		if err != nil {
+			res = errorResponse(wrapError(ERR_INVALID_ARGUMENT, "failed to unmarshal batch item", err))
+		} else if first, found := seen[itemResult.Hash]; found {
+			res = errorResponse(&PersonError{Code: ERR_DUPLICATE_HASH, Message: fmt.Sprintf("hash already used by item %d", first), Field: "hash", Hash: itemResult.Hash})
+		} else {
+			if itemResult.Hash != "" {
+				seen[itemResult.Hash] = i
+			}
+			res = single(bstub, []string{string(item)})
+		}
+		if res.Status == shim.OK {
+			err = bstub.commitItem()
+			if err != nil {
+				return errorResponse(err)
+			}
+			itemResult.OK = true
+			itemResult.Payload = res.Payload
+			result.Succeeded++
+		} else {
+			bstub.discardItem()
+			itemResult.Error = json.RawMessage(res.Message)
+			result.Failed++
+		}
+		result.Items = append(result.Items, itemResult)
+	}
+	logger.Infof("batch of %d persons, %d failed", len(items), result.Failed)
+	result.Committed = mode == BATCH_BEST_EFFORT || result.Failed == 0
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if !result.Committed {
+		return errorResponse(&ChaincodeError{
+			Code:    ERR_BATCH_FAILED,
+			Message: fmt.Sprintf("%d of %d persons failed, nothing is committed", result.Failed, len(items)),
+			Details: result,
+		})
+	}
+	if len(bstub.events) != 0 {
+		err = emitBatchEvent(stub, bstub.events)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	return shim.Success(resultBytes)
+}
+
+//sets ACTION_BATCH event with events of the batch items
+func emitBatchEvent(stub shim.ChaincodeStubInterface, events []NamedEvent) error {
+	names, err := loadEventNames(stub)
+	if err != nil {
+		return err
+	}
+	name := names[ACTION_BATCH]
+	if name == "" {
+		return nil
+	}
+	eventBytes, err := json.Marshal(&BatchEvent{Events: events})
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error marshalling batch event", err)
+	}
+	return stub.SetEvent(name, eventBytes)
+}
+
+func (t *SimpleChaincode) batchInsertPersons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.runBatch(stub, args, t.insertPerson)
+}
+
+func (t *SimpleChaincode) batchUpdatePersons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.runBatch(stub, args, t.updatePerson)
+}
+
+//searches every person of the batch, payload of items is their SearchResult
+func (t *SimpleChaincode) batchSearchPersons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.runBatch(stub, args, t.searchPersonAndReturn)
+}
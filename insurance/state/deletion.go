@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Deleting a person only marks it with a tombstone, so its history stays
+// readable and the person can be restored. Deleted persons are hidden from
+// getPersonInfo unless includeDeleted is set, searches treat them as unknown
+// and they can not be updated. purgePerson removes the person with its history
+// and searches from state and the search details from the collections for
+// data-erasure requests; the ledger itself still holds the old values.
+
+//type for deletion mark of person
+type Tombstone struct {
+	Company string    `json:"company"`
+	User    string    `json:"user"`
+	Date    time.Time `json:"date"`
+	Reason  string    `json:"reason,omitempty"`
+}
+
+//returns person from state, nil if it does not exist
+func getPersonFromState(stub shim.ChaincodeStubInterface, hash string) (*Person, error) {
+	personBytes, err := stub.GetState(personPrfx + hash)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting person "+hash+" from state", err)
+	}
+	if len(personBytes) == 0 {
+		return nil, nil
+	}
+	person := &Person{}
+	err = json.Unmarshal(personBytes, person)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling person "+hash+" from state", err)
+	}
+	return person, nil
+}
+
+func (t *SimpleChaincode) deletePerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.setTombstone(stub, args, true)
+}
+
+func (t *SimpleChaincode) restorePerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.setTombstone(stub, args, false)
+}
+
+//marks person deleted or removes the mark, records ACTION_DELETE or ACTION_RESTORE;
+//only the company of the person and admins may do so, see checkPersonOwner
+func (t *SimpleChaincode) setTombstone(stub shim.ChaincodeStubInterface, args []string, deleted bool) pb.Response {
+	var req TombstoneRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hash := req.Hash
+	user, company, err := getCaller(stub, req.CallerArgs)
+	if err != nil {
+		return errorResponse(err)
+	}
+	action := ACTION_DELETE
+	if !deleted {
+		action = ACTION_RESTORE
+	}
+	logger.Infof("%s man with hash %s for user %s of company %s", action, hash, user, company)
+	person, err := getPersonFromState(stub, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if person == nil {
+		return errorResponse(&PersonError{Code: ERR_PERSON_NOT_FOUND, Message: "person does not exist", Field: "hash", Hash: hash})
+	}
+	err = checkPersonOwner(stub, person, company)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if deleted && person.Deleted != nil {
+		return errorResponse(&PersonError{Code: ERR_PERSON_DELETED, Message: "person is already deleted", Field: "hash", Hash: hash})
+	}
+	if !deleted && person.Deleted == nil {
+		return errorResponse(&PersonError{Code: ERR_PERSON_NOT_DELETED, Message: "person is not deleted", Field: "hash", Hash: hash})
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	person.Deleted = nil
+	if deleted {
+		person.Deleted = &Tombstone{Company: company, User: user, Date: txTime, Reason: req.Reason}
+	}
+	person.ModifyDate = txTime
+	err = putPersonInState(stub, hash, *person)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addHistoryRecord(stub, hash, action, user, company, person.Status, nil)
+	if err != nil {
+		return errorResponse(internalError(err, "Error putting new history record "+hash+" to state"))
+	}
+	err = emitPersonEvent(stub, action, hash, person.Status, person.Status, user, company)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+//removes person, its history and searches from state, recorded in the maintenance log
+func (t *SimpleChaincode) purgePerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req PurgeRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hash := req.Hash
+	person, err := getPersonFromState(stub, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if person == nil {
+		return errorResponse(&PersonError{Code: ERR_PERSON_NOT_FOUND, Message: "person does not exist", Field: "hash", Hash: hash})
+	}
+	err = addMaintenanceRecord(stub, MAINTENANCE_PURGE, personPrfx+hash, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.DelState(personPrfx + hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = updatePersonIndexes(stub, person, nil)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = updateStatusCounts(stub, person, nil)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = deleteEntries(stub, personHistoryObj, personHistoryPrfx, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = deletePrivateSearches(stub, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = deleteEntries(stub, personSearchObj, personSearchPrfx, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
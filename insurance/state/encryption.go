@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Selected person fields can be kept encrypted, so whoever reads the state
+// database of a peer does not see them. setEncryptionKey registers an AES-256
+// consortium key and the fields to encrypt. Like the hash key, the key never
+// reaches the ledger: clients send it in the transient map under
+// transientEncryptionKey and the chaincode keeps only a check value per key
+// version. The encrypted fields of a person are kept in Person.Encrypted,
+// tagged with the key version, and are empty in the person itself.
+// A write that sets an encrypted field needs the key of the person's version,
+// sent as transientEncryptionKey or transientOldEncryptionKey, and the
+// current key; other writes keep the encrypted fields as they are. History
+// records that an encrypted field changed but not its values.
+// getPersonInfo decrypts if the caller sends the key, reencryptPersons moves
+// persons to the current key version and encrypts persons stored before.
+// Fields only change with a new key version. Fields dropped from the config
+// stay encrypted until the person is encrypted with the new version, by
+// reencryptPersons or a write of an encrypted field, which decrypts them into
+// the person; reencryptPersons reports them.
+// The ciphertext is bound to the key version, the fields and the person hash,
+// so it can not be moved to another person; rekeyPersons encrypts moved
+// persons again and needs the keys for that.
+// AES-GCM must not use a nonce twice with one key and endorsers must write
+// the same bytes, so the nonce is an HMAC with the key of the transaction, the
+// person hash, the sealed fields and their plain values. Two seals in one
+// transaction, like a batch writing a person twice, get the same nonce only
+// for the same values, and then the same ciphertext.
+
+const (
+	// key of the field encryption config
+	encryptionConfigKey = "Config:fieldEncryption"
+
+	// transient map entries
+	transientEncryptionKey    = "encryptionKey"
+	transientOldEncryptionKey = "oldEncryptionKey"
+
+	// AES-256
+	encryptionKeySize       = 32
+	defaultReencryptPersons = 100
+
+	// HMAC input of the key check value
+	encryptionKeyCheckInput = "insurance person field key check"
+)
+
+// fields encrypted if setEncryptionKey is not given any
+var defaultEncryptedFields = []string{"notes", "contact"}
+
+//type for registered encryption key version, the key itself is not kept
+type EncryptionKeyVersion struct {
+	Version int       `json:"version"`
+	Check   string    `json:"check"`
+	Company string    `json:"company"`
+	User    string    `json:"user"`
+	Date    time.Time `json:"date"`
+}
+
+//type for field encryption config, Current is 0 while no key is set
+type FieldEncryption struct {
+	Current int                    `json:"current"`
+	Fields  []string               `json:"fields"`
+	Keys    []EncryptionKeyVersion `json:"keys"`
+}
+
+//type for encrypted fields of person
+type EncryptedFields struct {
+	KeyVersion int      `json:"keyVersion"`
+	Fields     []string `json:"fields"`
+	// base64 of nonce and AES-GCM ciphertext of the fields as JSON object
+	Data string `json:"data,omitempty"`
+}
+
+//type for result of reencryptPersons, done once no person of fromVersion is left
+type ReencryptResult struct {
+	FromVersion int      `json:"fromVersion"`
+	ToVersion   int      `json:"toVersion"`
+	Persons     []string `json:"persons"`
+	// fields dropped from the config that were decrypted into the persons
+	Decrypted []string `json:"decrypted,omitempty"`
+	Done      bool     `json:"done"`
+}
+
+//returns value that tells a key apart without revealing it
+func encryptionKeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(encryptionKeyCheckInput))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//returns the field encryption config, one without keys if none is set
+func loadFieldEncryption(stub shim.ChaincodeStubInterface) (*FieldEncryption, error) {
+	config := &FieldEncryption{Fields: []string{}, Keys: []EncryptionKeyVersion{}}
+	configBytes, err := stub.GetState(encryptionConfigKey)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting field encryption", err)
+	}
+	if len(configBytes) == 0 {
+		return config, nil
+	}
+	err = json.Unmarshal(configBytes, config)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling field encryption", err)
+	}
+	return config, nil
+}
+
+//returns true if the transient map holds an encryption key
+func hasEncryptionKey(stub shim.ChaincodeStubInterface) (bool, error) {
+	for _, name := range []string{transientEncryptionKey, transientOldEncryptionKey} {
+		key, err := getTransientValue(stub, name, false)
+		if err != nil {
+			return false, err
+		}
+		if len(key) != 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//returns the key of version from the transient map, sent as encryptionKey or oldEncryptionKey
+func getEncryptionKey(stub shim.ChaincodeStubInterface, config *FieldEncryption, version int) ([]byte, error) {
+	var check string
+	for _, v := range config.Keys {
+		if v.Version == version {
+			check = v.Check
+		}
+	}
+	found := false
+	for _, name := range []string{transientEncryptionKey, transientOldEncryptionKey} {
+		key, err := getTransientValue(stub, name, false)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) == 0 {
+			continue
+		}
+		found = true
+		if check != "" && hmac.Equal([]byte(check), []byte(encryptionKeyCheck(key))) {
+			return key, nil
+		}
+	}
+	if !found {
+		return nil, newError(ERR_MISSING_FIELD, "transient."+transientEncryptionKey, transientEncryptionKey+" is missing in the transient map")
+	}
+	return nil, newError(ERR_UNKNOWN_ENCRYPTION_KEY, "transient."+transientEncryptionKey, fmt.Sprintf("the transient map holds no encryption key of version %d", version))
+}
+
+//returns AES-GCM of key
+func fieldCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//returns the data authenticated with the ciphertext, so neither the tag nor the person can be changed
+func encryptedFieldsData(version int, hash string, fields []string) []byte {
+	return []byte(fmt.Sprintf("v%d|%s|%s", version, hash, strings.Join(fields, ",")))
+}
+
+//returns fields of person that are or will be encrypted
+func (c *FieldEncryption) encryptedFields(person *Person) []string {
+	var fields []string
+	if c.Current != 0 {
+		fields = append(fields, c.Fields...)
+	}
+	if person.Encrypted != nil {
+		for _, field := range person.Encrypted.Fields {
+			if !containsField(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+//returns the encrypted fields of person that are no longer configured
+func (c *FieldEncryption) droppedFields(person *Person) []string {
+	var fields []string
+	if person.Encrypted == nil {
+		return nil
+	}
+	for _, field := range person.Encrypted.Fields {
+		if !containsField(c.Fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+//returns the configured fields of person that hold a value
+func (c *FieldEncryption) fieldsToSeal(person *Person) []string {
+	var fields []string
+	for _, field := range c.Fields {
+		value := personFieldValue(person, field)
+		if value != nil && value != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// Encrypts the configured fields of person that hold a value with the
+// current key and empties them. A person with no such value is left plain.
+func sealPerson(stub shim.ChaincodeStubInterface, config *FieldEncryption, person *Person) error {
+	values := make(map[string]interface{})
+	fields := config.fieldsToSeal(person)
+	for _, field := range fields {
+		values[field] = personFieldValue(person, field)
+	}
+	person.Encrypted = nil
+	if len(fields) == 0 {
+		return nil
+	}
+	key, err := getEncryptionKey(stub, config, config.Current)
+	if err != nil {
+		return err
+	}
+	aead, err := fieldCipher(key)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error creating cipher", err)
+	}
+	plain, err := json.Marshal(values)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error marshalling fields of person "+person.Hash, err)
+	}
+	data := encryptedFieldsData(config.Current, person.Hash, fields)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(stub.GetTxID() + "|" + person.Hash + "|"))
+	mac.Write(data)
+	mac.Write([]byte("|"))
+	mac.Write(plain)
+	nonce := append([]byte{}, mac.Sum(nil)[:aead.NonceSize()]...)
+	sealed := aead.Seal(nonce, nonce, plain, data)
+	mergePerson(person, &Person{}, fields)
+	person.Encrypted = &EncryptedFields{
+		KeyVersion: config.Current,
+		Fields:     fields,
+		Data:       base64.StdEncoding.EncodeToString(sealed),
+	}
+	return nil
+}
+
+//decrypts the encrypted fields of person with the key of their version from the transient map
+func openPerson(stub shim.ChaincodeStubInterface, config *FieldEncryption, person *Person) error {
+	sealed := person.Encrypted
+	if sealed == nil {
+		return nil
+	}
+	key, err := getEncryptionKey(stub, config, sealed.KeyVersion)
+	if err != nil {
+		return err
+	}
+	aead, err := fieldCipher(key)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error creating cipher", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed.Data)
+	if err != nil || len(data) < aead.NonceSize() {
+		return newError(ERR_INTERNAL, "", "invalid encrypted fields of person "+person.Hash)
+	}
+	nonce := data[:aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[aead.NonceSize():], encryptedFieldsData(sealed.KeyVersion, person.Hash, sealed.Fields))
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error decrypting fields of person "+person.Hash, err)
+	}
+	var values Person
+	err = json.Unmarshal(plain, &values)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error unmarshalling fields of person "+person.Hash, err)
+	}
+	mergePerson(person, &values, sealed.Fields)
+	person.Encrypted = nil
+	return nil
+}
+
+// Encrypts the encrypted fields of person again for newHash, as the
+// ciphertext is bound to the hash, and sets the hash. Needs the key of the
+// person's version and the current key in the transient map.
+func moveEncryptedFields(stub shim.ChaincodeStubInterface, person *Person, newHash string) error {
+	if person.Encrypted == nil {
+		person.Hash = newHash
+		return nil
+	}
+	config, err := loadFieldEncryption(stub)
+	if err != nil {
+		return err
+	}
+	err = openPerson(stub, config, person)
+	if err != nil {
+		return err
+	}
+	person.Hash = newHash
+	return sealPerson(stub, config, person)
+}
+
+// Decrypts the encrypted fields of person if the caller sends a key and keeps
+// their tag without the ciphertext, so the caller knows which fields were
+// encrypted. Returns false if person is left as it is.
+func revealPerson(stub shim.ChaincodeStubInterface, person *Person) (bool, error) {
+	if person.Encrypted == nil {
+		return false, nil
+	}
+	decrypt, err := hasEncryptionKey(stub)
+	if err != nil || !decrypt {
+		return false, err
+	}
+	config, err := loadFieldEncryption(stub)
+	if err != nil {
+		return false, err
+	}
+	sealed := *person.Encrypted
+	err = openPerson(stub, config, person)
+	if err != nil {
+		return false, err
+	}
+	sealed.Data = ""
+	person.Encrypted = &sealed
+	return true, nil
+}
+
+// Decrypts person before a write of fields if the write sets an encrypted
+// field. Returns the encrypted fields the write sets, nil if it sets none.
+func openForWrite(stub shim.ChaincodeStubInterface, config *FieldEncryption, person *Person, fields []string) ([]string, error) {
+	var involved []string
+	for _, field := range config.encryptedFields(person) {
+		if containsField(fields, field) {
+			involved = append(involved, field)
+		}
+	}
+	if len(involved) == 0 {
+		return nil, nil
+	}
+	return involved, openPerson(stub, config, person)
+}
+
+// Encrypts person again after a write opened by openForWrite and drops the
+// values of the encrypted fields from changes.
+func sealAfterWrite(stub shim.ChaincodeStubInterface, config *FieldEncryption, person *Person, involved []string, changes []FieldChange) ([]FieldChange, error) {
+	err := sealPerson(stub, config, person)
+	if err != nil {
+		return nil, err
+	}
+	for i := range changes {
+		if containsField(involved, changes[i].Field) {
+			changes[i] = FieldChange{Field: changes[i].Field, Encrypted: true}
+		}
+	}
+	return changes, nil
+}
+
+// Registers the key of the transient map as new current encryption key
+// version. The fields to encrypt are kept unless the request lists them.
+func (t *SimpleChaincode) setEncryptionKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req EncryptionKeyRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := getTransientValue(stub, transientEncryptionKey, true)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(key) != encryptionKeySize {
+		return errorResponse(newError(ERR_INVALID_FIELD, "transient."+transientEncryptionKey, fmt.Sprintf("%s must be %d bytes", transientEncryptionKey, encryptionKeySize)))
+	}
+	config, err := loadFieldEncryption(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	check := encryptionKeyCheck(key)
+	for _, v := range config.Keys {
+		if v.Check == check {
+			return errorResponse(newError(ERR_INVALID_FIELD, "transient."+transientEncryptionKey, fmt.Sprintf("%s is registered as version %d already", transientEncryptionKey, v.Version)))
+		}
+	}
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	keyVersion := EncryptionKeyVersion{
+		Version: config.Current + 1,
+		Check:   check,
+		Company: company,
+		User:    user,
+		Date:    txTime,
+	}
+	config.Keys = append(config.Keys, keyVersion)
+	config.Current = keyVersion.Version
+	if len(req.Fields) != 0 {
+		config.Fields = nil
+		for _, field := range req.Fields {
+			if !containsField(config.Fields, field) {
+				config.Fields = append(config.Fields, field)
+			}
+		}
+	} else if len(config.Fields) == 0 {
+		config.Fields = defaultEncryptedFields
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addMaintenanceRecord(stub, MAINTENANCE_SET_ENCRYPTION_KEY, encryptionConfigKey, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	logger.Noticef("encryption key version %d set by %s of %s for %v", keyVersion.Version, user, company, config.Fields)
+	err = stub.PutState(encryptionConfigKey, configBytes)
+	if err != nil {
+		return errorResponse(wrapError(ERR_INTERNAL, "Error putting field encryption", err))
+	}
+	versionBytes, err := json.Marshal(&keyVersion)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(versionBytes)
+}
+
+func (t *SimpleChaincode) getFieldEncryption(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	config, err := loadFieldEncryption(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	configBytes, err := json.Marshal(config)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(configBytes)
+}
+
+// Encrypts up to limit persons of key version fromVersion with the current
+// key; fromVersion 0 encrypts persons stored before encryption was set. The
+// current key and, unless fromVersion is 0, the old key are taken from the
+// transient map. Called until the result is done.
+func (t *SimpleChaincode) reencryptPersons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req ReencryptRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	from := *req.FromVersion
+	limit := defaultReencryptPersons
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	config, err := loadFieldEncryption(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if config.Current == 0 {
+		return errorResponse(newError(ERR_UNKNOWN_ENCRYPTION_KEY, "", "no encryption key is set"))
+	}
+	if from >= config.Current {
+		return errorResponse(newError(ERR_INVALID_FIELD, "fromVersion", fmt.Sprintf("fromVersion must be below the current key version %d", config.Current)))
+	}
+	//check the keys before anything is written
+	_, err = getEncryptionKey(stub, config, config.Current)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if from > 0 {
+		_, err = getEncryptionKey(stub, config, from)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	result := &ReencryptResult{FromVersion: from, ToVersion: config.Current, Persons: []string{}, Done: true}
+	var persons []Person
+	//';' follows ':', so the range holds all person keys
+	resultsIterator, err := stub.GetStateByRange(personPrfx, personPrfx[:len(personPrfx)-1]+";")
+	if err != nil {
+		return errorResponse(wrapError(ERR_INTERNAL, "Error reading persons", err))
+	}
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return errorResponse(wrapError(ERR_INTERNAL, "Error reading persons", err))
+		}
+		var person Person
+		err = json.Unmarshal(kv.Value, &person)
+		if err != nil {
+			resultsIterator.Close()
+			return errorResponse(wrapError(ERR_INTERNAL, "Error unmarshalling person "+kv.Key, err))
+		}
+		if from == 0 && (person.Encrypted != nil || len(config.fieldsToSeal(&person)) == 0) {
+			continue
+		}
+		if from > 0 && (person.Encrypted == nil || person.Encrypted.KeyVersion != from) {
+			continue
+		}
+		if len(persons) == limit {
+			result.Done = false
+			break
+		}
+		persons = append(persons, person)
+	}
+	resultsIterator.Close()
+	for i := range persons {
+		person := &persons[i]
+		for _, field := range config.droppedFields(person) {
+			if !containsField(result.Decrypted, field) {
+				result.Decrypted = append(result.Decrypted, field)
+			}
+		}
+		err = openPerson(stub, config, person)
+		if err != nil {
+			return errorResponse(err)
+		}
+		err = sealPerson(stub, config, person)
+		if err != nil {
+			return errorResponse(err)
+		}
+		err = putPersonInState(stub, person.Hash, *person)
+		if err != nil {
+			return errorResponse(err)
+		}
+		result.Persons = append(result.Persons, person.Hash)
+	}
+	logger.Infof("encrypted %d persons of key version %d with version %d, decrypted %v", len(result.Persons), from, config.Current, result.Decrypted)
+	err = addMaintenanceRecord(stub, MAINTENANCE_REENCRYPT, encryptionConfigKey, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Entries are the append-only records kept per person (history actions and
+// searches). Each entry lives under its own composite key
+// <objectType, hash, time, txID>, so writing one never touches the others and
+// concurrent transactions on the same person do not conflict.
+// Fabric iterates keys in ascending order only, so every entry is also
+// listed newest first under <entryNewestObj, objectType, hash, newest time, txID>,
+// with the digits of the time inverted; pages in either order read no more
+// keys than they return.
+// Before that all entries of a person were kept as one JSON array under
+// <legacyPrfx><hash>; such arrays are still read and can be moved to single
+// entries with migrateLegacyEntries, which also lists entries stored before
+// the newest first keys.
+
+const (
+	// fixed width time layout, so entry keys sort by time
+	entryTimeLayout = "2006-01-02T15:04:05.000000000Z"
+	// composite key type of the newest first list of entries
+	entryNewestObj = "EntryNewest"
+)
+
+//returns time of entry key with inverted digits, so later times sort first
+func invertEntryTime(entryTime string) string {
+	inverted := []byte(entryTime)
+	for i, c := range inverted {
+		if c >= '0' && c <= '9' {
+			inverted[i] = '9' - (c - '0')
+		}
+	}
+	return string(inverted)
+}
+
+//returns key of entry in the newest first list for the attributes of its key
+func newestEntryKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string) (string, error) {
+	if len(attributes) != 3 {
+		return "", fmt.Errorf("invalid entry attributes %v", attributes)
+	}
+	return stub.CreateCompositeKey(entryNewestObj, []string{objectType, attributes[0], invertEntryTime(attributes[1]), attributes[2]})
+}
+
+//put single entry of person to state
+func putEntry(stub shim.ChaincodeStubInterface, objectType string, hash string, date time.Time, id string, value []byte) error {
+	attributes := []string{hash, date.UTC().Format(entryTimeLayout), id}
+	key, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, value)
+	if err != nil {
+		return err
+	}
+	return putNewestEntryKey(stub, objectType, attributes)
+}
+
+//lists entry with the attributes of its key newest first
+func putNewestEntryKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string) error {
+	newestKey, err := newestEntryKey(stub, objectType, attributes)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(newestKey, indexValue)
+}
+
+//returns entries of person oldest first, legacy entries first
+func getEntries(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string) ([]json.RawMessage, error) {
+	entries, _, err := getEntriesWithTxIDs(stub, objectType, legacyPrfx, hash)
+	return entries, err
+}
+
+// Returns entries of person like getEntries and the ID of the transaction
+// that wrote each. Entries of legacy arrays have none.
+func getEntriesWithTxIDs(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string) ([]json.RawMessage, []string, error) {
+	var entries []json.RawMessage
+	var txIDs []string
+	legacy, err := getLegacyEntries(stub, legacyPrfx, hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := len(legacy) - 1; i >= 0; i-- {
+		entries = append(entries, legacy[i])
+		txIDs = append(txIDs, "")
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{hash})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, json.RawMessage(kv.Value))
+		//migrated legacy entries are numbered, see moveLegacyEntries
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) != 3 || strings.HasPrefix(attributes[2], "legacy") {
+			txIDs = append(txIDs, "")
+			continue
+		}
+		txIDs = append(txIDs, attributes[2])
+	}
+	return entries, txIDs, nil
+}
+
+// Returns entries of person as JSON. Without paging that is the whole list in
+// LIFO order, nil if there are none; with paging a Page of entries read by
+// getEntriesPage. reveal, when not nil, replaces the returned entries, so
+// only those on the page are read beyond state.
+func getEntriesAsBytes(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string, page *PageRequest, reveal revealFunc) ([]byte, error) {
+	if page == nil {
+		entries, err := getEntries(stub, objectType, legacyPrfx, hash)
+		if err != nil {
+			return nil, err
+		}
+		return entriesAsBytes(entries, nil, reveal)
+	}
+	records, bookmark, total, err := getEntriesPage(stub, objectType, legacyPrfx, hash, page)
+	if err != nil {
+		return nil, err
+	}
+	err = revealEntries(records, reveal)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&Page{Records: records, Bookmark: bookmark, Total: total})
+}
+
+//returns number of entries of person, legacy entries included
+func countEntries(stub shim.ChaincodeStubInterface, objectType string, hash string, legacy []json.RawMessage) (int, error) {
+	total := len(legacy)
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{hash})
+	if err != nil {
+		return 0, err
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		_, err := resultsIterator.Next()
+		if err != nil {
+			return 0, err
+		}
+		total++
+	}
+	return total, nil
+}
+
+// Returns one page of entries of person in the order of page, the bookmark
+// of the next page, empty after the last one, and the number of entries.
+// Entries are read a page at a time from state. The bookmark is the number of
+// entries and the key of the next entry, base64 encoded, or
+// legacyBookmarkPrfx and the position of the next entry of a legacy array; so
+// a bookmark stays valid when entries are added between calls, and only the
+// first page counts the entries.
+func getEntriesPage(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string, page *PageRequest) ([]json.RawMessage, string, int, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, []string{hash})
+	if page.Order == ORDER_NEWEST && err == nil {
+		prefix, err = stub.CreateCompositeKey(entryNewestObj, []string{objectType, hash})
+	}
+	if err != nil {
+		return nil, "", 0, err
+	}
+	legacy, err := getLegacyEntries(stub, legacyPrfx, hash)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	invalid := newError(ERR_INVALID_FIELD, "bookmark", "invalid bookmark "+page.Bookmark)
+	var total int
+	legacyPos, startKey := -1, ""
+	if page.Bookmark == "" {
+		total, err = countEntries(stub, objectType, hash, legacy)
+		if err != nil {
+			return nil, "", 0, err
+		}
+	} else {
+		parts := strings.SplitN(page.Bookmark, ":", 2)
+		total, err = strconv.Atoi(parts[0])
+		if err != nil || total < 0 || len(parts) != 2 {
+			return nil, "", 0, invalid
+		}
+		if strings.HasPrefix(parts[1], legacyBookmarkPrfx) {
+			legacyPos, err = strconv.Atoi(parts[1][len(legacyBookmarkPrfx):])
+			if err != nil || legacyPos < 0 || legacyPos >= len(legacy) {
+				return nil, "", 0, invalid
+			}
+		} else {
+			keyBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+			if err != nil || !strings.HasPrefix(string(keyBytes), prefix) {
+				return nil, "", 0, invalid
+			}
+			startKey = string(keyBytes)
+		}
+	}
+	var records []json.RawMessage
+	var bookmark string
+	if page.Order == ORDER_OLDEST {
+		records, bookmark, err = getOldestEntriesPage(stub, objectType, hash, page.PageSize, prefix, legacy, legacyPos, startKey)
+	} else {
+		records, bookmark, err = getNewestEntriesPage(stub, objectType, hash, page.PageSize, legacy, legacyPos, startKey)
+	}
+	if err != nil || bookmark == "" {
+		return records, "", total, err
+	}
+	return records, strconv.Itoa(total) + ":" + bookmark, total, nil
+}
+
+// bookmark of entries pages within a legacy array
+const legacyBookmarkPrfx = "legacy:"
+
+//returns page of entries oldest first, legacy entries before the keyed ones
+func getOldestEntriesPage(stub shim.ChaincodeStubInterface, objectType string, hash string, pageSize int, prefix string, legacy []json.RawMessage, legacyPos int, startKey string) ([]json.RawMessage, string, error) {
+	var records []json.RawMessage
+	if startKey == "" {
+		//legacy arrays are kept newest first
+		pos := 0
+		if legacyPos > 0 {
+			pos = legacyPos
+		}
+		for ; pos < len(legacy) && len(records) < pageSize; pos++ {
+			records = append(records, legacy[len(legacy)-1-pos])
+		}
+		if len(records) == pageSize {
+			if pos < len(legacy) {
+				return records, legacyBookmarkPrfx + strconv.Itoa(pos), nil
+			}
+			//keyed entries may follow
+			return records, base64.RawURLEncoding.EncodeToString([]byte(prefix)), nil
+		}
+	}
+	want := pageSize - len(records)
+	resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, []string{hash}, int32(want), startKey)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resultsIterator.Close()
+	read := 0
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return nil, "", err
+		}
+		records = append(records, json.RawMessage(kv.Value))
+		read++
+	}
+	if read == want && metadata != nil && metadata.Bookmark != "" {
+		return records, base64.RawURLEncoding.EncodeToString([]byte(metadata.Bookmark)), nil
+	}
+	return records, "", nil
+}
+
+// Returns page of entries newest first, legacy entries after the keyed ones.
+// Keyed entries are read by their keys in the newest first list.
+func getNewestEntriesPage(stub shim.ChaincodeStubInterface, objectType string, hash string, pageSize int, legacy []json.RawMessage, legacyPos int, startKey string) ([]json.RawMessage, string, error) {
+	var records []json.RawMessage
+	if legacyPos < 0 {
+		resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(entryNewestObj, []string{objectType, hash}, int32(pageSize), startKey)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resultsIterator.Close()
+		read := 0
+		for resultsIterator.HasNext() {
+			kv, err := resultsIterator.Next()
+			if err != nil {
+				return nil, "", err
+			}
+			read++
+			_, attributes, err := stub.SplitCompositeKey(kv.Key)
+			if err != nil || len(attributes) != 4 {
+				return nil, "", newError(ERR_INTERNAL, "", "invalid entry key "+kv.Key)
+			}
+			key, err := stub.CreateCompositeKey(objectType, []string{hash, invertEntryTime(attributes[2]), attributes[3]})
+			if err != nil {
+				return nil, "", err
+			}
+			value, err := stub.GetState(key)
+			if err != nil {
+				return nil, "", err
+			}
+			if len(value) == 0 {
+				logger.Warningf("entry %s listed newest first is missing", key)
+				continue
+			}
+			records = append(records, json.RawMessage(value))
+		}
+		if read == pageSize && metadata != nil && metadata.Bookmark != "" {
+			return records, base64.RawURLEncoding.EncodeToString([]byte(metadata.Bookmark)), nil
+		}
+		legacyPos = 0
+	}
+	pos := legacyPos
+	for ; pos < len(legacy) && len(records) < pageSize; pos++ {
+		records = append(records, legacy[pos])
+	}
+	if pos < len(legacy) {
+		return records, legacyBookmarkPrfx + strconv.Itoa(pos), nil
+	}
+	return records, "", nil
+}
+
+//returns entry as shown to the caller
+type revealFunc func(entry json.RawMessage) (json.RawMessage, error)
+
+//returns entries kept oldest first as JSON, see getEntriesAsBytes
+func entriesAsBytes(entries []json.RawMessage, page *PageRequest, reveal revealFunc) ([]byte, error) {
+	var records []json.RawMessage
+	if page == nil {
+		if len(entries) == 0 {
+			return nil, nil
+		}
+		records = make([]json.RawMessage, 0, len(entries))
+		for i := len(entries) - 1; i >= 0; i-- {
+			records = append(records, entries[i])
+		}
+		err := revealEntries(records, reveal)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(records)
+	}
+	positions, bookmark, err := page.positions(len(entries))
+	if err != nil {
+		return nil, err
+	}
+	records = make([]json.RawMessage, 0, len(positions))
+	for _, pos := range positions {
+		records = append(records, entries[pos])
+	}
+	err = revealEntries(records, reveal)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&Page{Records: records, Bookmark: bookmark, Total: len(entries)})
+}
+
+//replaces records by what reveal returns for them
+func revealEntries(records []json.RawMessage, reveal revealFunc) error {
+	if reveal == nil {
+		return nil
+	}
+	for i, record := range records {
+		revealed, err := reveal(record)
+		if err != nil {
+			return err
+		}
+		records[i] = revealed
+	}
+	return nil
+}
+
+//returns entries of the legacy JSON array in stored (LIFO) order
+func getLegacyEntries(stub shim.ChaincodeStubInterface, legacyPrfx string, hash string) ([]json.RawMessage, error) {
+	var entries []json.RawMessage
+	entriesBytes, err := stub.GetState(legacyPrfx + hash)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting legacy list for person "+hash, err)
+	}
+	if len(entriesBytes) == 0 {
+		return nil, nil
+	}
+	err = json.Unmarshal(entriesBytes, &entries)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling legacy list for person "+hash, err)
+	}
+	return entries, nil
+}
+
+// Moves legacy JSON array of person to single entries and removes the array.
+// Lists entries stored before the newest first list in it.
+func migrateLegacyEntries(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{hash})
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return err
+		}
+		keys = append(keys, kv.Key)
+	}
+	resultsIterator.Close()
+	for _, key := range keys {
+		_, attributes, err := stub.SplitCompositeKey(key)
+		if err == nil {
+			err = putNewestEntryKey(stub, objectType, attributes)
+		}
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error listing entry "+key, err)
+		}
+	}
+	return moveLegacyEntries(stub, objectType, legacyPrfx, hash, hash)
+}
+
+//moves legacy JSON array of person hash to single entries of person toHash
+func moveLegacyEntries(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string, toHash string) error {
+	entries, err := getLegacyEntries(stub, legacyPrfx, hash)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	//oldest entry first, so the sequence number follows the original order
+	for i := len(entries) - 1; i >= 0; i-- {
+		var dated struct {
+			Date time.Time `json:"date"`
+		}
+		err = json.Unmarshal(entries[i], &dated)
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error unmarshalling legacy entry for person "+hash, err)
+		}
+		id := fmt.Sprintf("legacy%06d", len(entries)-1-i)
+		err = putEntry(stub, objectType, toHash, dated.Date, id, entries[i])
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error putting migrated entry for person "+hash, err)
+		}
+	}
+	err = stub.DelState(legacyPrfx + hash)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error deleting legacy list for person "+hash, err)
+	}
+	logger.Infof("migrated %d entries of %s for %s", len(entries), objectType, hash)
+	return nil
+}
+
+// Moves all entries of person hash to person toHash, the legacy JSON array
+// included. Entries keep their time and ID.
+func moveEntries(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string, toHash string) error {
+	var keys []string
+	var values [][]byte
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{hash})
+	if err != nil {
+		return err
+	}
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return err
+		}
+		keys = append(keys, kv.Key)
+		values = append(values, kv.Value)
+	}
+	resultsIterator.Close()
+	for i, key := range keys {
+		_, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil || len(attributes) != 3 {
+			return newError(ERR_INTERNAL, "", "invalid entry key "+key)
+		}
+		newKey, err := stub.CreateCompositeKey(objectType, []string{toHash, attributes[1], attributes[2]})
+		if err != nil {
+			return err
+		}
+		err = stub.PutState(newKey, values[i])
+		if err == nil {
+			err = putNewestEntryKey(stub, objectType, []string{toHash, attributes[1], attributes[2]})
+		}
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error putting entry for person "+toHash, err)
+		}
+		newestKey, err := newestEntryKey(stub, objectType, attributes)
+		if err == nil {
+			err = stub.DelState(key)
+		}
+		if err == nil {
+			err = stub.DelState(newestKey)
+		}
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error deleting entry for person "+hash, err)
+		}
+	}
+	logger.Infof("moved %d entries of %s from %s to %s", len(keys), objectType, hash, toHash)
+	return moveLegacyEntries(stub, objectType, legacyPrfx, hash, toHash)
+}
+
+//removes all entries of person, the legacy JSON array and newest first list included
+func deleteEntries(stub shim.ChaincodeStubInterface, objectType string, legacyPrfx string, hash string) error {
+	var keys []string
+	var newestKeys []string
+	for _, list := range [][]string{{objectType, hash}, {entryNewestObj, objectType, hash}} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(list[0], list[1:])
+		if err != nil {
+			return err
+		}
+		for resultsIterator.HasNext() {
+			kv, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return err
+			}
+			if list[0] == entryNewestObj {
+				newestKeys = append(newestKeys, kv.Key)
+			} else {
+				keys = append(keys, kv.Key)
+			}
+		}
+		resultsIterator.Close()
+	}
+	for _, key := range append(keys, newestKeys...) {
+		err := stub.DelState(key)
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error deleting entry for person "+hash, err)
+		}
+	}
+	err := stub.DelState(legacyPrfx + hash)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error deleting legacy list for person "+hash, err)
+	}
+	logger.Infof("deleted %d entries of %s for %s", len(keys), objectType, hash)
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every error response of the chaincode is a JSON object
+//
+//	{"code": "...", "message": "...", "field": "...", "cause": "..."}
+//
+// Clients switch on code, the codes below are stable. message is meant for
+// humans and may change, field names the offending argument field and cause
+// is the error the chaincode got from below, both only when known. Some codes
+// add fields of their own, see PersonError, StatusError and BatchResult.
+const (
+	// argument is not one JSON object or has wrong number of parts
+	ERR_INVALID_ARGUMENT = "INVALID_ARGUMENT"
+	// required field is missing or empty
+	ERR_MISSING_FIELD = "MISSING_FIELD"
+	// field has wrong type or value
+	ERR_INVALID_FIELD = "INVALID_FIELD"
+	// field is not known to the function
+	ERR_UNKNOWN_FIELD = "UNKNOWN_FIELD"
+	// argument has invalid fields, details holds a FieldError per field
+	ERR_VALIDATION_FAILED = "VALIDATION_FAILED"
+	// function is not known to Invoke
+	ERR_UNKNOWN_FUNCTION = "UNKNOWN_FUNCTION"
+	// transaction creator has no role for the function or the change is forbidden
+	ERR_ACCESS_DENIED = "ACCESS_DENIED"
+	// transaction creator identity can not be read
+	ERR_INVALID_IDENTITY = "INVALID_IDENTITY"
+	// user or company in the argument differ from the transaction creator
+	ERR_CALLER_MISMATCH = "CALLER_MISMATCH"
+	// key can be changed only while repair mode is enabled
+	ERR_REPAIR_MODE_REQUIRED = "REPAIR_MODE_REQUIRED"
+	// status is not one of the known statuses
+	ERR_UNKNOWN_STATUS = "UNKNOWN_STATUS"
+	// status transition table does not allow the change
+	ERR_ILLEGAL_STATUS_TRANSITION = "ILLEGAL_STATUS_TRANSITION"
+	// person to insert exists already
+	ERR_PERSON_EXISTS = "PERSON_ALREADY_EXISTS"
+	// person to change does not exist
+	ERR_PERSON_NOT_FOUND = "PERSON_NOT_FOUND"
+	// person to change is deleted
+	ERR_PERSON_DELETED = "PERSON_DELETED"
+	// person to restore is not deleted
+	ERR_PERSON_NOT_DELETED = "PERSON_NOT_DELETED"
+	// hash is used by two items of one batch
+	ERR_DUPLICATE_HASH = "DUPLICATE_HASH"
+	// hash of new person is not of the current hash key version
+	ERR_HASH_VERSION = "HASH_VERSION_MISMATCH"
+	// hash key in the transient map is not the registered key of the needed version
+	ERR_UNKNOWN_HASH_KEY = "UNKNOWN_HASH_KEY"
+	// encryption key in the transient map is not the registered key of the needed version
+	ERR_UNKNOWN_ENCRYPTION_KEY = "UNKNOWN_ENCRYPTION_KEY"
+	// all-or-nothing batch has failed items, details holds the BatchResult
+	ERR_BATCH_FAILED = "BATCH_FAILED"
+	// reading or writing state failed, retrying may help
+	ERR_INTERNAL = "INTERNAL"
+)
+
+//type for error returned to the client as JSON
+type ChaincodeError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Field   string      `json:"field,omitempty"`
+	Cause   string      `json:"cause,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *ChaincodeError) Error() string {
+	errBytes, _ := json.Marshal(e)
+	return string(errBytes)
+}
+
+//type for rejected person write, returned to the client as JSON
+type PersonError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Field   string `json:"field"`
+	Hash    string `json:"hash"`
+}
+
+func (e *PersonError) Error() string {
+	errBytes, _ := json.Marshal(e)
+	return string(errBytes)
+}
+
+//returns error with code, field may be empty
+func newError(code string, field string, message string) *ChaincodeError {
+	return &ChaincodeError{Code: code, Field: field, Message: message}
+}
+
+//returns error with code and cause, cause may be nil
+func wrapError(code string, message string, cause error) *ChaincodeError {
+	res := &ChaincodeError{Code: code, Message: message}
+	if cause != nil {
+		res.Cause = cause.Error()
+	}
+	return res
+}
+
+//returns err if it has a code, else ERR_INTERNAL error with message and err as cause
+func internalError(err error, message string) error {
+	if hasErrorCode(err) {
+		return err
+	}
+	return wrapError(ERR_INTERNAL, message, err)
+}
+
+func hasErrorCode(err error) bool {
+	switch err.(type) {
+	case *ChaincodeError, *StatusError, *PersonError:
+		return true
+	}
+	return false
+}
+
+//returns error response with err as JSON, errors without code become ERR_INTERNAL
+func errorResponse(err error) pb.Response {
+	if !hasErrorCode(err) {
+		err = wrapError(ERR_INTERNAL, err.Error(), nil)
+	}
+	return shim.Error(err.Error())
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Person writes and searches emit a chaincode event, so clients can listen
+// instead of polling getPersonInfo. A transaction carries at most one event.
+// Event names per action are kept in state under eventNamesKey and override
+// defaultEventNames; an empty name turns the event of that action off.
+// Search events leave out company and user, who searched whom is kept in
+// private data collections, see searches.go.
+
+// key of configured event names
+var eventNamesKey = "Config:eventNames"
+
+var defaultEventNames = map[string]string{
+	ACTION_INSERT:  "PersonCreated",
+	ACTION_UPDATE:  "PersonUpdated",
+	ACTION_DELETE:  "PersonDeleted",
+	ACTION_RESTORE: "PersonRestored",
+	ACTION_SEARCH:  "PersonSearched",
+	ACTION_BATCH:   "PersonBatch",
+}
+
+//type for payload of person event
+type PersonEvent struct {
+	Hash      string       `json:"hash"`
+	Action    string       `json:"action"`
+	OldStatus PersonStatus `json:"oldStatus,omitempty"`
+	NewStatus PersonStatus `json:"newStatus"`
+	Company   string       `json:"company,omitempty"`
+	User      string       `json:"user,omitempty"`
+	TxID      string       `json:"txId"`
+	Date      time.Time    `json:"date"`
+}
+
+//returns configured event names, the default if none are configured
+func loadEventNames(stub shim.ChaincodeStubInterface) (map[string]string, error) {
+	namesBytes, err := stub.GetState(eventNamesKey)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting event names", err)
+	}
+	if len(namesBytes) == 0 {
+		return defaultEventNames, nil
+	}
+	names := make(map[string]string)
+	err = json.Unmarshal(namesBytes, &names)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling event names", err)
+	}
+	return names, nil
+}
+
+//sets event of action on person for the transaction, oldStatus is empty for a new person
+func emitPersonEvent(stub shim.ChaincodeStubInterface, action string, hash string, oldStatus PersonStatus, newStatus PersonStatus, user string, company string) error {
+	names, err := loadEventNames(stub)
+	if err != nil {
+		return err
+	}
+	name := names[action]
+	if name == "" {
+		return nil
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	if action == ACTION_SEARCH {
+		user, company = "", ""
+	}
+	event := &PersonEvent{
+		Hash:      hash,
+		Action:    action,
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		Company:   company,
+		User:      user,
+		TxID:      stub.GetTxID(),
+		Date:      txTime,
+	}
+	eventBytes, err := json.Marshal(event)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error marshalling person event", err)
+	}
+	logger.Debugf("event %s for %s", name, hash)
+	return stub.SetEvent(name, eventBytes)
+}
+
+//returns person status before a write of createOrUpdatePerson
+func statusBefore(person Person, action string, changes []FieldChange) PersonStatus {
+	if action == ACTION_INSERT {
+		return ""
+	}
+	for _, change := range changes {
+		if change.Field == "status" {
+			return change.Old.(PersonStatus)
+		}
+	}
+	return person.Status
+}
+
+//replaces the event names, actions missing in the arg keep their default name
+func (t *SimpleChaincode) setEventNames(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req EventNamesRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	names := make(map[string]string)
+	for action, name := range defaultEventNames {
+		names[action] = name
+	}
+	for action, name := range req.names() {
+		if name != nil {
+			names[action] = *name
+		}
+	}
+	namesBytes, err := json.Marshal(names)
+	if err != nil {
+		return errorResponse(err)
+	}
+	logger.Infof("set event names %s", string(namesBytes))
+	err = stub.PutState(eventNamesKey, namesBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) getEventNames(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	names, err := loadEventNames(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	namesBytes, err := json.Marshal(names)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(namesBytes)
+}
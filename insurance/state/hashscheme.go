@@ -0,0 +1,507 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Person hashes are keyed, so reading the ledger does not allow to guess the
+// identifier behind a hash. A hash is the HMAC-SHA256 of the normalized
+// person identifier (see PersonIdentifier.normalize) with a consortium key,
+// written with the version of the key as v<version>-<64 hex>.
+// The key never reaches the ledger: clients send it in the transient map
+// under transientHashKey, the chaincode keeps only a check value per key
+// version to recognize it. setHashKey registers a new key version,
+// derivePersonHash computes the hash of an identifier and rekeyPersons moves
+// persons to the hash of the current key.
+// Hashes of persons stored before the scheme are version 0: bare hex SHA-256
+// or any other string the caller chose, which requests still accept.
+// Existing persons are found under any version, new persons need a hash of
+// the current version.
+
+const (
+	// key of the registered hash key versions
+	hashSchemeKey = "Config:hashScheme"
+
+	// transient map entries
+	transientHashKey      = "hashKey"
+	transientOldHashKey   = "oldHashKey"
+	transientPersonID     = "personId"
+	transientRekeyPersons = "persons"
+
+	minHashKeySize = 32
+	maxRekeyItems  = 100
+
+	// HMAC input of the key check value
+	hashKeyCheckInput = "insurance person hash key check"
+)
+
+//type for registered hash key version, the key itself is not kept
+type HashKeyVersion struct {
+	Version int       `json:"version"`
+	Check   string    `json:"check"`
+	Company string    `json:"company"`
+	User    string    `json:"user"`
+	Date    time.Time `json:"date"`
+}
+
+//type for hash scheme config, Current is 0 while no key is set
+type HashScheme struct {
+	Current int              `json:"current"`
+	Keys    []HashKeyVersion `json:"keys"`
+}
+
+//type for identifier of person a hash is computed from, sent in the transient map
+type PersonIdentifier struct {
+	// kind of document, like passport
+	Type string `json:"type"`
+	// issuing country, like DE
+	Country string `json:"country"`
+	Number  string `json:"number"`
+}
+
+//type for response of derivePersonHash
+type DerivedHash struct {
+	Hash    string `json:"hash"`
+	Version int    `json:"version"`
+}
+
+//type for one person of rekeyPersons, oldHash is needed for version 0 only
+type RekeyItem struct {
+	PersonID PersonIdentifier `json:"personId"`
+	OldHash  string           `json:"oldHash"`
+}
+
+//type for result of rekeyPersons
+type RekeyResult struct {
+	FromVersion int             `json:"fromVersion"`
+	ToVersion   int             `json:"toVersion"`
+	Persons     []RekeyedPerson `json:"persons"`
+}
+
+type RekeyedPerson struct {
+	OldHash string `json:"oldHash"`
+	NewHash string `json:"newHash"`
+}
+
+// Returns the HMAC input of the identifier: type, country and number in upper
+// case, separators like spaces and dashes dropped, joined by |. field names
+// the identifier in errors.
+func (id *PersonIdentifier) normalize(field string) (string, error) {
+	parts := []struct {
+		name  string
+		value string
+	}{{"type", id.Type}, {"country", id.Country}, {"number", id.Number}}
+	var normalized []string
+	for _, part := range parts {
+		value := strings.Map(func(r rune) rune {
+			if unicode.IsLetter(r) || unicode.IsDigit(r) {
+				return unicode.ToUpper(r)
+			}
+			return -1
+		}, part.value)
+		if value == "" {
+			name := field + "." + part.name
+			return "", newError(ERR_MISSING_FIELD, name, name+" is missing")
+		}
+		normalized = append(normalized, value)
+	}
+	return strings.Join(normalized, "|"), nil
+}
+
+//returns the versioned person hash of the normalized identifier
+func computePersonHash(key []byte, version int, normalized string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(normalized))
+	return fmt.Sprintf("v%d-%s", version, hex.EncodeToString(mac.Sum(nil)))
+}
+
+//returns value that tells a key apart without revealing it
+func hashKeyCheck(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(hashKeyCheckInput))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//returns key version of a valid hash, 0 for a hash without version
+func hashVersion(hash string) int {
+	end := strings.Index(hash, "-")
+	if !strings.HasPrefix(hash, "v") || end < 0 {
+		return 0
+	}
+	version, err := strconv.Atoi(hash[1:end])
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+//returns the hash scheme, one without keys if none is set
+func loadHashScheme(stub shim.ChaincodeStubInterface) (*HashScheme, error) {
+	scheme := &HashScheme{Keys: []HashKeyVersion{}}
+	schemeBytes, err := stub.GetState(hashSchemeKey)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting hash scheme", err)
+	}
+	if len(schemeBytes) == 0 {
+		return scheme, nil
+	}
+	err = json.Unmarshal(schemeBytes, scheme)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling hash scheme", err)
+	}
+	return scheme, nil
+}
+
+//returns the key of transient entry name, checked to be the key of version
+func getHashKey(stub shim.ChaincodeStubInterface, scheme *HashScheme, name string, version int) ([]byte, error) {
+	key, err := getTransientValue(stub, name, true)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range scheme.Keys {
+		if v.Version == version && hmac.Equal([]byte(v.Check), []byte(hashKeyCheck(key))) {
+			return key, nil
+		}
+	}
+	return nil, newError(ERR_UNKNOWN_HASH_KEY, "transient."+name, fmt.Sprintf("%s is not the hash key of version %d", name, version))
+}
+
+// Checks that the hash of a new person is a lowercase hex SHA-256 with the
+// current key version. Requests accept any hash, so that persons stored
+// under hashes the callers chose before the scheme stay readable.
+func checkNewPersonHash(stub shim.ChaincodeStubInterface, hash string) error {
+	if !hashPattern.MatchString(hash) {
+		return &PersonError{Code: ERR_INVALID_FIELD, Message: "hash must be a lowercase hex SHA-256, optionally prefixed by its key version like v1-", Field: "hash", Hash: hash}
+	}
+	scheme, err := loadHashScheme(stub)
+	if err != nil {
+		return err
+	}
+	version := hashVersion(hash)
+	if version == scheme.Current {
+		return nil
+	}
+	message := fmt.Sprintf("new person needs a hash of key version %d, got version %d", scheme.Current, version)
+	if scheme.Current == 0 {
+		message = fmt.Sprintf("no hash key is set, new person needs a hash without key version, got version %d", version)
+	}
+	return &PersonError{Code: ERR_HASH_VERSION, Message: message, Field: "hash", Hash: hash}
+}
+
+// Returns the person hash of a request: the hash of the argument, the hash
+// in the transient map or the hash of the transient personId with the
+// current key. All of them that are sent must agree.
+func resolvePersonHash(stub shim.ChaincodeStubInterface, hash string, tr *HashTransient) (string, error) {
+	var hashes, fields []string
+	add := func(field string, hash string) {
+		if hash != "" {
+			hashes = append(hashes, hash)
+			fields = append(fields, field)
+		}
+	}
+	add("hash", hash)
+	if tr != nil {
+		prefix := "transient." + transientPerson + "."
+		add(prefix+"hash", tr.Hash)
+		if tr.PersonID != nil {
+			scheme, err := loadHashScheme(stub)
+			if err != nil {
+				return "", err
+			}
+			if scheme.Current == 0 {
+				return "", newError(ERR_UNKNOWN_HASH_KEY, prefix+"personId", "no hash key is set, personId can not be hashed")
+			}
+			key, err := getHashKey(stub, scheme, transientHashKey, scheme.Current)
+			if err != nil {
+				return "", err
+			}
+			normalized, err := tr.PersonID.normalize(prefix + "personId")
+			if err != nil {
+				return "", err
+			}
+			add(prefix+"personId", computePersonHash(key, scheme.Current, normalized))
+		}
+	}
+	if len(hashes) == 0 {
+		return "", validationError([]FieldError{{Field: "hash", Code: ERR_MISSING_FIELD, Message: "hash is missing"}})
+	}
+	for i := 1; i < len(hashes); i++ {
+		if hashes[i] != hashes[0] {
+			return "", newError(ERR_INVALID_FIELD, fields[i], "hash of "+fields[i]+" does not match "+fields[0])
+		}
+	}
+	return hashes[0], nil
+}
+
+//registers the key of the transient map as new current hash key version
+func (t *SimpleChaincode) setHashKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req ReasonRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, err := getTransientValue(stub, transientHashKey, true)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if len(key) < minHashKeySize {
+		return errorResponse(newError(ERR_INVALID_FIELD, "transient."+transientHashKey, fmt.Sprintf("%s must be at least %d bytes", transientHashKey, minHashKeySize)))
+	}
+	scheme, err := loadHashScheme(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	check := hashKeyCheck(key)
+	for _, v := range scheme.Keys {
+		if v.Check == check {
+			return errorResponse(newError(ERR_INVALID_FIELD, "transient."+transientHashKey, fmt.Sprintf("%s is registered as version %d already", transientHashKey, v.Version)))
+		}
+	}
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	keyVersion := HashKeyVersion{
+		Version: scheme.Current + 1,
+		Check:   check,
+		Company: company,
+		User:    user,
+		Date:    txTime,
+	}
+	scheme.Keys = append(scheme.Keys, keyVersion)
+	scheme.Current = keyVersion.Version
+	schemeBytes, err := json.Marshal(scheme)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addMaintenanceRecord(stub, MAINTENANCE_SET_HASH_KEY, hashSchemeKey, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	logger.Noticef("hash key version %d set by %s of %s", keyVersion.Version, user, company)
+	err = stub.PutState(hashSchemeKey, schemeBytes)
+	if err != nil {
+		return errorResponse(wrapError(ERR_INTERNAL, "Error putting hash scheme", err))
+	}
+	versionBytes, err := json.Marshal(&keyVersion)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(versionBytes)
+}
+
+func (t *SimpleChaincode) getHashScheme(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	scheme, err := loadHashScheme(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	schemeBytes, err := json.Marshal(scheme)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(schemeBytes)
+}
+
+// Returns the hash of the identifier in the transient map, computed with the
+// transient key of the requested version, the current one by default. Meant
+// to be evaluated, not submitted.
+func (t *SimpleChaincode) derivePersonHash(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req DeriveHashRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	scheme, err := loadHashScheme(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if scheme.Current == 0 {
+		return errorResponse(newError(ERR_UNKNOWN_HASH_KEY, "", "no hash key is set"))
+	}
+	version := scheme.Current
+	if req.Version != nil {
+		version = *req.Version
+	}
+	if version > scheme.Current {
+		return errorResponse(newError(ERR_INVALID_FIELD, "version", fmt.Sprintf("version must be at most the current key version %d", scheme.Current)))
+	}
+	key, err := getHashKey(stub, scheme, transientHashKey, version)
+	if err != nil {
+		return errorResponse(err)
+	}
+	idBytes, err := getTransientValue(stub, transientPersonID, true)
+	if err != nil {
+		return errorResponse(err)
+	}
+	var id PersonIdentifier
+	err = json.Unmarshal(idBytes, &id)
+	if err != nil {
+		return errorResponse(newError(ERR_INVALID_FIELD, "transient."+transientPersonID, transientPersonID+" must be an object of type, country and number"))
+	}
+	normalized, err := id.normalize("transient." + transientPersonID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hashBytes, err := json.Marshal(&DerivedHash{Hash: computePersonHash(key, version, normalized), Version: version})
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(hashBytes)
+}
+
+// Moves the persons listed in the transient map from their hash of key
+// version fromVersion to the hash of the current key. The current key and,
+// unless fromVersion is 0, the old key are taken from the transient map.
+// Hashes of version 0 are not computed by the chaincode, so for them each
+// item carries the old hash. Persons with encrypted fields also need the
+// encryption keys, see moveEncryptedFields.
+func (t *SimpleChaincode) rekeyPersons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req RekeyRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	from := *req.FromVersion
+	scheme, err := loadHashScheme(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if scheme.Current == 0 {
+		return errorResponse(newError(ERR_UNKNOWN_HASH_KEY, "", "no hash key is set"))
+	}
+	if from >= scheme.Current {
+		return errorResponse(newError(ERR_INVALID_FIELD, "fromVersion", fmt.Sprintf("fromVersion must be below the current key version %d", scheme.Current)))
+	}
+	newKey, err := getHashKey(stub, scheme, transientHashKey, scheme.Current)
+	if err != nil {
+		return errorResponse(err)
+	}
+	var oldKey []byte
+	if from > 0 {
+		oldKey, err = getHashKey(stub, scheme, transientOldHashKey, from)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	itemsBytes, err := getTransientValue(stub, transientRekeyPersons, true)
+	if err != nil {
+		return errorResponse(err)
+	}
+	var items []RekeyItem
+	err = json.Unmarshal(itemsBytes, &items)
+	if err != nil || len(items) == 0 || len(items) > maxRekeyItems {
+		return errorResponse(newError(ERR_INVALID_FIELD, "transient."+transientRekeyPersons, fmt.Sprintf("%s must be an array of 1 to %d items of personId and oldHash", transientRekeyPersons, maxRekeyItems)))
+	}
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	result := &RekeyResult{FromVersion: from, ToVersion: scheme.Current}
+	//reads do not see writes of the same transaction, so a hash is moved only once
+	seen := make(map[string]bool)
+	for i, item := range items {
+		field := fmt.Sprintf("%s[%d]", transientRekeyPersons, i)
+		normalized, err := item.PersonID.normalize(field + ".personId")
+		if err != nil {
+			return errorResponse(err)
+		}
+		oldHash := item.OldHash
+		if from == 0 {
+			//legacy hashes may be any string the callers chose
+			if strings.TrimSpace(oldHash) == "" || (hashPattern.MatchString(oldHash) && hashVersion(oldHash) != 0) {
+				return errorResponse(newError(ERR_INVALID_FIELD, field+".oldHash", field+".oldHash must be a hash without key version"))
+			}
+		} else {
+			oldHash = computePersonHash(oldKey, from, normalized)
+			if item.OldHash != "" && item.OldHash != oldHash {
+				return errorResponse(newError(ERR_INVALID_FIELD, field+".oldHash", field+".oldHash is not the hash of personId"))
+			}
+		}
+		newHash := computePersonHash(newKey, scheme.Current, normalized)
+		if seen[oldHash] || seen[newHash] {
+			return errorResponse(&PersonError{Code: ERR_DUPLICATE_HASH, Message: "person is listed twice", Field: field, Hash: oldHash})
+		}
+		seen[oldHash], seen[newHash] = true, true
+		result.Persons = append(result.Persons, RekeyedPerson{OldHash: oldHash, NewHash: newHash})
+	}
+	for _, moved := range result.Persons {
+		err = rekeyPerson(stub, moved.OldHash, moved.NewHash, user, company)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	logger.Infof("moved %d persons from hash key version %d to %d", len(items), from, scheme.Current)
+	err = addMaintenanceRecord(stub, MAINTENANCE_REKEY, hashSchemeKey, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
+
+//moves person with its history, searches and index keys from hash to newHash
+func rekeyPerson(stub shim.ChaincodeStubInterface, hash string, newHash string, user string, company string) error {
+	person, err := getPersonFromState(stub, hash)
+	if err != nil {
+		return err
+	}
+	if person == nil {
+		return &PersonError{Code: ERR_PERSON_NOT_FOUND, Message: "person does not exist", Field: "hash", Hash: hash}
+	}
+	existing, err := getPersonFromState(stub, newHash)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return &PersonError{Code: ERR_PERSON_EXISTS, Message: "person exists under the new hash already", Field: "hash", Hash: newHash}
+	}
+	old := *person
+	err = moveEncryptedFields(stub, person, newHash)
+	if err != nil {
+		return err
+	}
+	err = putPersonInState(stub, newHash, *person)
+	if err != nil {
+		return err
+	}
+	err = stub.DelState(personPrfx + hash)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error deleting person "+hash, err)
+	}
+	err = updatePersonIndexes(stub, &old, nil)
+	if err != nil {
+		return err
+	}
+	err = updateStatusCounts(stub, &old, nil)
+	if err != nil {
+		return err
+	}
+	err = moveEntries(stub, personHistoryObj, personHistoryPrfx, hash, newHash)
+	if err != nil {
+		return internalError(err, "Error moving history of person "+hash)
+	}
+	err = moveEntries(stub, personSearchObj, personSearchPrfx, hash, newHash)
+	if err != nil {
+		return internalError(err, "Error moving searches of person "+hash)
+	}
+	changes := []FieldChange{{Field: "hash", Old: hash, New: newHash}}
+	return addHistoryRecord(stub, newHash, ACTION_REKEY, user, company, person.Status, changes)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/msp"
+)
+
+// Returns enrollment ID and MSP ID of the transaction creator. The
+// enrollment ID is the common name of the creator's certificate.
+func getCreatorIdentity(stub shim.ChaincodeStubInterface) (string, string, error) {
+	creator, err := stub.GetCreator()
+	if err != nil || len(creator) == 0 {
+		return "", "", wrapError(ERR_INVALID_IDENTITY, "transaction creator is not available", err)
+	}
+	identity := &msp.SerializedIdentity{}
+	err = proto.Unmarshal(creator, identity)
+	if err != nil {
+		return "", "", wrapError(ERR_INVALID_IDENTITY, "failed to unmarshal transaction creator", err)
+	}
+	block, _ := pem.Decode(identity.IdBytes)
+	if block == nil {
+		return "", "", newError(ERR_INVALID_IDENTITY, "", "transaction creator has no PEM certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", "", wrapError(ERR_INVALID_IDENTITY, "failed to parse transaction creator certificate", err)
+	}
+	if cert.Subject.CommonName == "" || identity.Mspid == "" {
+		return "", "", newError(ERR_INVALID_IDENTITY, "", "transaction creator has no enrollment ID or MSP ID")
+	}
+	return cert.Subject.CommonName, identity.Mspid, nil
+}
+
+// Returns user and company recorded for the caller, taken from the
+// transaction creator. Clients may still send user and company, but they
+// are rejected unless they match the creator.
+func getCaller(stub shim.ChaincodeStubInterface, caller CallerArgs) (string, string, error) {
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return "", "", err
+	}
+	if caller.User != "" && caller.User != user {
+		return "", "", newError(ERR_CALLER_MISMATCH, "user", "user "+caller.User+" does not match transaction creator "+user)
+	}
+	if caller.Company != "" && caller.Company != company {
+		return "", "", newError(ERR_CALLER_MISMATCH, "company", "company "+caller.Company+" does not match transaction creator "+company)
+	}
+	return user, company, nil
+}
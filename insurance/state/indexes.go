@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Persons are indexed by composite keys, so lookups other than by hash do
+// not scan the whole Person: range:
+//
+//	<personByStatusObj, status, modifyDate, hash>
+//	<personByCompanyObj, createdBy, hash>
+//	<personByDateObj, modifyDate, hash>
+//
+// The status index carries modifyDate before the hash, so persons of a status
+// are listed by date. putPersonInState keeps the keys in step with the person
+// in the same transaction; a changed status or date replaces the old keys.
+// Deleted persons have no keys. Writes that bypass putPersonInState, like
+// maintenanceWrite in repair mode, leave the indexes behind; readers skip such
+// stale keys and rebuildPersonIndexes repairs them.
+
+const (
+	// composite key type of persons by status and modify date
+	personByStatusObj = "PersonByStatus"
+	// composite key type of persons by creating company
+	personByCompanyObj = "PersonByCompany"
+	// composite key type of persons by modify date
+	personByDateObj = "PersonByDate"
+)
+
+var personIndexObjs = []string{personByStatusObj, personByCompanyObj, personByDateObj}
+
+// value of index keys, state can not hold empty values
+var indexValue = []byte{0x00}
+
+//type for result of rebuildPersonIndexes
+type IndexRebuildResult struct {
+	Persons int `json:"persons"`
+	// persons given their docType or modifyKey
+	Updated int `json:"updated"`
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+}
+
+//returns index keys of person, none for a deleted person
+func getPersonIndexKeys(stub shim.ChaincodeStubInterface, person *Person) ([]string, error) {
+	var keys []string
+	if person == nil || person.Deleted != nil {
+		return nil, nil
+	}
+	date := person.ModifyDate.UTC().Format(entryTimeLayout)
+	attributes := map[string][]string{
+		personByStatusObj: {string(person.Status), date, person.Hash},
+		personByDateObj:   {date, person.Hash},
+	}
+	if person.CreatedBy != "" {
+		attributes[personByCompanyObj] = []string{person.CreatedBy, person.Hash}
+	}
+	for _, objectType := range personIndexObjs {
+		if attributes[objectType] == nil {
+			continue
+		}
+		key, err := stub.CreateCompositeKey(objectType, attributes[objectType])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+//replaces index keys of old person with those of new person, either may be nil
+func updatePersonIndexes(stub shim.ChaincodeStubInterface, old *Person, new *Person) error {
+	oldKeys, err := getPersonIndexKeys(stub, old)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error creating person index key", err)
+	}
+	newKeys, err := getPersonIndexKeys(stub, new)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error creating person index key", err)
+	}
+	keep := make(map[string]bool)
+	for _, key := range newKeys {
+		keep[key] = true
+	}
+	for _, key := range oldKeys {
+		if keep[key] {
+			delete(keep, key)
+			continue
+		}
+		err = stub.DelState(key)
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error deleting person index key", err)
+		}
+	}
+	for _, key := range newKeys {
+		if !keep[key] {
+			continue
+		}
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error putting person index key", err)
+		}
+	}
+	return nil
+}
+
+//lists persons of a status, oldest modified first
+func (t *SimpleChaincode) listPersonsByStatus(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req StatusListRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	query := &PersonQueryRequest{Statuses: []PersonStatus{req.Status}, CursorArgs: req.CursorArgs}
+	return t.listPersons(stub, query)
+}
+
+//lists persons inserted by a company, ordered by hash
+func (t *SimpleChaincode) listPersonsByCompany(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req CompanyListRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	query := &PersonQueryRequest{CreatedBy: req.Company, CursorArgs: req.CursorArgs}
+	return t.listPersons(stub, query)
+}
+
+func (t *SimpleChaincode) listPersons(stub shim.ChaincodeStubInterface, query *PersonQueryRequest) pb.Response {
+	result, err := queryPersonIndexes(stub, query, query.pageSize())
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
+
+// Puts the index keys of every person and deletes all other keys of the
+// index types. Persons stored before docType and modifyKey existed get them
+// and the persons per status are counted anew.
+func (t *SimpleChaincode) rebuildPersonIndexes(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req ReasonRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	result := &IndexRebuildResult{}
+	wanted := make(map[string]bool)
+	counts := make(map[PersonStatus]int)
+	//';' follows ':', so the range holds all person keys
+	resultsIterator, err := stub.GetStateByRange(personPrfx, personPrfx[:len(personPrfx)-1]+";")
+	if err != nil {
+		return errorResponse(wrapError(ERR_INTERNAL, "Error reading persons", err))
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(wrapError(ERR_INTERNAL, "Error reading persons", err))
+		}
+		var person Person
+		err = json.Unmarshal(kv.Value, &person)
+		if err != nil {
+			return errorResponse(wrapError(ERR_INTERNAL, "Error unmarshalling person "+kv.Key, err))
+		}
+		result.Persons++
+		modifyKey := person.ModifyDate.UTC().Format(entryTimeLayout)
+		if person.DocType != DOC_TYPE_PERSON || person.ModifyKey != modifyKey {
+			person.DocType = DOC_TYPE_PERSON
+			person.ModifyKey = modifyKey
+			personBytes, err := json.Marshal(&person)
+			if err != nil {
+				return errorResponse(wrapError(ERR_INTERNAL, "Error marshalling person "+kv.Key, err))
+			}
+			err = stub.PutState(kv.Key, personBytes)
+			if err != nil {
+				return errorResponse(wrapError(ERR_INTERNAL, "Error putting person "+kv.Key, err))
+			}
+			result.Updated++
+		}
+		keys, err := getPersonIndexKeys(stub, &person)
+		if err != nil {
+			return errorResponse(wrapError(ERR_INTERNAL, "Error creating person index key", err))
+		}
+		for _, key := range keys {
+			wanted[key] = true
+		}
+		if person.Deleted == nil {
+			counts[person.Status]++
+		}
+	}
+	for _, objectType := range personIndexObjs {
+		err = removeUnwantedKeys(stub, objectType, wanted, result)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	var missing []string
+	for key := range wanted {
+		missing = append(missing, key)
+	}
+	sort.Strings(missing)
+	for _, key := range missing {
+		err = stub.PutState(key, indexValue)
+		if err != nil {
+			return errorResponse(wrapError(ERR_INTERNAL, "Error putting person index key", err))
+		}
+		result.Added++
+	}
+	err = resetStatusCounts(stub, counts)
+	if err != nil {
+		return errorResponse(err)
+	}
+	logger.Infof("rebuilt person indexes of %d persons, %d keys added, %d removed", result.Persons, result.Added, result.Removed)
+	err = addMaintenanceRecord(stub, MAINTENANCE_REBUILD_INDEXES, personPrfx, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
+
+// Deletes keys of objectType that are not wanted. Wanted keys found are
+// taken out of wanted, so it is left with the missing keys.
+func removeUnwantedKeys(stub shim.ChaincodeStubInterface, objectType string, wanted map[string]bool, result *IndexRebuildResult) error {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{})
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error reading person index", err)
+	}
+	var stale []string
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return wrapError(ERR_INTERNAL, "Error reading person index", err)
+		}
+		if wanted[kv.Key] {
+			delete(wanted, kv.Key)
+			continue
+		}
+		stale = append(stale, kv.Key)
+	}
+	resultsIterator.Close()
+	for _, key := range stale {
+		err = stub.DelState(key)
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error deleting person index key", err)
+		}
+		result.Removed++
+	}
+	return nil
+}
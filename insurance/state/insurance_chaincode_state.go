@@ -5,8 +5,8 @@ import (
 	"errors"
 	"fmt"
 	//"strconv"
+	"strings"
 	"time"
-	//"strings"
 
 	//"os"
 
@@ -17,22 +17,32 @@ import (
 var (
 	// prefix for saving person data
 	personPrfx = "Person:"
-	// prefix for saving history of person
+	// prefix of legacy history of person, kept as one JSON array
 	personHistoryPrfx = "PersonHistory:"
-	//prefix for saving serches for person
+	//prefix of legacy serches for person, kept as one JSON array
 	personSearchPrfx = "PersonSearch:"
+	// composite key type for single history records of person
+	personHistoryObj = "PersonHistory"
+	// composite key type for single search records of person
+	personSearchObj = "PersonSearch"
 	logger           = shim.NewLogger("insurance")
 )
 
 const ACTION_INSERT = "create"
 const ACTION_UPDATE = "update"
-//const ACTION_DELETE = "delete"
-//const ACTION_SEARCH = "search"
+const ACTION_DELETE = "delete"
+const ACTION_RESTORE = "restore"
+const ACTION_SEARCH = "search"
+const ACTION_BATCH = "batch"
+const ACTION_REKEY = "rekey"
 
-//const STATUS_OK = "trusted"
-//const STATUS_SUSP = "banned"
-//const STATUS_DELETED = "wrong-data"
-const STATUS_NOT_FOUND = "not-initialized"
+//type for person status, see status.go for allowed changes
+type PersonStatus string
+
+const STATUS_OK PersonStatus = "trusted"
+const STATUS_SUSP PersonStatus = "banned"
+const STATUS_WRONG_DATA PersonStatus = "wrong-data"
+const STATUS_NOT_FOUND PersonStatus = "not-initialized"
 
 // SimpleChaincode example simple Chaincode implementation
 type SimpleChaincode struct {
@@ -43,8 +53,10 @@ type Action struct {
 	Company string    `json:"company"`
 	User    string    `json:"user"`
 	Date    time.Time `json:"date"`
-	Status  string    `json:"status"`
+	Status  PersonStatus `json:"status"`
 	Method  string    `json:"method"`
+	// fields changed by update
+	Changes []FieldChange `json:"changes,omitempty"`
 }
 
 //type for search record
@@ -52,14 +64,33 @@ type SearchResult struct {
 	Company string    `json:"company"`
 	User    string    `json:"user"`
 	Date    time.Time `json:"date"`
-	Status  string    `json:"status"`
+	Status  PersonStatus `json:"status"`
 }
 
 //type for person data
 type Person struct {
 	Hash       string    `json:"hash"`
-	Status     string    `json:"status"`
+	Status     PersonStatus `json:"status"`
 	ModifyDate time.Time `json:"modifyDate"`
+	// optional attributes
+	PolicyNumbers []string `json:"policyNumbers,omitempty"`
+	RiskScore     *float64 `json:"riskScore,omitempty"`
+	SourceCompany string   `json:"sourceCompany,omitempty"`
+	Notes         string   `json:"notes,omitempty"`
+	Contact       string   `json:"contact,omitempty"`
+	// fields kept encrypted, see encryption.go
+	Encrypted *EncryptedFields `json:"encrypted,omitempty"`
+	// set while person is deleted
+	Deleted *Tombstone `json:"deleted,omitempty"`
+	// company that inserted the person
+	CreatedBy string `json:"createdBy,omitempty"`
+	// set on persons a search registered, until a company writes them
+	SearchPlaceholder bool `json:"searchPlaceholder,omitempty"`
+	// DOC_TYPE_PERSON, lets CouchDB queries tell persons from other documents
+	DocType string `json:"docType,omitempty"`
+	// ModifyDate in the fixed width entryTimeLayout, lets CouchDB compare
+	// dates as text
+	ModifyKey string `json:"modifyKey,omitempty"`
 }
 
 //---------------------------------------------------- MAIN
@@ -81,7 +112,16 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 	_, args := stub.GetFunctionAndParameters()
 	//check arguments length
 	if len(args) != 1 {
-		shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(newError(ERR_INVALID_ARGUMENT, "", "Incorrect number of arguments. Expecting 1"))
+	}
+	//whoever instantiates or upgrades the chaincode administers it
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = grantRoleTo(stub, user, company, ROLE_ADMIN)
+	if err != nil {
+		return errorResponse(err)
 	}
 	return shim.Success(nil)
 }
@@ -90,7 +130,6 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
 func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	// Handle different functions
 
-	fmt.Println("query did not find func: " + function)
 	logger.Errorf("query did not find func%s:", function)
 	return nil, errors.New("Received unknown function query")
 }
@@ -98,285 +137,300 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 //Invoke - shim method
 func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
-	fmt.Println("Invoke is running this function :" + function)
 	logger.Infof("Invoke is running this function : %s", function)
+	err := checkPermission(stub, function)
+	if err != nil {
+		return errorResponse(err)
+	}
 	// Handle different functions
 	if function == "init" { //initialize the chaincode state, used as reset
 		return t.Init(stub)
 		//////// write state functions
-	} else if function == "write" {
-		return t.write(stub, args)
 	} else if function == "insertPerson" { //create a new person
 		return t.insertPerson(stub, args)
 	} else if function == "updatePerson" { // update a person
 		return t.updatePerson(stub, args)
+	} else if function == "upsertPerson" { // create or update a person
+		return t.upsertPerson(stub, args)
 	} else if function == "searchPerson" {
 		return t.searchPerson(stub, args)
+	} else if function == "batchInsertPersons" { // insert array of persons
+		return t.batchInsertPersons(stub, args)
+	} else if function == "batchUpdatePersons" {
+		return t.batchUpdatePersons(stub, args)
+	} else if function == "batchSearchPersons" {
+		return t.batchSearchPersons(stub, args)
+	} else if function == "deletePerson" { // mark person deleted
+		return t.deletePerson(stub, args)
+	} else if function == "restorePerson" {
+		return t.restorePerson(stub, args)
+	} else if function == "purgePerson" { // remove person with history and searches
+		return t.purgePerson(stub, args)
 		/// read  state functions
 	} else if function == "getPersonInfo" { //read person by hash
 		return t.getPersonInfo(stub, args)
-	} else if function == "read" { // read data by name from state
-		return t.read(stub, args)
 	} else if function == "getPersonHistory" { // read history of person from state
 		return t.getPersonHistory(stub, args)
 	} else if function == "getPersonSearches" {
 		return t.getPersonSearches(stub, args)
+	} else if function == "queryPersons" { // find persons by status, date and company
+		return t.queryPersons(stub, args)
+	} else if function == "listPersonsByStatus" {
+		return t.listPersonsByStatus(stub, args)
+	} else if function == "listPersonsByCompany" {
+		return t.listPersonsByCompany(stub, args)
+	} else if function == "rebuildPersonIndexes" { // repair index keys of persons
+		return t.rebuildPersonIndexes(stub, args)
+	} else if function == "getRegistryStats" {
+		return t.getRegistryStats(stub, args)
+	} else if function == "compactRegistryStats" {
+		return t.compactRegistryStats(stub, args)
 	} else if function == "getPersonHistoryIter" {
 		return t.getPersonHistoryIter(stub, args)
+	} else if function == "getPersonAsOf" { // read person as it was at a time
+		return t.getPersonAsOf(stub, args)
 		////// util functions
 	} else if function == "setLoggingLevel" {
 		return t.setLoggingLevel(stub, args)
 		/// read-write function
 	} else if function == "searchPersonAndReturn" {
 		return t.searchPersonAndReturn(stub, args)
-	}
-
-	return shim.Error("Received unknown function invocation")
+	} else if function == "migratePersonHistory" { // move legacy history arrays to single records
+		return t.migratePersonHistory(stub, args)
+		////// access control functions
+	} else if function == "grantRole" {
+		return t.grantRole(stub, args)
+	} else if function == "revokeRole" {
+		return t.revokeRole(stub, args)
+	} else if function == "getRoles" {
+		return t.getRoles(stub, args)
+		////// maintenance functions
+	} else if function == "maintenanceRead" { // read data by name from state
+		return t.maintenanceRead(stub, args)
+	} else if function == "maintenanceWrite" {
+		return t.maintenanceWrite(stub, args)
+	} else if function == "maintenanceDelete" {
+		return t.maintenanceDelete(stub, args)
+	} else if function == "setRepairMode" {
+		return t.setRepairMode(stub, args)
+	} else if function == "getMaintenanceLog" {
+		return t.getMaintenanceLog(stub, args)
+		////// configuration functions
+	} else if function == "setStatusTransitions" {
+		return t.setStatusTransitions(stub, args)
+	} else if function == "getStatusTransitions" {
+		return t.getStatusTransitions(stub, args)
+	} else if function == "setEventNames" {
+		return t.setEventNames(stub, args)
+	} else if function == "getEventNames" {
+		return t.getEventNames(stub, args)
+		////// person hash scheme functions
+	} else if function == "setHashKey" { // register new consortium hash key
+		return t.setHashKey(stub, args)
+	} else if function == "getHashScheme" {
+		return t.getHashScheme(stub, args)
+	} else if function == "derivePersonHash" {
+		return t.derivePersonHash(stub, args)
+	} else if function == "rekeyPersons" { // move persons to hashes of the current key
+		return t.rekeyPersons(stub, args)
+		////// field encryption functions
+	} else if function == "setEncryptionKey" { // register new consortium encryption key
+		return t.setEncryptionKey(stub, args)
+	} else if function == "getFieldEncryption" {
+		return t.getFieldEncryption(stub, args)
+	} else if function == "reencryptPersons" { // encrypt persons with the current key
+		return t.reencryptPersons(stub, args)
+	}
+
+	return errorResponse(newError(ERR_UNKNOWN_FUNCTION, "", "Received unknown function invocation"))
 }
-func (t *SimpleChaincode) getPersonHistoryIter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var history []string
+//print person data by hash
+func (t *SimpleChaincode) getPersonInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req PersonInfoRequest
 	//parse parameters  - need 1
-	argsMap, err := getUnmarshalledArgument(args)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	logger.Debugf("search history for %s",personPrfx + hash)
-	resultsIterator, err := stub.GetHistoryForKey(personPrfx + hash)
+	err := decodeRequest(args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
-	}
-	defer resultsIterator.Close()
-
-	for resultsIterator.HasNext() {
-		historicValue, err := resultsIterator.Next()
-		if err != nil {
-			return shim.Error(err.Error())
-		}
-		logger.Debugf("historicValue%+v",historicValue)
-		if historicValue != nil && historicValue.Value != nil {
-			history = append(history, "{", time.Unix(historicValue.Timestamp.Seconds, int64(historicValue.Timestamp.Nanos)).String(), ":", string(historicValue.Value), "}") //add this tx to the list
-		}
-
+		return errorResponse(err)
 	}
-	fmt.Printf("- readKeyHistory returning:\n%v", history)
-
-	//change to array of bytes
-	historyAsBytes, _ := json.MarshalIndent(history, "", "\t") //convert to array of bytes
-	return shim.Success(historyAsBytes)
-}
+	hash := req.Hash
+	logger.Infof("get info for person %s", hash)
+	//get person from state
+	res, err := stub.GetState(personPrfx + hash)
 
-func (t *SimpleChaincode) read(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
-	}
-	key := args[0]
-	response, err := stub.GetState(key)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	return shim.Success(response)
-}
-
-func (t *SimpleChaincode) write(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	if len(args) != 2 {
-		return shim.Error("Incorrect number of arguments. Expecting 2")
+	if len(res) == 0 {
+		return shim.Success(res)
 	}
-	key := args[0]
-	val := []byte(args[1])
-	err := stub.PutState(key, val)
+	var person Person
+	err = json.Unmarshal(res, &person)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(wrapError(ERR_INTERNAL, "Error unmarshalling person "+hash+" from state", err))
 	}
-	return shim.Success(nil)
-}
-
-//print person data by hash
-func (t *SimpleChaincode) getPersonInfo(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	//parse parameters  - need 1
-	argsMap, err := getUnmarshalledArgument(args)
-	if err != nil {
-		return shim.Error(err.Error())
+	if person.Deleted != nil && !req.IncludeDeleted {
+		return shim.Success(nil)
 	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
+	//encrypted fields are decrypted only for callers that send the key
+	revealed, err := revealPerson(stub, &person)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("get info for person " + hash)
-	logger.Infof("get info for person %s", hash)
-	//get person from state
-	res, err := stub.GetState(personPrfx + hash)
-
+	if !revealed {
+		return shim.Success(res)
+	}
+	personBytes, err := json.Marshal(&person)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	return shim.Success(res)
+	return shim.Success(personBytes)
 }
 
 //print person history by hash
 func (t *SimpleChaincode) getPersonHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req HistoryRequest
 	//parse parameters  - need 1
-	argsMap, err := getUnmarshalledArgument(args)
+	err := decodeRequest(args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
-	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
+	hash := req.Hash
 	//get person from state
-	fmt.Println("get person history for person " + hash)
 	logger.Infof("get person history for person %s", hash)
-	res, err := stub.GetState(personHistoryPrfx + hash)
+	res, err := getEntriesAsBytes(stub, personHistoryObj, personHistoryPrfx, hash, req.pageRequest(), nil)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 	return shim.Success(res)
 }
 
 //print person searches by hash
 func (t *SimpleChaincode) getPersonSearches(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req HistoryRequest
 	//parse parameters  - need 1
-	argsMap, err := getUnmarshalledArgument(args)
+	err := decodeRequest(args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
-	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
+	hash := req.Hash
 	//get person from state
-	fmt.Println("get person searches for person " + hash)
 	logger.Infof("get person searches for person %s ", hash)
-	res, err := stub.GetState(personSearchPrfx + hash)
+	collections, err := readableSearchCollections(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	return shim.Success(res)
-}
-
-func (t *SimpleChaincode) insertPerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	//parse parameters  - need 4
-	argsMap, err := getUnmarshalledArgument(args)
-	if err != nil {
-		return shim.Error(err.Error())
+	//details are read for the returned page only
+	reveal := func(entry json.RawMessage) (json.RawMessage, error) {
+		return revealSearch(stub, entry, collections)
 	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
+	res, err := getEntriesAsBytes(stub, personSearchObj, personSearchPrfx, hash, req.pageRequest(), reveal)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("insert man with hash " + hash)
-	logger.Infof("insert man with hash %s", hash)
-	user, err := getStringParamFromArgs("user", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	fmt.Println("for user " + user)
-	logger.Infof("for user %s", user)
-	company, err := getStringParamFromArgs("company", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	fmt.Println("company=" + company)
-	logger.Infof("company= %s", company)
-	status, err := getStringParamFromArgs("status", argsMap)
+	return shim.Success(res)
+}
+
+//move legacy history and search arrays of person to single records, list records newest first
+func (t *SimpleChaincode) migratePersonHistory(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req HashRequest
+	//parse parameters  - need 1
+	err := decodeRequest(args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("status=" + status)
-	logger.Infof("status= %s", status)
-	//-----add person hash to state
-	newPerson := &Person{}
-	newPerson.ModifyDate = time.Now()
-	newPerson.Status = status
-	newPerson.Hash = hash
-	err = createOrUpdatePerson(stub, hash, *newPerson)
+	hash := req.Hash
+	logger.Infof("migrate history of person %s", hash)
+	err = migrateLegacyEntries(stub, personHistoryObj, personHistoryPrfx, hash)
 	if err != nil {
-		return shim.Error("error inserting person")
+		return errorResponse(err)
 	}
-	//------add record to person history
-	err = addHistoryRecord(stub, hash, ACTION_INSERT, user, company, status)
+	err = migrateLegacyEntries(stub, personSearchObj, personSearchPrfx, hash)
 	if err != nil {
-		return shim.Error("Error putting new history record " + hash + " to state")
+		return errorResponse(err)
 	}
 	return shim.Success(nil)
 }
 
+func (t *SimpleChaincode) insertPerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.writePerson(stub, args, modeCreate)
+}
+
 func (t *SimpleChaincode) updatePerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	//parse parameters  - need 4
-	argsMap, err := getUnmarshalledArgument(args)
+	return t.writePerson(stub, args, modeUpdate)
+}
+
+//create or update person, for callers that do not care whether it exists
+func (t *SimpleChaincode) upsertPerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	return t.writePerson(stub, args, modeUpsert)
+}
+
+//verbs of the write modes in logs and error messages
+var modeVerbs = map[int]string{modeCreate: "insert", modeUpdate: "update", modeUpsert: "upsert"}
+
+// Writes person of the request with createOrUpdatePerson in mode, then records
+// the history and emits the event. Inserts need the status, updates and
+// upserts at least one person field.
+func (t *SimpleChaincode) writePerson(stub shim.ChaincodeStubInterface, args []string, mode int) pb.Response {
+	var req PersonRequest
+	verb := modeVerbs[mode]
+	//parse parameters  - need 2, sensitive ones may come in the transient map
+	err := decodePersonRequest(stub, args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
+	hash := req.Hash
+	logger.Infof("%s man with hash %s", verb, hash)
+	user, company, err := getCaller(stub, req.CallerArgs)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	logger.Infof("update man with hash %s", hash)
-	user, err := getStringParamFromArgs("user", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
+	logger.Infof("for user %s of company %s", user, company)
+	patch, fields := req.patch()
+	if mode == modeCreate && !containsField(fields, "status") {
+		return errorResponse(newError(ERR_MISSING_FIELD, "status", "status is missing"))
 	}
-	fmt.Println("user=" + user)
-	logger.Infof("for user %s", user)
-	company, err := getStringParamFromArgs("company", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
+	if len(fields) == 0 {
+		return errorResponse(newError(ERR_MISSING_FIELD, "", "nothing to "+verb+", expecting one of "+strings.Join(personFields, ", ")))
 	}
-	fmt.Println("company=" + company)
-	logger.Infof("company= %s", company)
-	status, err := getStringParamFromArgs("status", argsMap)
+	logger.Debugf("fields= %v", fields)
+	//-----add person hash to state
+	txTime, err := getTxTime(stub)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("status=" + status)
-	logger.Infof("status= %s", status)
-	//-----add person hash to state
-	newPerson := &Person{}
-	newPerson.Hash = hash
-	newPerson.ModifyDate = time.Now()
-	newPerson.Status = status
-	err = createOrUpdatePerson(stub, hash, *newPerson)
+	patch.ModifyDate = txTime
+	patch.CreatedBy = company
+	person, action, changes, err := createOrUpdatePerson(stub, hash, patch, fields, mode)
 	if err != nil {
-		return shim.Error("error updating person")
+		return errorResponse(internalError(err, "failed to "+verb+" person"))
 	}
 	//------add record to person history
-	err = addHistoryRecord(stub, hash, ACTION_UPDATE, user, company, status)
+	err = addHistoryRecord(stub, hash, action, user, company, person.Status, changes)
 	if err != nil {
-		return shim.Error("Error putting new history record " + hash + " to state")
+		return errorResponse(internalError(err, "Error putting new history record "+hash+" to state"))
+	}
+	err = emitPersonEvent(stub, action, hash, statusBefore(person, action, changes), person.Status, user, company)
+	if err != nil {
+		return errorResponse(err)
 	}
-
 	return shim.Success(nil)
 }
 
 func (t *SimpleChaincode) searchPerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//parse parameters  - need 3
-	argsMap, err := getUnmarshalledArgument(args)
+	var req SearchRequest
+	//parse parameters  - need 1, may come in the transient map
+	err := decodeSearchRequest(stub, args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	fmt.Println("hash=" + hash)
+	hash := req.Hash
 	logger.Infof("search man with hash %s", hash)
-	user, err := getStringParamFromArgs("user", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	fmt.Println("user=" + user)
-	logger.Infof("for user %s", user)
-	company, err := getStringParamFromArgs("company", argsMap)
+	user, company, err := getCaller(stub, req.CallerArgs)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("company=" + company)
-	logger.Infof("company= %s", company)
+	logger.Infof("for user %s of company %s", user, company)
 
 	res := &SearchResult{}
 	//check existence
@@ -389,159 +443,244 @@ func (t *SimpleChaincode) searchPerson(stub shim.ChaincodeStubInterface, args []
 		var oldperson Person
 		err = json.Unmarshal(personBytes, &oldperson)
 		if err != nil {
-			return shim.Error("Error unmarshalling person " + hash + " from state")
+			return errorResponse(wrapError(ERR_INTERNAL, "Error unmarshalling person "+hash+" from state", err))
 		}
-		//fill response record
+		//fill response record, deleted person is reported as unknown
 		res.Status = oldperson.Status
+		if oldperson.Deleted != nil {
+			res.Status = STATUS_NOT_FOUND
+		}
 	} else {
 		//create new
 		//-----add person hash to state
+		txTime, err := getTxTime(stub)
+		if err != nil {
+			return errorResponse(err)
+		}
 		newPerson := &Person{}
 		newPerson.Hash = hash
-		newPerson.ModifyDate = time.Now()
+		newPerson.ModifyDate = txTime
 		newPerson.Status = STATUS_NOT_FOUND
-		err = createOrUpdatePerson(stub, hash, *newPerson)
+		//the person names no company, it would tell who searched, see searches.go
+		newPerson.SearchPlaceholder = true
+		_, _, _, err = createOrUpdatePerson(stub, hash, *newPerson, []string{"status"}, modeCreate)
 		if err != nil {
-			return shim.Error("error inserting person")
+			return errorResponse(internalError(err, "error inserting person"))
 		}
 		//------add record to person history
-		err = addHistoryRecord(stub, hash, ACTION_INSERT, user, company, STATUS_NOT_FOUND)
+		err = addHistoryRecord(stub, hash, ACTION_INSERT, "", "", STATUS_NOT_FOUND, nil)
 		if err != nil {
-			return shim.Error("Error putting new history record " + hash + " to state")
+			return errorResponse(internalError(err, "Error putting new history record "+hash+" to state"))
 		}
 	}
 	//add record to history
 	err = addSearchRecord(stub, hash, user, company, res.Status)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
+	}
+	//status before the search, empty if it created the person
+	var oldStatus PersonStatus
+	if found {
+		oldStatus = res.Status
+	}
+	err = emitPersonEvent(stub, ACTION_SEARCH, hash, oldStatus, res.Status, user, company)
+	if err != nil {
+		return errorResponse(err)
 	}
 	return shim.Success(nil)
 }
 
-func addHistoryRecord(stub shim.ChaincodeStubInterface, hash string, action string, user string, company string, status string) error {
-	var history []Action
-	historyBytes, err := stub.GetState(personHistoryPrfx + hash)
-	fmt.Println("current list: " + string(historyBytes))
-	logger.Infof("current list: %s", string(historyBytes))
+func addHistoryRecord(stub shim.ChaincodeStubInterface, hash string, action string, user string, company string, status PersonStatus, changes []FieldChange) error {
+	txTime, err := getTxTime(stub)
 	if err != nil {
-		return errors.New("Error getting history for person ")
-	}
-	if historyBytes != nil {
-		err = json.Unmarshal(historyBytes, &history)
-		if err != nil {
-			return errors.New("Error unmarshalling history for person ")
-		}
+		return err
 	}
 	newAction := &Action{}
 	newAction.Status = status
 	newAction.Method = action
 	newAction.User = user
-	newAction.Date = time.Now()
+	newAction.Date = txTime
 	newAction.Company = company
-	//insert action to history in LIFO order
-	history = append([]Action{*newAction}, history...)
-	//put history to state
-	newHistoryBytes, err := json.Marshal(&history)
+	newAction.Changes = changes
+	//put action to state under its own key
+	newActionBytes, err := json.Marshal(newAction)
 	if err != nil {
-		return errors.New("Error parsing history for person " + hash)
+		return wrapError(ERR_INTERNAL, "Error parsing history for person "+hash, err)
 	}
-	err = stub.PutState(personHistoryPrfx+hash, newHistoryBytes)
+	err = putEntry(stub, personHistoryObj, hash, txTime, stub.GetTxID(), newActionBytes)
 	if err != nil {
-		return errors.New("Error parsing history for person" + hash)
+		return wrapError(ERR_INTERNAL, "Error putting history for person "+hash, err)
 	}
-	return nil
+	return countAction(stub, hash, action, company)
 }
 
-func addSearchRecord(stub shim.ChaincodeStubInterface, hash string, user string, company string, status string) error {
-	var search []SearchResult
-	searchBytes, err := stub.GetState(personSearchPrfx + hash)
-	fmt.Println("current list: " + string(searchBytes))
-	logger.Infof("current list: %s", string(searchBytes))
+func addSearchRecord(stub shim.ChaincodeStubInterface, hash string, user string, company string, status PersonStatus) error {
+	txTime, err := getTxTime(stub)
 	if err != nil {
-		return errors.New("Error getting search result for person ")
-	}
-	if searchBytes != nil {
-		err = json.Unmarshal(searchBytes, &search)
-		if err != nil {
-			return errors.New("Error unmarshalling search result for person ")
-		}
+		return err
 	}
 	newSearch := &SearchResult{}
 	newSearch.Status = status
 	newSearch.User = user
-	newSearch.Date = time.Now()
+	newSearch.Date = txTime
 	newSearch.Company = company
-	//insert search to search list in LIFO order
-	search = append([]SearchResult{*newSearch}, search...)
-	//put search list to state
-	newSearchBytes, err := json.Marshal(&search)
+	//put detail to the collections and its digest to state under its own key, see searches.go
+	newSearchBytes, err := putPrivateSearch(stub, hash, newSearch)
 	if err != nil {
-		return errors.New("Error parsing search list for person " + hash)
+		return err
 	}
-	err = stub.PutState(personSearchPrfx+hash, newSearchBytes)
+	err = putEntry(stub, personSearchObj, hash, txTime, stub.GetTxID(), newSearchBytes)
 	if err != nil {
-		return errors.New("Error parsing search list for person" + hash)
+		return wrapError(ERR_INTERNAL, "Error putting search list for person "+hash, err)
 	}
-	return nil
+	return countSearch(stub, hash, company, txTime)
 }
 
-func createOrUpdatePerson(stub shim.ChaincodeStubInterface, hash string, newPerson Person) error {
-	var oldPerson Person
+//returns the transaction timestamp, the same on every endorsing peer
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, wrapError(ERR_INTERNAL, "Error getting transaction timestamp", err)
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
+
+// write modes of createOrUpdatePerson
+const (
+	modeCreate = iota // person must not exist
+	modeUpdate        // person must exist
+	modeUpsert        // create or update
+)
+
+// Puts person in state, taking the listed fields from patch and ModifyDate,
+// for a new person also CreatedBy and SearchPlaceholder. An existing person
+// can be changed only by its company, see checkPersonOwner; a person a search
+// registered belongs to no company until the first write takes it.
+// Returns the stored person, ACTION_INSERT or ACTION_UPDATE and the fields an
+// update changed.
+func createOrUpdatePerson(stub shim.ChaincodeStubInterface, hash string, patch Person, fields []string, mode int) (Person, string, []FieldChange, error) {
+	var person Person
+	var action string
+	var changes []FieldChange
+	//encrypted fields the write sets, see encryption.go
+	var encrypted []string
+	crypt, err := loadFieldEncryption(stub)
+	if err != nil {
+		return person, "", nil, err
+	}
 	//retrieve Person from state by hash
 	personBytes, err := stub.GetState(personPrfx + hash)
-	if err != nil || len(personBytes) == 0 {
+	if err != nil {
+		return person, "", nil, wrapError(ERR_INTERNAL, "error getting person from state", err)
+	}
+	if len(personBytes) == 0 {
 		//data not found, create scenario
-		oldPerson = newPerson
+		if mode == modeUpdate {
+			return person, "", nil, &PersonError{Code: ERR_PERSON_NOT_FOUND, Message: "person does not exist", Field: "hash", Hash: hash}
+		}
+		if !containsField(fields, "status") {
+			return person, "", nil, &PersonError{Code: ERR_MISSING_FIELD, Message: "new person needs status", Field: "status", Hash: hash}
+		}
+		err = checkNewPersonHash(stub, hash)
+		if err != nil {
+			return person, "", nil, err
+		}
+		err = checkStatusTransition(stub, "", patch.Status)
+		if err != nil {
+			return person, "", nil, err
+		}
+		person.Hash = hash
+		person.CreatedBy = patch.CreatedBy
+		person.SearchPlaceholder = patch.SearchPlaceholder
+		encrypted, err = openForWrite(stub, crypt, &person, fields)
+		if err != nil {
+			return person, "", nil, err
+		}
+		mergePerson(&person, &patch, fields)
+		action = ACTION_INSERT
 	} else {
 		//update scenario
-		err = json.Unmarshal(personBytes, &oldPerson)
+		if mode == modeCreate {
+			return person, "", nil, &PersonError{Code: ERR_PERSON_EXISTS, Message: "person already exists", Field: "hash", Hash: hash}
+		}
+		err = json.Unmarshal(personBytes, &person)
+		if err != nil {
+			return person, "", nil, wrapError(ERR_INTERNAL, "error unmarshalling person from state", err)
+		}
+		if person.Deleted != nil {
+			return person, "", nil, &PersonError{Code: ERR_PERSON_DELETED, Message: "person is deleted", Field: "hash", Hash: hash}
+		}
+		//a person only a search registered goes to the first company that writes it
+		if person.SearchPlaceholder {
+			person.CreatedBy = patch.CreatedBy
+			person.SearchPlaceholder = false
+		}
+		err = checkPersonOwner(stub, &person, patch.CreatedBy)
 		if err != nil {
-			return errors.New("error unmarshalling person from state")
+			return person, "", nil, err
 		}
-		//TODO merge data, now only replace
-		oldPerson = newPerson
+		if containsField(fields, "status") {
+			err = checkStatusTransition(stub, person.Status, patch.Status)
+			if err != nil {
+				return person, "", nil, err
+			}
+		}
+		encrypted, err = openForWrite(stub, crypt, &person, fields)
 		if err != nil {
-			return errors.New("error mergin data of Person")
+			return person, "", nil, err
 		}
+		changes = mergePerson(&person, &patch, fields)
+		action = ACTION_UPDATE
 	}
+	if len(encrypted) != 0 {
+		changes, err = sealAfterWrite(stub, crypt, &person, encrypted, changes)
+		if err != nil {
+			return person, "", nil, err
+		}
+	}
+	person.ModifyDate = patch.ModifyDate
 	//put Person in state
-	err = putPersonInState(stub, hash, oldPerson)
+	err = putPersonInState(stub, hash, person)
 	if err != nil {
-		return err
+		return person, "", nil, err
 	}
-	return nil
+	return person, action, changes, nil
 }
 
+//puts person in state and updates its index keys, see query.go
 func putPersonInState(stub shim.ChaincodeStubInterface, hash string, person Person) error {
+	old, err := getPersonFromState(stub, hash)
+	if err != nil {
+		return err
+	}
+	person.DocType = DOC_TYPE_PERSON
+	person.ModifyKey = person.ModifyDate.UTC().Format(entryTimeLayout)
+	err = updatePersonIndexes(stub, old, &person)
+	if err != nil {
+		return err
+	}
+	err = updateStatusCounts(stub, old, &person)
+	if err != nil {
+		return err
+	}
 	personAsBytes, err := json.Marshal(&person)
 	if err != nil {
-		return errors.New("Error marhalling new person")
+		return wrapError(ERR_INTERNAL, "Error marhalling new person", err)
 	}
 	err = stub.PutState(personPrfx+hash, personAsBytes)
 	if err != nil {
-		return errors.New("Error puttin new person")
+		return wrapError(ERR_INTERNAL, "Error puttin new person", err)
 	}
-	fmt.Println("put record for " + hash)
 	logger.Infof("put record for %s", hash)
 	return nil
 }
 
 func (t *SimpleChaincode) setLoggingLevel(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	type LogLevelArg struct {
-		Level string `json:"logLevel"`
-	}
-	var level LogLevelArg
-	var err error
-	if len(args) != 1 {
-		err = errors.New("Incorrect number of arguments. Expecting a JSON encoded LogLevel.")
-		logger.Errorf(err.Error())
-		return shim.Error(err.Error())
-	}
-	err = json.Unmarshal([]byte(args[0]), &level)
+	var level LogLevelRequest
+	err := decodeRequest(args, &level)
 	if err != nil {
-		err = fmt.Errorf("setLoggingLevel failed to unmarshal arg: %s", err)
 		logger.Errorf(err.Error())
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
 	switch level.Level {
@@ -558,9 +697,9 @@ func (t *SimpleChaincode) setLoggingLevel(stub shim.ChaincodeStubInterface, args
 	case "CRITICAL":
 		logger.SetLevel(shim.LogCritical)
 	default:
-		err = fmt.Errorf("setLoggingLevel failed with unknown arg: %s", level.Level)
+		err = newError(ERR_INVALID_FIELD, "logLevel", "setLoggingLevel failed with unknown arg: "+level.Level)
 		logger.Errorf(err.Error())
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 
 	return shim.Success(nil)
@@ -568,29 +707,19 @@ func (t *SimpleChaincode) setLoggingLevel(stub shim.ChaincodeStubInterface, args
 
 func (t *SimpleChaincode) searchPersonAndReturn(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	//parse parameters  - need 3
-	argsMap, err := getUnmarshalledArgument(args)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	hash, err := getStringParamFromArgs("hash", argsMap)
+	var req SearchRequest
+	//parse parameters  - need 1, may come in the transient map
+	err := decodeSearchRequest(stub, args, &req)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("hash=" + hash)
+	hash := req.Hash
 	logger.Infof("search man with hash %s", hash)
-	user, err := getStringParamFromArgs("user", argsMap)
-	if err != nil {
-		return shim.Error(err.Error())
-	}
-	fmt.Println("user=" + user)
-	logger.Infof("for user %s", user)
-	company, err := getStringParamFromArgs("company", argsMap)
+	user, company, err := getCaller(stub, req.CallerArgs)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
-	fmt.Println("company=" + company)
-	logger.Infof("company= %s", company)
+	logger.Infof("for user %s of company %s", user, company)
 
 	res := &SearchResult{}
 	//check existence
@@ -603,26 +732,36 @@ func (t *SimpleChaincode) searchPersonAndReturn(stub shim.ChaincodeStubInterface
 		var oldperson Person
 		err = json.Unmarshal(personBytes, &oldperson)
 		if err != nil {
-			return shim.Error("Error unmarshalling person " + hash + " from state")
+			return errorResponse(wrapError(ERR_INTERNAL, "Error unmarshalling person "+hash+" from state", err))
 		}
-		//fill response record
+		//fill response record, deleted person is reported as unknown
 		res.Status = oldperson.Status
 		res.Date = oldperson.ModifyDate
+		if oldperson.Deleted != nil {
+			res.Status = STATUS_NOT_FOUND
+			res.Date = time.Time{}
+		}
 	} else {
 		//create new
 		//-----add person hash to state
+		txTime, err := getTxTime(stub)
+		if err != nil {
+			return errorResponse(err)
+		}
 		newPerson := &Person{}
 		newPerson.Hash = hash
-		newPerson.ModifyDate = time.Now()
+		newPerson.ModifyDate = txTime
 		newPerson.Status = STATUS_NOT_FOUND
-		err = createOrUpdatePerson(stub, hash, *newPerson)
+		//the person names no company, it would tell who searched, see searches.go
+		newPerson.SearchPlaceholder = true
+		_, _, _, err = createOrUpdatePerson(stub, hash, *newPerson, []string{"status"}, modeCreate)
 		if err != nil {
-			return shim.Error("error inserting person")
+			return errorResponse(internalError(err, "error inserting person"))
 		}
 		//------add record to person history
-		err = addHistoryRecord(stub, hash, ACTION_INSERT, user, company, STATUS_NOT_FOUND)
+		err = addHistoryRecord(stub, hash, ACTION_INSERT, "", "", STATUS_NOT_FOUND, nil)
 		if err != nil {
-			return shim.Error("Error putting new history record " + hash + " to state")
+			return errorResponse(internalError(err, "Error putting new history record "+hash+" to state"))
 		}
 		res.Status = newPerson.Status
 		res.Date = newPerson.ModifyDate
@@ -630,12 +769,21 @@ func (t *SimpleChaincode) searchPersonAndReturn(stub shim.ChaincodeStubInterface
 	//add record to history
 	err = addSearchRecord(stub, hash, user, company, res.Status)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
+	}
+	//status before the search, empty if it created the person
+	var oldStatus PersonStatus
+	if found {
+		oldStatus = res.Status
+	}
+	err = emitPersonEvent(stub, ACTION_SEARCH, hash, oldStatus, res.Status, user, company)
+	if err != nil {
+		return errorResponse(err)
 	}
 	//prepare response
 	resBytes, err := json.Marshal(res)
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(err)
 	}
 	return shim.Success(resBytes)
 }
@@ -0,0 +1,2260 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+//person hashes are hex SHA-256
+const testHash = "a3f1c2e4b5d6978812345678deadbeef00112233445566778899aabbccddeeff"
+const otherHash = "0ffe1abd1a08215353c233d6e009613e95eec4253832a761af28ff37ac5a150c"
+const unknownHash = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+
+//returns distinct valid hash for n
+func hashN(n int) string {
+	return fmt.Sprintf("%064x", n)
+}
+
+//identity that instantiates the chaincode in newInsuranceStub
+const adminUser = "root"
+const adminCompany = "consortium"
+
+//newInsuranceStub returns a test stub with the chaincode instantiated by the
+//admin and insurer role granted to alice, bob and carol, auditor to audrey
+func newInsuranceStub(t *testing.T) *testStub {
+	t.Helper()
+	stub := newTestStub(new(SimpleChaincode))
+	mustSucceed(t, stub.initAs(adminUser, adminCompany, "{}"))
+	grants := [][]string{
+		{"alice", "acme", ROLE_INSURER},
+		//admins may also change persons of other companies, see checkPersonOwner
+		{"bob", "globex", ROLE_ADMIN},
+		{"carol", "initech", ROLE_INSURER},
+		{"audrey", "regulator", ROLE_AUDITOR},
+	}
+	for _, grant := range grants {
+		mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg(grant[0], grant[1], grant[2])))
+	}
+	return stub
+}
+
+func roleArg(user string, company string, role string) string {
+	b, _ := json.Marshal(map[string]string{"user": user, "company": company, "role": role})
+	return string(b)
+}
+
+func personArg(hash string, status string) string {
+	arg := map[string]string{"hash": hash}
+	if status != "" {
+		arg["status"] = status
+	}
+	b, _ := json.Marshal(arg)
+	return string(b)
+}
+
+func hashArg(hash string) string {
+	return `{"hash":"` + hash + `"}`
+}
+
+func mustSucceed(t *testing.T, res pb.Response) []byte {
+	t.Helper()
+	if res.Status != shim.OK {
+		t.Fatalf("expected success, got status %d: %s", res.Status, res.Message)
+	}
+	return res.Payload
+}
+
+func mustFail(t *testing.T, res pb.Response, msg string) {
+	t.Helper()
+	if res.Status == shim.OK {
+		t.Fatalf("expected failure containing %q, got success", msg)
+	}
+	if !strings.Contains(res.Message, msg) {
+		t.Fatalf("expected failure containing %q, got %q", msg, res.Message)
+	}
+	//every error response is a JSON object with a code
+	var chaincodeErr ChaincodeError
+	if err := json.Unmarshal([]byte(res.Message), &chaincodeErr); err != nil || chaincodeErr.Code == "" {
+		t.Fatalf("error response %q is not a JSON error with code", res.Message)
+	}
+}
+
+func getPerson(t *testing.T, stub *testStub, hash string) Person {
+	t.Helper()
+	var person Person
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", hashArg(hash)))
+	if err := json.Unmarshal(payload, &person); err != nil {
+		t.Fatalf("cannot unmarshal person %q: %s", payload, err)
+	}
+	return person
+}
+
+func getHistory(t *testing.T, stub *testStub, hash string) []Action {
+	t.Helper()
+	var history []Action
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", hashArg(hash)))
+	if err := json.Unmarshal(payload, &history); err != nil {
+		t.Fatalf("cannot unmarshal history %q: %s", payload, err)
+	}
+	return history
+}
+
+func getSearches(t *testing.T, stub *testStub, hash string) []SearchResult {
+	t.Helper()
+	var searches []SearchResult
+	//the regulator reads the details of all searches
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getPersonSearches", hashArg(hash)))
+	if err := json.Unmarshal(payload, &searches); err != nil {
+		t.Fatalf("cannot unmarshal searches %q: %s", payload, err)
+	}
+	return searches
+}
+
+func TestInsertPerson(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+
+	person := getPerson(t, stub, testHash)
+	if person.Hash != testHash || person.Status != "trusted" {
+		t.Errorf("unexpected person %+v", person)
+	}
+	history := getHistory(t, stub, testHash)
+	if len(history) != 1 {
+		t.Fatalf("expected 1 history record, got %d", len(history))
+	}
+	if a := history[0]; a.Method != ACTION_INSERT || a.User != "alice" || a.Company != "acme" || a.Status != "trusted" {
+		t.Errorf("unexpected history record %+v", a)
+	}
+}
+
+func TestInsertPersonMissingParams(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "insertPerson"), "Expecting one JSON event object")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "insertPerson", "not json"), "failed to unmarshal arg")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "insertPerson", `{"status":"trusted"}`), "hash is missing")
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "")), "status is missing")
+	if _, found := stub.State[personPrfx+testHash]; found {
+		t.Errorf("failed inserts must not write person")
+	}
+}
+
+func TestCallerFromTransactionCreator(t *testing.T) {
+	stub := newInsuranceStub(t)
+	stub.creator = nil
+	mustFail(t, stub.invoke("insertPerson", personArg(testHash, "trusted")), "transaction creator is not available")
+	stub.creator = []byte("garbage")
+	mustFail(t, stub.invoke("insertPerson", personArg(testHash, "trusted")), "failed to unmarshal transaction creator")
+
+	//matching client values are accepted, others rejected
+	stub.setCreator("alice", "acme")
+	mustSucceed(t, stub.invoke("insertPerson", `{"hash":"`+testHash+`","status":"trusted","user":"alice","company":"acme"}`))
+	mustFail(t, stub.invoke("updatePerson", `{"hash":"`+testHash+`","status":"banned","user":"mallory"}`), "does not match transaction creator")
+	mustFail(t, stub.invoke("searchPerson", `{"hash":"`+testHash+`","company":"globex"}`), "does not match transaction creator")
+	mustFail(t, stub.invoke("searchPersonAndReturn", `{"hash":"`+testHash+`","company":"globex"}`), "does not match transaction creator")
+
+	history := getHistory(t, stub, testHash)
+	if len(history) != 1 || history[0].User != "alice" || history[0].Company != "acme" {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestInitGrantsAdmin(t *testing.T) {
+	stub := newTestStub(new(SimpleChaincode))
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{"logLevel":"DEBUG"}`), "access denied")
+	//a failed init grants nothing
+	for _, args := range [][]string{{}, {"{}", "{}"}} {
+		mustFail(t, stub.initAs(adminUser, adminCompany, args...), "Expecting 1")
+		mustFail(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{"logLevel":"DEBUG"}`), "access denied")
+	}
+	mustSucceed(t, stub.initAs(adminUser, adminCompany, "{}"))
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{"logLevel":"DEBUG"}`))
+	//init as reset is an admin function too
+	mustFail(t, stub.invokeAs("alice", "acme", "init", "{}"), "access denied")
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "init", "{}"))
+}
+
+func TestRolePermissions(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+
+	//auditor reads but does not change persons
+	mustFail(t, stub.invokeAs("audrey", "regulator", "updatePerson", personArg(testHash, "banned")), "access denied")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "searchPerson", personArg(testHash, "")), "access denied")
+	mustSucceed(t, stub.invokeAs("audrey", "regulator", "getPersonInfo", hashArg(testHash)))
+	mustSucceed(t, stub.invokeAs("audrey", "regulator", "getPersonSearches", hashArg(testHash)))
+	//insurer changes persons but does not administer
+	mustFail(t, stub.invokeAs("alice", "acme", "setLoggingLevel", `{"logLevel":"DEBUG"}`), "access denied")
+	mustFail(t, stub.invokeAs("alice", "acme", "maintenanceWrite", maintenanceArg("key1", "value1")), "access denied")
+	mustFail(t, stub.invokeAs("alice", "acme", "grantRole", roleArg("alice", "acme", ROLE_ADMIN)), "access denied")
+	//identities without roles can do nothing
+	mustFail(t, stub.invokeAs("mallory", "acme", "getPersonInfo", hashArg(testHash)), "access denied")
+	//same user name in another company is another identity
+	mustFail(t, stub.invokeAs("alice", "globex", "insertPerson", personArg(otherHash, "trusted")), "access denied")
+
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "revokeRole", roleArg("alice", "acme", ROLE_INSURER)))
+	mustFail(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, "banned")), "access denied")
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg("alice", "acme", ROLE_AUDITOR)))
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg("alice", "acme", ROLE_AUDITOR)))
+
+	var assignment RoleAssignment
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getRoles", `{"user":"alice","company":"acme"}`))
+	if err := json.Unmarshal(payload, &assignment); err != nil {
+		t.Fatalf("cannot unmarshal roles %q: %s", payload, err)
+	}
+	if len(assignment.Roles) != 1 || assignment.Roles[0] != ROLE_AUDITOR {
+		t.Errorf("unexpected roles %+v", assignment)
+	}
+
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg("alice", "acme", "superuser")), "role must be one of")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "revokeRole", roleArg(adminUser, adminCompany, ROLE_ADMIN)), "can not revoke own admin role")
+}
+
+func TestUpdatePerson(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "banned")))
+
+	if person := getPerson(t, stub, testHash); person.Status != "banned" {
+		t.Errorf("expected status banned, got %q", person.Status)
+	}
+	history := getHistory(t, stub, testHash)
+	if len(history) != 2 {
+		t.Fatalf("expected 2 history records, got %d", len(history))
+	}
+	//newest record comes first
+	if a := history[0]; a.Method != ACTION_UPDATE || a.User != "bob" || a.Company != "globex" || a.Status != "banned" {
+		t.Errorf("unexpected history record %+v", a)
+	}
+	if history[1].Method != ACTION_INSERT {
+		t.Errorf("expected oldest record to be the insert, got %+v", history[1])
+	}
+	mustFail(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`"}`), "nothing to update")
+}
+
+func TestPersonOwnership(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+
+	//only the company that created the person and admins may change it
+	var personErr PersonError
+	res := stub.invokeAs("carol", "initech", "updatePerson", personArg(testHash, "banned"))
+	mustFail(t, res, ERR_ACCESS_DENIED)
+	if err := json.Unmarshal([]byte(res.Message), &personErr); err != nil || personErr.Hash != testHash || personErr.Field != "hash" {
+		t.Errorf("unexpected person error %q", res.Message)
+	}
+	mustFail(t, stub.invokeAs("carol", "initech", "upsertPerson", personArg(testHash, "banned")), ERR_ACCESS_DENIED)
+	mustFail(t, stub.invokeAs("carol", "initech", "batchUpdatePersons", `{"persons":[{"hash":"`+testHash+`","status":"banned"}]}`), ERR_ACCESS_DENIED)
+	if person := getPerson(t, stub, testHash); person.Status != STATUS_OK || person.CreatedBy != "acme" {
+		t.Errorf("denied update changed person %+v", person)
+	}
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "updatePerson", personArg(testHash, "banned")))
+	if person := getPerson(t, stub, testHash); person.Status != STATUS_SUSP || person.CreatedBy != "acme" {
+		t.Errorf("admin update not kept or changed owner %+v", person)
+	}
+
+	//a person a company inserted as not initialized stays with it
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(otherHash, string(STATUS_NOT_FOUND))))
+	mustFail(t, stub.invokeAs("carol", "initech", "updatePerson", personArg(otherHash, "banned")), ERR_ACCESS_DENIED)
+	mustFail(t, stub.invokeAs("carol", "initech", "upsertPerson", personArg(otherHash, "banned")), ERR_ACCESS_DENIED)
+	if person := getPerson(t, stub, otherHash); person.Status != STATUS_NOT_FOUND || person.CreatedBy != "acme" {
+		t.Errorf("person taken over %+v", person)
+	}
+
+	//a person a search registered goes to the company that writes it first
+	mustSucceed(t, stub.invokeAs("carol", "initech", "searchPerson", hashArg(unknownHash)))
+	if person := getPerson(t, stub, unknownHash); !person.SearchPlaceholder || person.CreatedBy != "" {
+		t.Errorf("unexpected person registered by search %+v", person)
+	}
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(unknownHash, "banned")))
+	if person := getPerson(t, stub, unknownHash); person.SearchPlaceholder || person.CreatedBy != "acme" {
+		t.Errorf("unexpected person after first write %+v", person)
+	}
+	mustFail(t, stub.invokeAs("carol", "initech", "updatePerson", personArg(unknownHash, "trusted")), ERR_ACCESS_DENIED)
+}
+
+func TestStrictInsertAndUpdate(t *testing.T) {
+	stub := newInsuranceStub(t)
+	var personErr PersonError
+	res := stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, "banned"))
+	mustFail(t, res, ERR_PERSON_NOT_FOUND)
+	if err := json.Unmarshal([]byte(res.Message), &personErr); err != nil || personErr.Hash != testHash || personErr.Field != "hash" {
+		t.Errorf("unexpected person error %q", res.Message)
+	}
+	if _, found := stub.State[personPrfx+testHash]; found {
+		t.Errorf("failed update must not create person")
+	}
+
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustFail(t, stub.invokeAs("bob", "globex", "insertPerson", personArg(testHash, "banned")), ERR_PERSON_EXISTS)
+	if person := getPerson(t, stub, testHash); person.Status != STATUS_OK {
+		t.Errorf("failed insert changed status to %q", person.Status)
+	}
+
+	//upsert creates or updates and records which one it did
+	mustSucceed(t, stub.invokeAs("bob", "globex", "upsertPerson", personArg(testHash, "banned")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "upsertPerson", personArg(otherHash, "banned")))
+	if person := getPerson(t, stub, testHash); person.Status != STATUS_SUSP {
+		t.Errorf("expected upserted status banned, got %q", person.Status)
+	}
+	if history := getHistory(t, stub, testHash); len(history) != 2 || history[0].Method != ACTION_UPDATE {
+		t.Errorf("unexpected history %+v", history)
+	}
+	if history := getHistory(t, stub, otherHash); len(history) != 1 || history[0].Method != ACTION_INSERT {
+		t.Errorf("unexpected history %+v", history)
+	}
+	mustFail(t, stub.invokeAs("bob", "globex", "upsertPerson", personArg(testHash, "not-initialized")), ERR_ILLEGAL_STATUS_TRANSITION)
+}
+
+func TestMergePersonFields(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson",
+		`{"hash":"`+testHash+`","status":"trusted","policyNumbers":["P-1"],"riskScore":0.5,"notes":"first"}`))
+	//fields missing in the patch are kept, status included
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`","riskScore":0.75,"sourceCompany":"globex"}`))
+	person := getPerson(t, stub, testHash)
+	if person.Status != STATUS_OK || len(person.PolicyNumbers) != 1 || person.Notes != "first" {
+		t.Errorf("partial update lost fields: %+v", person)
+	}
+	if person.RiskScore == nil || *person.RiskScore != 0.75 || person.SourceCompany != "globex" {
+		t.Errorf("partial update not applied: %+v", person)
+	}
+	//null clears a field
+	mustSucceed(t, stub.invokeAs("bob", "globex", "upsertPerson", `{"hash":"`+testHash+`","riskScore":null,"notes":null}`))
+	person = getPerson(t, stub, testHash)
+	if person.RiskScore != nil || person.Notes != "" || person.SourceCompany != "globex" {
+		t.Errorf("null did not clear fields: %+v", person)
+	}
+
+	history := getHistory(t, stub, testHash)
+	if len(history) != 3 || history[2].Changes != nil {
+		t.Fatalf("unexpected history %+v", history)
+	}
+	if a := history[1]; a.Status != STATUS_OK || len(a.Changes) != 2 || a.Changes[0].Field != "riskScore" || a.Changes[0].Old != 0.5 || a.Changes[0].New != 0.75 {
+		t.Errorf("unexpected changes %+v", a.Changes)
+	}
+	if a := history[0]; len(a.Changes) != 2 || a.Changes[1].Field != "notes" || a.Changes[1].Old != "first" || a.Changes[1].New != "" {
+		t.Errorf("unexpected changes %+v", a.Changes)
+	}
+
+	mustFail(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`","riskScore":"high"}`), "riskScore must be a number")
+	mustFail(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`","policyNumbers":[1]}`), "policyNumbers must be an array of strings")
+	mustFail(t, stub.invokeAs("bob", "globex", "insertPerson", `{"hash":"`+otherHash+`","notes":"x"}`), "status is missing")
+	mustFail(t, stub.invokeAs("bob", "globex", "upsertPerson", `{"hash":"`+otherHash+`","notes":"x"}`), ERR_MISSING_FIELD)
+}
+
+func TestStatusTransitions(t *testing.T) {
+	stub := newInsuranceStub(t)
+	var statusErr StatusError
+	res := stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "suspicious"))
+	if errs := getFieldErrors(t, res); len(errs) != 1 || errs[0].Field != "status" || errs[0].Code != ERR_UNKNOWN_STATUS {
+		t.Errorf("unexpected status error %q", res.Message)
+	}
+
+	mustSucceed(t, stub.invokeAs("alice", "acme", "searchPerson", personArg(testHash, "")))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, string(STATUS_SUSP))))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, string(STATUS_SUSP))))
+	res = stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, string(STATUS_NOT_FOUND)))
+	mustFail(t, res, ERR_ILLEGAL_STATUS_TRANSITION)
+	if err := json.Unmarshal([]byte(res.Message), &statusErr); err != nil || statusErr.From != STATUS_SUSP || statusErr.To != STATUS_NOT_FOUND {
+		t.Errorf("unexpected status error %q", res.Message)
+	}
+	if person := getPerson(t, stub, testHash); person.Status != STATUS_SUSP {
+		t.Errorf("rejected transition changed status to %q", person.Status)
+	}
+
+	//admin can tighten the table, others can only read it
+	table := `{"initial":["not-initialized"],"allowed":{"not-initialized":["trusted"],"trusted":["banned"]}}`
+	mustFail(t, stub.invokeAs("alice", "acme", "setStatusTransitions", table), "access denied")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setStatusTransitions", `{"initial":["dead"]}`), "initial[0]")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setStatusTransitions", `{"initial":["trusted"],"allowed":{"trusted":["dead"]}}`), "allowed.trusted[0]")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setStatusTransitions", `{"allowed":{}}`), "initial is missing")
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "setStatusTransitions", table))
+	var transitions StatusTransitions
+	payload := mustSucceed(t, stub.invokeAs("alice", "acme", "getStatusTransitions", "{}"))
+	if err := json.Unmarshal(payload, &transitions); err != nil || len(transitions.Initial) != 1 {
+		t.Errorf("unexpected status transitions %q", payload)
+	}
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(otherHash, string(STATUS_OK))), "new person can not get status")
+	mustFail(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, string(STATUS_OK))), ERR_ILLEGAL_STATUS_TRANSITION)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "searchPerson", personArg(otherHash, "")))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(otherHash, string(STATUS_OK))))
+}
+
+func TestSearchPerson(t *testing.T) {
+	stub := newInsuranceStub(t)
+	//unknown person gets registered as not initialized
+	mustSucceed(t, stub.invokeAs("alice", "acme", "searchPerson", personArg(testHash, "")))
+	if person := getPerson(t, stub, testHash); person.Status != STATUS_NOT_FOUND {
+		t.Errorf("expected status %q, got %q", STATUS_NOT_FOUND, person.Status)
+	}
+	if history := getHistory(t, stub, testHash); len(history) != 1 || history[0].Status != STATUS_NOT_FOUND {
+		t.Errorf("unexpected history %+v", history)
+	}
+
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "banned")))
+	mustSucceed(t, stub.invokeAs("carol", "initech", "searchPerson", personArg(testHash, "")))
+
+	searches := getSearches(t, stub, testHash)
+	if len(searches) != 2 {
+		t.Fatalf("expected 2 search records, got %d", len(searches))
+	}
+	if s := searches[0]; s.User != "carol" || s.Company != "initech" || s.Status != "banned" {
+		t.Errorf("unexpected search record %+v", s)
+	}
+	if s := searches[1]; s.User != "alice" || s.Status != STATUS_NOT_FOUND {
+		t.Errorf("unexpected search record %+v", s)
+	}
+	mustFail(t, stub.invokeAs("carol", "initech", "searchPerson", `{}`), "hash is missing")
+}
+
+func TestSearchPersonAndReturn(t *testing.T) {
+	stub := newInsuranceStub(t)
+	var res SearchResult
+	payload := mustSucceed(t, stub.invokeAs("alice", "acme", "searchPersonAndReturn", personArg(testHash, "")))
+	if err := json.Unmarshal(payload, &res); err != nil {
+		t.Fatalf("cannot unmarshal search result %q: %s", payload, err)
+	}
+	if res.Status != STATUS_NOT_FOUND || res.Date.IsZero() {
+		t.Errorf("unexpected search result %+v", res)
+	}
+
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "trusted")))
+	payload = mustSucceed(t, stub.invokeAs("alice", "acme", "searchPersonAndReturn", personArg(testHash, "")))
+	if err := json.Unmarshal(payload, &res); err != nil {
+		t.Fatalf("cannot unmarshal search result %q: %s", payload, err)
+	}
+	if res.Status != "trusted" {
+		t.Errorf("expected status trusted, got %q", res.Status)
+	}
+	if searches := getSearches(t, stub, testHash); len(searches) != 2 {
+		t.Errorf("expected 2 search records, got %d", len(searches))
+	}
+}
+
+func TestTimestampsFromTransaction(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	insertTime := stub.clock
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", personArg(testHash, "")))
+	searchTime := stub.clock
+
+	if person := getPerson(t, stub, testHash); !person.ModifyDate.Equal(insertTime) {
+		t.Errorf("expected modifyDate %s, got %s", insertTime, person.ModifyDate)
+	}
+	if history := getHistory(t, stub, testHash); !history[0].Date.Equal(insertTime) {
+		t.Errorf("expected history date %s, got %s", insertTime, history[0].Date)
+	}
+	if searches := getSearches(t, stub, testHash); !searches[0].Date.Equal(searchTime) {
+		t.Errorf("expected search date %s, got %s", searchTime, searches[0].Date)
+	}
+
+	//replaying the same transaction yields byte-identical writes
+	replay := newInsuranceStub(t)
+	mustSucceed(t, replay.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	for key, value := range replay.State {
+		if string(value) != string(stub.history[key][0].Value) {
+			t.Errorf("writes to %q differ: %s vs %s", key, value, stub.history[key][0].Value)
+		}
+	}
+}
+
+func TestHistoryEntriesAreAppendOnly(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "banned")))
+	mustSucceed(t, stub.invokeAs("carol", "initech", "searchPerson", personArg(testHash, "")))
+
+	if _, found := stub.State[personHistoryPrfx+testHash]; found {
+		t.Errorf("legacy history array must not be written")
+	}
+	//every record has its own key, written once
+	var entryKeys int
+	for key, mods := range stub.history {
+		if !strings.HasPrefix(key, "\x00") {
+			continue
+		}
+		objectType, attributes, err := stub.SplitCompositeKey(key)
+		if err != nil || (objectType != personHistoryObj && objectType != personSearchObj) {
+			continue
+		}
+		entryKeys++
+		if len(mods) != 1 || attributes[0] != testHash || attributes[2] != mods[0].TxId {
+			t.Errorf("unexpected entry %q with %d writes", key, len(mods))
+		}
+	}
+	if entryKeys != 3 {
+		t.Errorf("expected 3 entry keys, got %d", entryKeys)
+	}
+}
+
+func TestMigratePersonHistory(t *testing.T) {
+	stub := newInsuranceStub(t)
+	stub.seed(personHistoryPrfx+testHash, []byte(`[`+
+		`{"company":"globex","user":"bob","date":"2016-02-01T00:00:00Z","status":"banned","method":"update"},`+
+		`{"company":"acme","user":"alice","date":"2016-01-01T00:00:00Z","status":"trusted","method":"create"}]`))
+	stub.seed(personSearchPrfx+testHash, []byte(`[`+
+		`{"company":"initech","user":"carol","date":"2016-03-01T00:00:00Z","status":"banned"}]`))
+
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg("dave", "acme", ROLE_INSURER)))
+	//new records are listed before the legacy ones
+	mustSucceed(t, stub.invokeAs("dave", "acme", "searchPerson", personArg(testHash, "")))
+	before := getSearches(t, stub, testHash)
+	if len(before) != 2 || before[0].User != "dave" || before[1].User != "carol" {
+		t.Fatalf("unexpected searches before migration %+v", before)
+	}
+	beforeHistory := getHistory(t, stub, testHash)
+
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "migratePersonHistory", hashArg(testHash)))
+	if _, found := stub.State[personHistoryPrfx+testHash]; found {
+		t.Errorf("legacy history array must be removed")
+	}
+	if _, found := stub.State[personSearchPrfx+testHash]; found {
+		t.Errorf("legacy search array must be removed")
+	}
+	history := getHistory(t, stub, testHash)
+	//the search registered the person without naming the searcher
+	if len(history) != 3 || history[0].Method != ACTION_INSERT || history[0].User != "" || history[1].User != "bob" || history[2].User != "alice" {
+		t.Errorf("unexpected history after migration %+v", history)
+	}
+	if len(history) != len(beforeHistory) {
+		t.Errorf("migration changed history length from %d to %d", len(beforeHistory), len(history))
+	}
+	after := getSearches(t, stub, testHash)
+	if len(after) != 2 || after[0].User != "dave" || after[1].User != "carol" {
+		t.Errorf("unexpected searches after migration %+v", after)
+	}
+	//migrating again is a no-op
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "migratePersonHistory", hashArg(testHash)))
+	if again := getHistory(t, stub, testHash); len(again) != 3 {
+		t.Errorf("second migration changed history %+v", again)
+	}
+}
+
+//page of search records as returned by a paged list function
+type searchPage struct {
+	Records  []SearchResult `json:"records"`
+	Bookmark string         `json:"bookmark"`
+	Total    int            `json:"total"`
+}
+
+func getSearchPage(t *testing.T, stub *testStub, arg string) searchPage {
+	t.Helper()
+	var page searchPage
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getPersonSearches", arg))
+	if err := json.Unmarshal(payload, &page); err != nil {
+		t.Fatalf("cannot unmarshal page %q: %s", payload, err)
+	}
+	return page
+}
+
+func TestGetPersonSearchesPaging(t *testing.T) {
+	stub := newInsuranceStub(t)
+	for _, user := range []string{"u1", "u2", "u3", "u4", "u5", "u6"} {
+		mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg(user, "acme", ROLE_INSURER)))
+	}
+	for _, user := range []string{"u1", "u2", "u3", "u4", "u5"} {
+		mustSucceed(t, stub.invokeAs(user, "acme", "searchPerson", personArg(testHash, "")))
+	}
+
+	reads := stub.privateReads
+	page := getSearchPage(t, stub, `{"hash":"`+testHash+`","pageSize":2}`)
+	if page.Total != 5 || len(page.Records) != 2 || page.Records[0].User != "u5" || page.Records[1].User != "u4" {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	//only the details of the page are read
+	if reads = stub.privateReads - reads; reads != 2 {
+		t.Errorf("expected 2 private reads for the page, got %d", reads)
+	}
+	//records appended between calls do not shift the next page
+	mustSucceed(t, stub.invokeAs("u6", "acme", "searchPerson", personArg(testHash, "")))
+	//later pages read the keys of the page only and keep the total of the first
+	reads = stub.pagedReads
+	page = getSearchPage(t, stub, `{"hash":"`+testHash+`","pageSize":2,"bookmark":"`+page.Bookmark+`"}`)
+	if page.Total != 5 || len(page.Records) != 2 || page.Records[0].User != "u3" || page.Records[1].User != "u2" {
+		t.Fatalf("unexpected second page %+v", page)
+	}
+	if reads = stub.pagedReads - reads; reads != 2 {
+		t.Errorf("expected 2 keys read for the page, got %d", reads)
+	}
+	page = getSearchPage(t, stub, `{"hash":"`+testHash+`","pageSize":2,"bookmark":"`+page.Bookmark+`"}`)
+	if len(page.Records) != 1 || page.Records[0].User != "u1" || page.Bookmark != "" {
+		t.Fatalf("unexpected last page %+v", page)
+	}
+
+	page = getSearchPage(t, stub, `{"hash":"`+testHash+`","order":"oldest","pageSize":4}`)
+	if len(page.Records) != 4 || page.Records[0].User != "u1" || page.Records[3].User != "u4" || page.Bookmark == "" {
+		t.Fatalf("unexpected oldest first page %+v", page)
+	}
+	page = getSearchPage(t, stub, `{"hash":"`+testHash+`","order":"oldest","pageSize":4,"bookmark":"`+page.Bookmark+`"}`)
+	if len(page.Records) != 2 || page.Records[0].User != "u5" || page.Records[1].User != "u6" || page.Bookmark != "" {
+		t.Fatalf("unexpected oldest last page %+v", page)
+	}
+
+	//pages run over legacy arrays not yet migrated, which hold older records
+	stub.seed(personSearchPrfx+testHash, []byte(`[{"company":"acme","user":"l2","date":"2016-01-02T00:00:00Z"},{"company":"acme","user":"l1","date":"2016-01-01T00:00:00Z"}]`))
+	var users []string
+	bookmark := ""
+	for {
+		page = getSearchPage(t, stub, `{"hash":"`+testHash+`","order":"oldest","pageSize":3,"bookmark":"`+bookmark+`"}`)
+		for _, record := range page.Records {
+			users = append(users, record.User)
+		}
+		if bookmark = page.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	if expected := []string{"l1", "l2", "u1", "u2", "u3", "u4", "u5", "u6"}; !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected oldest first %v, got %v", expected, users)
+	}
+	users = nil
+	for {
+		page = getSearchPage(t, stub, `{"hash":"`+testHash+`","pageSize":5,"bookmark":"`+bookmark+`"}`)
+		for _, record := range page.Records {
+			users = append(users, record.User)
+		}
+		if bookmark = page.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	if expected := []string{"u6", "u5", "u4", "u3", "u2", "u1", "l2", "l1"}; !reflect.DeepEqual(users, expected) {
+		t.Errorf("expected newest first %v, got %v", expected, users)
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches", `{"hash":"`+testHash+`","bookmark":"legacy:2"}`), "invalid bookmark")
+
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches", `{"hash":"`+testHash+`","pageSize":0}`), "pageSize must be at least 1")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches", `{"hash":"`+testHash+`","order":"random"}`), "order must be")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches", `{"hash":"`+testHash+`","bookmark":"99"}`), "invalid bookmark")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches", `{"hash":"`+testHash+`","pageSize":"2"}`), "pageSize must be an integer")
+}
+
+func TestGetPersonHistoryPaging(t *testing.T) {
+	stub := newInsuranceStub(t)
+	if page := getSearchPage(t, stub, `{"hash":"`+testHash+`","pageSize":10}`); page.Total != 0 || page.Bookmark != "" {
+		t.Errorf("unexpected empty page %+v", page)
+	}
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "banned")))
+
+	var page struct {
+		Records  []Action `json:"records"`
+		Bookmark string   `json:"bookmark"`
+		Total    int      `json:"total"`
+	}
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", `{"hash":"`+testHash+`","order":"oldest"}`))
+	if err := json.Unmarshal(payload, &page); err != nil {
+		t.Fatalf("cannot unmarshal page %q: %s", payload, err)
+	}
+	if len(page.Records) != 2 || page.Records[0].Method != ACTION_INSERT || page.Bookmark != "" || page.Total != 2 {
+		t.Errorf("unexpected history page %+v", page)
+	}
+
+	//entries stored before the newest first list are listed by the migration
+	forgedKey, _ := stub.CreateCompositeKey(personHistoryObj, []string{testHash, "2016-01-01T00:00:00.000000000Z", "unlisted"})
+	stub.seed(forgedKey, []byte(`{"method":"create","user":"old","date":"2016-01-01T00:00:00Z"}`))
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "migratePersonHistory", hashArg(testHash)))
+	payload = mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", `{"hash":"`+testHash+`","pageSize":2}`))
+	page.Records = nil
+	if err := json.Unmarshal(payload, &page); err != nil {
+		t.Fatalf("cannot unmarshal page %q: %s", payload, err)
+	}
+	if len(page.Records) != 2 || page.Records[0].Method != ACTION_UPDATE || page.Total != 3 || page.Bookmark == "" {
+		t.Fatalf("unexpected newest history page %+v", page)
+	}
+	payload = mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", `{"hash":"`+testHash+`","pageSize":2,"bookmark":"`+page.Bookmark+`"}`))
+	page.Records = nil
+	if err := json.Unmarshal(payload, &page); err != nil {
+		t.Fatalf("cannot unmarshal page %q: %s", payload, err)
+	}
+	if len(page.Records) != 1 || page.Records[0].User != "old" || page.Total != 3 || page.Bookmark != "" {
+		t.Errorf("unexpected last history page %+v", page)
+	}
+}
+
+func TestGetPersonInfoUnknown(t *testing.T) {
+	stub := newInsuranceStub(t)
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", hashArg(unknownHash)))
+	if len(payload) != 0 {
+		t.Errorf("expected empty payload, got %q", payload)
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", `{}`), "hash is missing")
+}
+
+func TestGetPersonHistoryAndSearchesUnknown(t *testing.T) {
+	stub := newInsuranceStub(t)
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", hashArg(unknownHash))); len(payload) != 0 {
+		t.Errorf("expected empty history, got %q", payload)
+	}
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches", hashArg(unknownHash))); len(payload) != 0 {
+		t.Errorf("expected empty searches, got %q", payload)
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", `[]`), "arg is not a map shape")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonSearches"), "Expecting one JSON event object")
+}
+
+//returns versions of getPersonHistoryIter called with arg
+func getVersions(t *testing.T, stub *testStub, arg string) []PersonVersion {
+	t.Helper()
+	var versions []PersonVersion
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistoryIter", arg))
+	if err := json.Unmarshal(payload, &versions); err != nil {
+		t.Fatalf("cannot unmarshal history %q: %s", payload, err)
+	}
+	return versions
+}
+
+func TestGetPersonHistoryIter(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "banned")))
+	//failed transactions leave no trace in the history
+	mustFail(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`"}`), "nothing to update")
+
+	versions := getVersions(t, stub, hashArg(testHash))
+	if len(versions) != 2 {
+		t.Fatalf("expected 2 versions, got %+v", versions)
+	}
+	first, second := versions[0], versions[1]
+	if first.TxID == "" || first.TxID == second.TxID || first.IsDelete || first.Person == nil || first.Person.Status != STATUS_OK {
+		t.Errorf("unexpected first version %+v", first)
+	}
+	if second.Person == nil || second.Person.Status != STATUS_SUSP || !second.Timestamp.After(first.Timestamp) || first.Changes != nil {
+		t.Errorf("unexpected second version %+v", second)
+	}
+	//timestamps are RFC 3339
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistoryIter", hashArg(testHash)))
+	if !strings.Contains(string(payload), `"timestamp":"`+first.Timestamp.Format(time.RFC3339Nano)+`"`) {
+		t.Errorf("unexpected timestamp in %s", payload)
+	}
+	if versions := getVersions(t, stub, hashArg(otherHash)); versions == nil || len(versions) != 0 {
+		t.Errorf("expected empty history, got %+v", versions)
+	}
+}
+
+func TestGetPersonHistoryIterDiff(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"`+testHash+`","status":"trusted","notes":"first"}`))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", `{"hash":"`+testHash+`","status":"banned","riskScore":0.5}`))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "deletePerson", hashArg(testHash)))
+
+	versions := getVersions(t, stub, `{"hash":"`+testHash+`","diff":true}`)
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %+v", versions)
+	}
+	fields := func(changes []FieldChange) []string {
+		var names []string
+		for _, change := range changes {
+			names = append(names, change.Field)
+		}
+		return names
+	}
+	if names := fields(versions[0].Changes); !reflect.DeepEqual(names, []string{"status", "notes"}) || versions[0].Changes[1].New != "first" {
+		t.Errorf("unexpected changes of insert %+v", versions[0].Changes)
+	}
+	if names := fields(versions[1].Changes); !reflect.DeepEqual(names, []string{"status", "riskScore"}) || versions[1].Changes[0].Old != string(STATUS_OK) {
+		t.Errorf("unexpected changes of update %+v", versions[1].Changes)
+	}
+	//a tombstone keeps the fields
+	if versions[2].IsDelete || versions[2].Person == nil || versions[2].Person.Deleted == nil || len(versions[2].Changes) != 0 {
+		t.Errorf("unexpected delete %+v", versions[2])
+	}
+	if versions := getVersions(t, stub, hashArg(testHash)); versions[1].Changes != nil {
+		t.Errorf("changes without diff %+v", versions[1].Changes)
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistoryIter", `{"hash":"`+testHash+`","diff":"yes"}`), "diff")
+
+	//versions before a purge are not served, the history starts with its delete
+	inserted := versions[0].Timestamp
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "purgePerson", `{"hash":"`+testHash+`","reason":"erasure request"}`))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "insertPerson", personArg(testHash, "trusted")))
+	versions = getVersions(t, stub, `{"hash":"`+testHash+`","diff":true}`)
+	if len(versions) != 2 || !versions[0].IsDelete || versions[0].Person != nil || len(versions[0].Changes) != 0 {
+		t.Fatalf("unexpected versions after purge %+v", versions)
+	}
+	if names := fields(versions[1].Changes); versions[1].Person == nil || versions[1].Person.Notes != "" || !reflect.DeepEqual(names, []string{"status"}) {
+		t.Errorf("insert after purge must not be compared to purged versions %+v", versions[1])
+	}
+	if result := getAsOf(t, stub, testHash, inserted); result.Person != nil || result.Transaction != nil {
+		t.Errorf("purged person served as of %s: %+v", inserted, result)
+	}
+	stub.noHistory = true
+	if result := getAsOf(t, stub, testHash, inserted); result.Person != nil || result.Transaction != nil {
+		t.Errorf("purged person served from actions as of %s: %+v", inserted, result)
+	}
+}
+
+func TestGetPersonHistoryIterPaging(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	for _, status := range []string{"banned", "wrong-data"} {
+		mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, status)))
+	}
+
+	var page struct {
+		Records  []PersonVersion `json:"records"`
+		Bookmark string          `json:"bookmark"`
+		Total    int             `json:"total"`
+	}
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistoryIter", `{"hash":"`+testHash+`","pageSize":1,"diff":true}`))
+	if err := json.Unmarshal(payload, &page); err != nil {
+		t.Fatalf("cannot unmarshal page %q: %s", payload, err)
+	}
+	if page.Total != 3 || len(page.Records) != 1 || page.Records[0].Person.Status != STATUS_WRONG_DATA || page.Bookmark != "1" {
+		t.Errorf("unexpected history page %+v", page)
+	}
+	//changes are taken against the version before, not the one before on the page
+	if changes := page.Records[0].Changes; len(changes) != 1 || changes[0].Old != string(STATUS_SUSP) {
+		t.Errorf("unexpected changes %+v", changes)
+	}
+}
+
+func TestGetPersonHistoryIterSimulated(t *testing.T) {
+	stub := newInsuranceStub(t)
+	stub.addHistory(personPrfx+testHash, &queryresult.KeyModification{
+		TxId:      "old1",
+		Value:     []byte(`{"hash":"` + testHash + `","status":"trusted"}`),
+		Timestamp: &timestamp.Timestamp{Seconds: 1400000000},
+	})
+	stub.addHistory(personPrfx+testHash, &queryresult.KeyModification{
+		TxId:      "old2",
+		Timestamp: &timestamp.Timestamp{Seconds: 1400000100},
+		IsDelete:  true,
+	})
+
+	//deletes carry no person
+	versions := getVersions(t, stub, hashArg(testHash))
+	if len(versions) != 2 || versions[0].TxID != "old1" || versions[0].Person.Status != STATUS_OK || !versions[0].Timestamp.Equal(time.Unix(1400000000, 0)) {
+		t.Errorf("unexpected versions %+v", versions)
+	}
+	if !versions[1].IsDelete || versions[1].Person != nil || versions[1].TxID != "old2" {
+		t.Errorf("unexpected delete %+v", versions[1])
+	}
+	stub.addHistory(personPrfx+otherHash, &queryresult.KeyModification{TxId: "bad", Value: []byte("{"), Timestamp: &timestamp.Timestamp{Seconds: 1400000000}})
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistoryIter", hashArg(otherHash)), "Error unmarshalling person "+otherHash+" of transaction bad")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistoryIter", `{}`), "hash is missing")
+}
+
+func TestSetLoggingLevel(t *testing.T) {
+	stub := newInsuranceStub(t)
+	for _, level := range []string{"DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "CRITICAL"} {
+		mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{"logLevel":"`+level+`"}`))
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{"logLevel":"VERBOSE"}`), "logLevel must be one of")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{`), "failed to unmarshal arg")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setLoggingLevel"), "Expecting one JSON event object")
+	logger.SetLevel(shim.LogDebug)
+}
+
+//returns arg of maintenance functions, value is left out when empty
+func maintenanceArg(key string, value string) string {
+	arg := map[string]string{"key": key, "reason": "ticket 42"}
+	if value != "" {
+		arg["value"] = value
+	}
+	b, _ := json.Marshal(arg)
+	return string(b)
+}
+
+func TestMaintenance(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "write", "key1", "value1"), "unknown function")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "read", "key1"), "unknown function")
+
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg("key1", "value1")))
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "maintenanceRead", maintenanceArg("key1", ""))); string(payload) != "value1" {
+		t.Errorf("expected value1, got %q", payload)
+	}
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "maintenanceDelete", maintenanceArg("key1", "")))
+	if _, found := stub.State["key1"]; found {
+		t.Errorf("key1 must be deleted")
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", `{"key":"key1","value":"v"}`), "reason is missing")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", `{"key":"key1","reason":"ticket 42"}`), "value is missing")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg("", "v")), "key is missing")
+	mustFail(t, stub.invokeAs("alice", "acme", "maintenanceRead", maintenanceArg("key1", "")), "access denied")
+
+	//person data needs repair mode
+	historyKey, _ := stub.CreateCompositeKey(personHistoryObj, []string{testHash, "2017", "forged"})
+	roleKey, _ := stub.CreateCompositeKey(roleObj, []string{"acme", "mallory"})
+	for _, key := range []string{personPrfx + testHash, personHistoryPrfx + testHash, personSearchPrfx + testHash, historyKey} {
+		mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg(key, "{}")), "only in repair mode")
+		mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceDelete", maintenanceArg(key, "")), "only in repair mode")
+	}
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "setRepairMode", `{"enabled":true,"reason":"fix ticket 42"}`))
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg(personPrfx+testHash, `{"hash":"`+testHash+`","status":"banned"}`)))
+	if person := getPerson(t, stub, testHash); person.Status != "banned" {
+		t.Errorf("expected repaired status banned, got %q", person.Status)
+	}
+	//access control and maintenance keys are never writable
+	for _, key := range []string{roleKey, repairModeKey} {
+		mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg(key, "{}")), "can not be changed")
+	}
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "setRepairMode", `{"enabled":false,"reason":"done"}`))
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg(personPrfx+testHash, "{}")), "only in repair mode")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setRepairMode", `{"reason":"x"}`), "enabled is missing")
+
+	//every successful use is recorded, newest first
+	var log []MaintenanceRecord
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getMaintenanceLog", "{}"))
+	if err := json.Unmarshal(payload, &log); err != nil {
+		t.Fatalf("cannot unmarshal maintenance log %q: %s", payload, err)
+	}
+	methods := []string{MAINTENANCE_REPAIR_MODE, MAINTENANCE_WRITE, MAINTENANCE_REPAIR_MODE, MAINTENANCE_DELETE, MAINTENANCE_READ, MAINTENANCE_WRITE}
+	if len(log) != len(methods) {
+		t.Fatalf("expected %d maintenance records, got %+v", len(methods), log)
+	}
+	for i, method := range methods {
+		if log[i].Method != method || log[i].User != adminUser || log[i].Company != adminCompany || log[i].TxID == "" {
+			t.Errorf("unexpected maintenance record %d: %+v", i, log[i])
+		}
+	}
+	if !log[1].Repair || log[1].Key != personPrfx+testHash || log[1].Reason != "ticket 42" {
+		t.Errorf("unexpected repair record %+v", log[1])
+	}
+}
+
+func TestUnknownFunction(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "noSuchFunction"), "unknown function")
+}
+
+func TestDeleteAndRestorePerson(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustFail(t, stub.invokeAs("alice", "acme", "deletePerson", hashArg(testHash)), ERR_PERSON_NOT_FOUND)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "banned")))
+	mustFail(t, stub.invokeAs("alice", "acme", "restorePerson", hashArg(testHash)), ERR_PERSON_NOT_DELETED)
+	//only the company that created the person and admins may delete or restore it
+	mustFail(t, stub.invokeAs("carol", "initech", "deletePerson", `{"hash":"`+testHash+`","reason":"duplicate"}`), ERR_ACCESS_DENIED)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "deletePerson", `{"hash":"`+testHash+`","reason":"duplicate"}`))
+	mustFail(t, stub.invokeAs("alice", "acme", "deletePerson", hashArg(testHash)), ERR_PERSON_DELETED)
+	mustFail(t, stub.invokeAs("carol", "initech", "restorePerson", hashArg(testHash)), ERR_ACCESS_DENIED)
+
+	//deleted person is hidden unless asked for
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", hashArg(testHash))); payload != nil {
+		t.Errorf("deleted person returned: %s", payload)
+	}
+	var person Person
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", `{"hash":"`+testHash+`","includeDeleted":true}`))
+	if err := json.Unmarshal(payload, &person); err != nil || person.Deleted == nil || person.Deleted.User != "alice" || person.Deleted.Reason != "duplicate" {
+		t.Errorf("unexpected deleted person %s", payload)
+	}
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", `{"hash":"`+testHash+`","includeDeleted":"yes"}`), "includeDeleted must be a boolean")
+
+	//deleted person can not be changed and searches do not see it
+	mustFail(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, "trusted")), ERR_PERSON_DELETED)
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")), ERR_PERSON_EXISTS)
+	var res SearchResult
+	payload = mustSucceed(t, stub.invokeAs("alice", "acme", "searchPersonAndReturn", hashArg(testHash)))
+	if err := json.Unmarshal(payload, &res); err != nil || res.Status != STATUS_NOT_FOUND {
+		t.Errorf("unexpected search result %s", payload)
+	}
+
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "restorePerson", hashArg(testHash)))
+	if person := getPerson(t, stub, testHash); person.Deleted != nil || person.Status != STATUS_SUSP {
+		t.Errorf("unexpected restored person %+v", person)
+	}
+	history := getHistory(t, stub, testHash)
+	if len(history) != 3 || history[0].Method != ACTION_RESTORE || history[1].Method != ACTION_DELETE || history[1].User != "alice" || history[0].User != adminUser {
+		t.Errorf("unexpected history %+v", history)
+	}
+}
+
+func TestPurgePerson(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(testHash)))
+	mustSucceed(t, stub.invokeAs("carol", "initech", "searchPerson", hashArg(testHash)))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(otherHash, "trusted")))
+	//details searches used to write to the collection of a company that lost
+	//its insurer role since go as well
+	legacyCollection := companySearchCollection("initech")
+	stub.PvtState[legacyCollection] = make(map[string][]byte)
+	for key, value := range stub.PvtState[regulatorSearchCollection] {
+		if strings.Contains(string(value), `"carol"`) {
+			stub.PvtState[legacyCollection][key] = value
+		}
+	}
+	collectionKey, _ := stub.CreateCompositeKey(searchCollectionObj, []string{legacyCollection})
+	stub.seed(collectionKey, indexValue)
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "revokeRole", roleArg("carol", "initech", ROLE_INSURER)))
+	//legacy arrays go as well
+	stub.seed(personSearchPrfx+testHash, []byte(`[{"company":"acme","user":"alice","date":"2016-01-01T00:00:00Z","status":"trusted"}]`))
+
+	mustFail(t, stub.invokeAs("alice", "acme", "purgePerson", `{"hash":"`+testHash+`","reason":"erasure request"}`), "access denied")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "purgePerson", hashArg(testHash)), "reason is missing")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "purgePerson", `{"hash":"`+unknownHash+`","reason":"erasure request"}`), ERR_PERSON_NOT_FOUND)
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "purgePerson", `{"hash":"`+testHash+`","reason":"erasure request"}`))
+
+	for key := range stub.State {
+		if strings.Contains(key, testHash) {
+			t.Errorf("purged person left key %q", key)
+		}
+	}
+	if len(stub.PvtState[legacyCollection]) != 0 {
+		t.Errorf("purged person left search details in %s", legacyCollection)
+	}
+	for collection, values := range stub.PvtState {
+		for key := range values {
+			if strings.HasPrefix(key, compositeKeyNamespace+privateSearchObj) {
+				t.Errorf("purged person left search detail %q in %s", key, collection)
+			}
+		}
+	}
+	if person := getPerson(t, stub, otherHash); person.Status != STATUS_OK {
+		t.Errorf("purge touched other person %+v", person)
+	}
+	var log []MaintenanceRecord
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getMaintenanceLog", "{}"))
+	if err := json.Unmarshal(payload, &log); err != nil || len(log) != 1 || log[0].Method != MAINTENANCE_PURGE || log[0].Key != personPrfx+testHash {
+		t.Errorf("unexpected maintenance log %s", payload)
+	}
+}
+
+//lastEvent returns name and payload of the event of the last successful transaction
+func lastEvent(t *testing.T, stub *testStub) (string, PersonEvent) {
+	t.Helper()
+	var event PersonEvent
+	if len(stub.events) == 0 {
+		t.Fatalf("no event emitted")
+	}
+	last := stub.events[len(stub.events)-1]
+	if err := json.Unmarshal(last.Payload, &event); err != nil {
+		t.Fatalf("cannot unmarshal event %q: %s", last.Payload, err)
+	}
+	return last.EventName, event
+}
+
+func TestPersonEvents(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "searchPerson", hashArg(testHash)))
+	name, event := lastEvent(t, stub)
+	if name != "PersonSearched" || event.OldStatus != "" || event.NewStatus != STATUS_NOT_FOUND || event.Action != ACTION_SEARCH ||
+		event.Company != "" || event.User != "" {
+		t.Errorf("unexpected event %s %+v", name, event)
+	}
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(testHash, "banned")))
+	name, event = lastEvent(t, stub)
+	if name != "PersonUpdated" || event.OldStatus != STATUS_NOT_FOUND || event.NewStatus != STATUS_SUSP ||
+		event.Company != "globex" || event.Hash != testHash || event.TxID != fmt.Sprintf("tx%d", stub.txSeq) {
+		t.Errorf("unexpected event %s %+v", name, event)
+	}
+	//status kept when other fields change
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`","notes":"x"}`))
+	if _, event = lastEvent(t, stub); event.OldStatus != STATUS_SUSP || event.NewStatus != STATUS_SUSP {
+		t.Errorf("unexpected event %+v", event)
+	}
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(otherHash, "trusted")))
+	if name, event = lastEvent(t, stub); name != "PersonCreated" || event.OldStatus != "" || event.NewStatus != STATUS_OK {
+		t.Errorf("unexpected event %s %+v", name, event)
+	}
+	mustSucceed(t, stub.invokeAs("alice", "acme", "searchPersonAndReturn", hashArg(otherHash)))
+	if name, event = lastEvent(t, stub); name != "PersonSearched" || event.OldStatus != STATUS_OK || event.User != "" || event.Company != "" {
+		t.Errorf("unexpected event %s %+v", name, event)
+	}
+	//failed transactions emit nothing
+	count := len(stub.events)
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(otherHash, "trusted")), ERR_PERSON_EXISTS)
+	if len(stub.events) != count {
+		t.Errorf("failed transaction emitted event")
+	}
+
+	//names are configurable, empty name turns the event off
+	mustFail(t, stub.invokeAs("alice", "acme", "setEventNames", `{"update":"x"}`), "access denied")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setEventNames", `{"merge":"x"}`), "merge is not a known field")
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "setEventNames", `{"update":"insurance.person.updated","search":""}`))
+	names := map[string]string{}
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getEventNames", "{}"))
+	if err := json.Unmarshal(payload, &names); err != nil || names[ACTION_INSERT] != "PersonCreated" || names[ACTION_UPDATE] != "insurance.person.updated" {
+		t.Errorf("unexpected event names %s", payload)
+	}
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(otherHash, "banned")))
+	if name, _ = lastEvent(t, stub); name != "insurance.person.updated" {
+		t.Errorf("unexpected event name %s", name)
+	}
+	count = len(stub.events)
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(otherHash)))
+	if len(stub.events) != count {
+		t.Errorf("disabled search event emitted")
+	}
+}
+
+func getBatchResult(t *testing.T, data []byte) BatchResult {
+	t.Helper()
+	var result BatchResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatalf("cannot unmarshal batch result %q: %s", data, err)
+	}
+	return result
+}
+
+func TestBatchInsertAndUpdate(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(0), "trusted")))
+	batch := `{"persons":[{"hash":"`+hashN(1)+`","status":"trusted"},{"hash":"`+hashN(2)+`","status":"banned","notes":"x"}]}`
+	result := getBatchResult(t, mustSucceed(t, stub.invokeAs("alice", "acme", "batchInsertPersons", batch)))
+	if !result.Committed || result.Mode != BATCH_ALL_OR_NOTHING || result.Succeeded != 2 || result.Failed != 0 {
+		t.Errorf("unexpected batch result %+v", result)
+	}
+	if person := getPerson(t, stub, hashN(2)); person.Status != STATUS_SUSP || person.Notes != "x" {
+		t.Errorf("unexpected person %+v", person)
+	}
+	if history := getHistory(t, stub, hashN(1)); len(history) != 1 || history[0].User != "alice" {
+		t.Errorf("unexpected history %+v", history)
+	}
+	//one event for the whole batch
+	last := stub.events[len(stub.events)-1]
+	var event BatchEvent
+	if err := json.Unmarshal(last.Payload, &event); err != nil || last.EventName != "PersonBatch" || len(event.Events) != 2 || event.Events[1].Name != "PersonCreated" {
+		t.Errorf("unexpected batch event %s %s", last.EventName, last.Payload)
+	}
+
+	//all or nothing: one bad item fails the transaction and reports every item
+	batch = `{"persons":[{"hash":"`+hashN(3)+`","status":"trusted"},{"hash":"`+hashN(0)+`","status":"trusted"},{"status":"trusted"},{"hash":"`+hashN(3)+`","status":"banned"}]}`
+	res := stub.invokeAs("alice", "acme", "batchInsertPersons", batch)
+	mustFail(t, res, ERR_PERSON_EXISTS)
+	var batchErr struct {
+		Code    string          `json:"code"`
+		Details json.RawMessage `json:"details"`
+	}
+	if err := json.Unmarshal([]byte(res.Message), &batchErr); err != nil || batchErr.Code != ERR_BATCH_FAILED {
+		t.Fatalf("unexpected batch error %q", res.Message)
+	}
+	result = getBatchResult(t, batchErr.Details)
+	if result.Committed || result.Succeeded != 1 || result.Failed != 3 || !result.Items[0].OK {
+		t.Errorf("unexpected batch result %+v", result)
+	}
+	if !strings.Contains(string(result.Items[2].Error), "hash is missing") || !strings.Contains(string(result.Items[3].Error), ERR_DUPLICATE_HASH) {
+		t.Errorf("unexpected item errors %+v", result.Items)
+	}
+	//writes of the item that succeeded are rolled back with the transaction
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", hashArg(hashN(3)))); len(payload) != 0 {
+		t.Errorf("person of failed batch kept: %s", payload)
+	}
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", hashArg(hashN(3)))); len(payload) != 0 {
+		t.Errorf("history of failed batch kept: %s", payload)
+	}
+
+	//best effort keeps what succeeded
+	batch = `{"mode":"bestEffort","persons":[{"hash":"`+hashN(1)+`","status":"banned"},{"hash":"`+hashN(9)+`","status":"banned"}]}`
+	result = getBatchResult(t, mustSucceed(t, stub.invokeAs("bob", "globex", "batchUpdatePersons", batch)))
+	if !result.Committed || result.Succeeded != 1 || result.Failed != 1 || result.Items[1].Hash != hashN(9) || !strings.Contains(string(result.Items[1].Error), ERR_PERSON_NOT_FOUND) {
+		t.Errorf("unexpected batch result %+v", result)
+	}
+	if person := getPerson(t, stub, hashN(1)); person.Status != STATUS_SUSP {
+		t.Errorf("best effort update not kept: %+v", person)
+	}
+
+	//malformed items and items without hash fail on their own
+	batch = `{"mode":"bestEffort","persons":[[1],{"hash":5},{"status":"trusted"},{"status":"trusted"},{"hash":"`+hashN(4)+`","status":"trusted"}]}`
+	result = getBatchResult(t, mustSucceed(t, stub.invokeAs("alice", "acme", "batchInsertPersons", batch)))
+	if result.Succeeded != 1 || !result.Items[4].OK {
+		t.Errorf("unexpected batch result %+v", result)
+	}
+	for i, msg := range []string{"failed to unmarshal batch item", "failed to unmarshal batch item", "hash is missing", "hash is missing"} {
+		if !strings.Contains(string(result.Items[i].Error), msg) {
+			t.Errorf("unexpected error of item %d: %s", i, result.Items[i].Error)
+		}
+	}
+
+	mustFail(t, stub.invokeAs("alice", "acme", "batchInsertPersons", `{"persons":[]}`), "persons is missing")
+	mustFail(t, stub.invokeAs("alice", "acme", "batchInsertPersons", `{"mode":"some","persons":[{}]}`), "mode must be")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "batchInsertPersons", batch), "access denied")
+}
+
+//chaincode whose batch items write state and events, then fail when their
+//hash is in failing
+type partialWriteChaincode struct {
+	failing map[string]bool
+}
+
+func (cc *partialWriteChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	return shim.Success(nil)
+}
+
+func (cc *partialWriteChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+	return new(SimpleChaincode).runBatch(stub, args, func(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+		var req PersonInfoRequest
+		if err := decodeRequest(args, &req); err != nil {
+			return errorResponse(err)
+		}
+		stub.PutState("written"+req.Hash, []byte(req.Hash))
+		stub.PutPrivateData("collection", "written"+req.Hash, []byte(req.Hash))
+		stub.SetEvent("Written", []byte(`"`+req.Hash+`"`))
+		if cc.failing[req.Hash] {
+			return errorResponse(&PersonError{Code: ERR_INVALID_FIELD, Message: "failed after writing", Field: "hash", Hash: req.Hash})
+		}
+		return shim.Success(nil)
+	})
+}
+
+func TestBatchBestEffortDropsFailedItems(t *testing.T) {
+	stub := newTestStub(&partialWriteChaincode{failing: map[string]bool{hashN(2): true}})
+	batch := `{"mode":"bestEffort","persons":[{"hash":"` + hashN(1) + `"},{"hash":"` + hashN(2) + `"},{"hash":"` + hashN(3) + `"}]}`
+	result := getBatchResult(t, mustSucceed(t, stub.invoke("batch", batch)))
+	if !result.Committed || result.Succeeded != 2 || result.Failed != 1 {
+		t.Errorf("unexpected batch result %+v", result)
+	}
+	for i, kept := range []bool{false, true, false, true} {
+		key := "written" + hashN(i)
+		if (len(stub.State[key]) != 0) != kept || (len(stub.PvtState["collection"][key]) != 0) != kept {
+			t.Errorf("unexpected writes of %s: kept %v", hashN(i), !kept)
+		}
+	}
+	var event BatchEvent
+	last := stub.events[len(stub.events)-1]
+	if err := json.Unmarshal(last.Payload, &event); err != nil || len(event.Events) != 2 || string(event.Events[1].Payload) != `"`+hashN(3)+`"` {
+		t.Errorf("unexpected batch event %s", last.Payload)
+	}
+}
+
+func TestBatchSearchPersons(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(1), "banned")))
+	batch := `{"persons":[{"hash":"`+hashN(1)+`"},{"hash":"`+hashN(2)+`"}]}`
+	result := getBatchResult(t, mustSucceed(t, stub.invokeAs("bob", "globex", "batchSearchPersons", batch)))
+	var found, created SearchResult
+	if err := json.Unmarshal(result.Items[0].Payload, &found); err != nil || found.Status != STATUS_SUSP {
+		t.Errorf("unexpected search result %s", result.Items[0].Payload)
+	}
+	if err := json.Unmarshal(result.Items[1].Payload, &created); err != nil || created.Status != STATUS_NOT_FOUND {
+		t.Errorf("unexpected search result %s", result.Items[1].Payload)
+	}
+	if searches := getSearches(t, stub, hashN(2)); len(searches) != 1 || searches[0].User != "bob" {
+		t.Errorf("unexpected searches %+v", searches)
+	}
+}
+
+//getError returns error of failed response
+func getError(t *testing.T, res pb.Response) ChaincodeError {
+	t.Helper()
+	var chaincodeErr ChaincodeError
+	if res.Status == shim.OK {
+		t.Fatalf("expected failure, got success")
+	}
+	if err := json.Unmarshal([]byte(res.Message), &chaincodeErr); err != nil {
+		t.Fatalf("cannot unmarshal error %q: %s", res.Message, err)
+	}
+	return chaincodeErr
+}
+
+//returns the invalid fields of a failed validation
+func getFieldErrors(t *testing.T, res pb.Response) []FieldError {
+	t.Helper()
+	var validationErr struct {
+		Code    string       `json:"code"`
+		Details []FieldError `json:"details"`
+	}
+	if res.Status == shim.OK {
+		t.Fatalf("expected failure, got success")
+	}
+	if err := json.Unmarshal([]byte(res.Message), &validationErr); err != nil || validationErr.Code != ERR_VALIDATION_FAILED {
+		t.Fatalf("expected validation error, got %q", res.Message)
+	}
+	return validationErr.Details
+}
+
+func TestErrorResponses(t *testing.T) {
+	stub := newInsuranceStub(t)
+	tests := []struct {
+		res   pb.Response
+		code  string
+		field string
+		cause bool
+	}{
+		{stub.invokeAs("alice", "acme", "insertPerson", `{"hash":`), ERR_INVALID_ARGUMENT, "", true},
+		{stub.invokeAs("alice", "acme", "insertPerson", `[]`), ERR_INVALID_ARGUMENT, "", false},
+		{stub.invokeAs("alice", "acme", "insertPerson", `{"status":"trusted"}`), ERR_VALIDATION_FAILED, "hash", false},
+		{stub.invokeAs("alice", "acme", "insertPerson", `{"hash":7,"status":"trusted"}`), ERR_VALIDATION_FAILED, "hash", false},
+		{stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"`+hashN(1)+`","status":"trusted","user":"eve"}`), ERR_CALLER_MISMATCH, "user", false},
+		{stub.invokeAs("alice", "acme", "updatePerson", `{"hash":"`+hashN(1)+`","riskScore":"high"}`), ERR_VALIDATION_FAILED, "riskScore", false},
+		{stub.invokeAs("alice", "acme", "getPersonHistory", `{"hash":"`+hashN(1)+`","pageSize":0}`), ERR_VALIDATION_FAILED, "pageSize", false},
+		{stub.invokeAs("alice", "acme", "grantRole", roleArg("eve", "acme", ROLE_ADMIN)), ERR_ACCESS_DENIED, "", false},
+		{stub.invokeAs(adminUser, adminCompany, "grantRole", roleArg("eve", "acme", "root")), ERR_VALIDATION_FAILED, "role", false},
+		{stub.invokeAs(adminUser, adminCompany, "maintenanceWrite", maintenanceArg(personPrfx+hashN(1), "{}")), ERR_REPAIR_MODE_REQUIRED, "key", false},
+		{stub.invokeAs(adminUser, adminCompany, "setLoggingLevel", `{"logLevel":"LOUD"}`), ERR_VALIDATION_FAILED, "logLevel", false},
+		{stub.invokeAs(adminUser, adminCompany, "noSuchFunction"), ERR_UNKNOWN_FUNCTION, "", false},
+	}
+	for i, test := range tests {
+		chaincodeErr := getError(t, test.res)
+		if chaincodeErr.Code != test.code || chaincodeErr.Field != test.field || (chaincodeErr.Cause != "") != test.cause {
+			t.Errorf("case %d: expected code %s field %q, got %q", i, test.code, test.field, test.res.Message)
+		}
+	}
+	//errors without a code of their own are internal
+	res := errorResponse(errors.New("disk on fire"))
+	if chaincodeErr := getError(t, res); chaincodeErr.Code != ERR_INTERNAL || chaincodeErr.Message != "disk on fire" {
+		t.Errorf("unexpected internal error %q", res.Message)
+	}
+	wrapped := internalError(errors.New("disk on fire"), "Error putting person")
+	if chaincodeErr := getError(t, errorResponse(wrapped)); chaincodeErr.Code != ERR_INTERNAL || chaincodeErr.Cause != "disk on fire" {
+		t.Errorf("unexpected wrapped error %q", wrapped)
+	}
+	if personErr := (&PersonError{Code: ERR_PERSON_EXISTS}); internalError(personErr, "x") != personErr {
+		t.Errorf("error with code was wrapped")
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	stub := newInsuranceStub(t)
+	//all invalid fields are reported at once
+	res := stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"A3F1\u0001","status":"dead","policyNumbers":["P-1",""],"notes":"bell\u0007","nickname":"x"}`)
+	expected := []FieldError{
+		{Field: "nickname", Code: ERR_UNKNOWN_FIELD},
+		{Field: "hash", Code: ERR_INVALID_FIELD},
+		{Field: "status", Code: ERR_UNKNOWN_STATUS},
+		{Field: "policyNumbers[1]", Code: ERR_MISSING_FIELD},
+		{Field: "notes", Code: ERR_INVALID_FIELD},
+	}
+	errs := getFieldErrors(t, res)
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d field errors, got %q", len(expected), res.Message)
+	}
+	for i, e := range expected {
+		if errs[i].Field != e.Field || errs[i].Code != e.Code || errs[i].Message == "" {
+			t.Errorf("field error %d: expected %s %s, got %+v", i, e.Field, e.Code, errs[i])
+		}
+	}
+	if getError(t, res).Field != "nickname" {
+		t.Errorf("error field must be the first invalid field, got %q", res.Message)
+	}
+
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"`+testHash+`","status":"trusted","sourceCompany":"acme corp"}`), "sourceCompany may contain only")
+	mustFail(t, stub.invokeAs("alice", "acme", "updatePerson", `{"hash":"`+testHash+`","status":null}`), "status can not be cleared")
+	mustFail(t, stub.invokeAs("alice", "acme", "searchPerson", `{"hash":"`+strings.ToUpper(testHash)+`"}`), "hash must be a lowercase hex SHA-256")
+	mustFail(t, stub.invokeAs("alice", "acme", "searchPerson", `"`+testHash+`"`), "arg is not a map shape")
+	mustFail(t, stub.invokeAs("alice", "acme", "searchPerson", `{"hash":"`+testHash+`","user":"alice","reason":"x"}`), "reason is not a known field")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "batchInsertPersons", `{"persons":[],"mode":"fast"}`), "persons is missing; mode must be one of allOrNothing, bestEffort")
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"`+testHash+`","status":"trusted","policyNumbers":["P-1"],"notes":"line\nbreak"}`))
+}
+
+func TestCommonsPathHelpers(t *testing.T) {
+	args, err := getUnmarshalledArgument([]string{`{"person":{"hash":"h","policies":[{"number":"P-1","active":true,"count":2,"since":"2019-03-01T10:00:00Z"}]}}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number, err := getStringParamFromArgs("person.policies[0].number", args); err != nil || number != "P-1" {
+		t.Errorf("expected P-1, got %q, %v", number, err)
+	}
+	if active, err := getBool(args, "person.policies[0].active"); err != nil || !active {
+		t.Errorf("expected active, got %v", err)
+	}
+	if count, err := getInt(args, "person.policies[0].count"); err != nil || count != 2 {
+		t.Errorf("expected 2, got %d, %v", count, err)
+	}
+	if since, err := getTime(args, "person.policies[0].since"); err != nil || since.Year() != 2019 {
+		t.Errorf("expected 2019, got %v, %v", since, err)
+	}
+	if _, found := getObject(ArgsMap(args.(map[string]interface{})), "hash"); found {
+		t.Errorf("hash is nested in person, not at the root")
+	}
+	//not found and wrong type map to their error codes
+	_, err = getStringParamFromArgs("person.address.street", args)
+	if chaincodeErr := getError(t, errorResponse(err)); chaincodeErr.Code != ERR_MISSING_FIELD || chaincodeErr.Message != "person.address is missing" {
+		t.Errorf("expected missing person.address, got %v", err)
+	}
+	_, err = getStringSlice(args, "person.hash")
+	if chaincodeErr := getError(t, errorResponse(err)); chaincodeErr.Code != ERR_INVALID_FIELD || chaincodeErr.Field != "person.hash" {
+		t.Errorf("expected invalid person.hash, got %v", err)
+	}
+}
+
+//returns page of queryPersons
+func getQueryResult(t *testing.T, stub *testStub, query string) PersonQueryResult {
+	t.Helper()
+	var result PersonQueryResult
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "queryPersons", query))
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("cannot unmarshal query result %q: %s", payload, err)
+	}
+	return result
+}
+
+//returns hashes of the persons of a query result
+func queryHashes(result PersonQueryResult) []string {
+	hashes := []string{}
+	for _, person := range result.Persons {
+		hashes = append(hashes, person.Hash)
+	}
+	return hashes
+}
+
+func TestQueryPersons(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(1), "trusted")))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(2), "banned")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "insertPerson", personArg(hashN(3), "banned")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "insertPerson", personArg(hashN(4), "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "deletePerson", hashArg(hashN(4))))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(hashN(1), "banned")))
+	if person := getPerson(t, stub, hashN(1)); person.CreatedBy != "acme" || person.DocType != DOC_TYPE_PERSON {
+		t.Errorf("unexpected creator %q or docType %q", person.CreatedBy, person.DocType)
+	}
+	//CouchDB compares the fixed width modify date
+	if person := getPerson(t, stub, hashN(1)); person.ModifyKey != "2017-06-01T12:00:11.000000000Z" {
+		t.Errorf("unexpected modifyKey %q of %s", person.ModifyKey, person.ModifyDate)
+	}
+	since := getPerson(t, stub, hashN(3)).ModifyDate.Format(time.RFC3339)
+
+	//without CouchDB the indexes are used; deleted persons and stale keys are left out
+	tests := []struct {
+		query  string
+		hashes []string
+	}{
+		{`{"statuses":["banned"]}`, []string{hashN(2), hashN(3), hashN(1)}},
+		{`{"statuses":["trusted"]}`, []string{}},
+		{`{"createdBy":"acme"}`, []string{hashN(1), hashN(2)}},
+		{`{"statuses":["banned"],"modifiedFrom":"` + since + `"}`, []string{hashN(3), hashN(1)}},
+		{`{"statuses":["banned"],"modifiedTo":"` + since + `"}`, []string{hashN(2)}},
+		{`{"statuses":["trusted","banned"],"createdBy":"globex"}`, []string{hashN(3)}},
+		{`{}`, []string{hashN(2), hashN(3), hashN(1)}},
+	}
+	for _, test := range tests {
+		result := getQueryResult(t, stub, test.query)
+		if hashes := queryHashes(result); !reflect.DeepEqual(hashes, test.hashes) || result.Count != len(test.hashes) {
+			t.Errorf("%s: expected %v, got %v", test.query, test.hashes, hashes)
+		}
+	}
+
+	//the date range bounds the index keys read
+	reads := stub.pagedReads
+	if hashes := queryHashes(getQueryResult(t, stub, `{"modifiedFrom":"`+since+`"}`)); !reflect.DeepEqual(hashes, []string{hashN(3), hashN(1)}) {
+		t.Errorf("unexpected persons modified since %s: %v", since, hashes)
+	}
+	if reads = stub.pagedReads - reads; reads != 2 {
+		t.Errorf("expected 2 index keys read, got %d", reads)
+	}
+
+	page := getQueryResult(t, stub, `{"statuses":["banned"],"pageSize":2}`)
+	if page.Count != 2 || page.Bookmark == "" {
+		t.Fatalf("expected full first page, got %+v", page)
+	}
+	statusBookmark := page.Bookmark
+	page = getQueryResult(t, stub, `{"statuses":["banned"],"pageSize":2,"bookmark":"`+page.Bookmark+`"}`)
+	if hashes := queryHashes(page); !reflect.DeepEqual(hashes, []string{hashN(1)}) || page.Bookmark != "" {
+		t.Errorf("unexpected last page %+v", page)
+	}
+
+	//purge removes the index keys too
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "purgePerson", `{"hash":"`+hashN(3)+`","reason":"erasure request"}`))
+	if hashes := queryHashes(getQueryResult(t, stub, `{"statuses":["banned"]}`)); !reflect.DeepEqual(hashes, []string{hashN(2), hashN(1)}) {
+		t.Errorf("purged person still indexed: %v", hashes)
+	}
+
+	mustFail(t, stub.invokeAs("audrey", "regulator", "queryPersons", `{"modifiedFrom":"`+since+`","modifiedTo":"`+since+`"}`), "modifiedTo must be after modifiedFrom")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "queryPersons", `{"modifiedFrom":"last month"}`), "modifiedFrom must be an RFC 3339 time")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "queryPersons", `{"statuses":["dead"]}`), ERR_UNKNOWN_STATUS)
+	mustFail(t, stub.invokeAs("audrey", "regulator", "queryPersons", `{"bookmark":"%%"}`), "invalid bookmark")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "queryPersons", `{"createdBy":"acme","bookmark":"`+statusBookmark+`"}`), "invalid bookmark")
+	mustFail(t, stub.invokeAs("mallory", "acme", "queryPersons", `{}`), "access denied")
+}
+
+func TestQueryPersonsCouchDB(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(1), "banned")))
+	var query string
+	stub.richQuery = func(q string, pageSize int32, bookmark string) ([]*queryresult.KV, string) {
+		query = q
+		if pageSize != 1 || bookmark != "b1" {
+			t.Errorf("unexpected page size %d or bookmark %q", pageSize, bookmark)
+		}
+		return []*queryresult.KV{{Key: personPrfx + hashN(1), Value: stub.State[personPrfx+hashN(1)]}}, "b2"
+	}
+	result := getQueryResult(t, stub, `{"statuses":["banned"],"createdBy":"acme","modifiedFrom":"2017-06-01T00:00:00+02:00","pageSize":1,"bookmark":"b1"}`)
+	if hashes := queryHashes(result); !reflect.DeepEqual(hashes, []string{hashN(1)}) || result.Bookmark != "b2" {
+		t.Errorf("unexpected result %+v", result)
+	}
+	expected := `{"selector":{"createdBy":"acme","deleted":{"$exists":false},"docType":"person","modifyKey":{"$gte":"2017-05-31T22:00:00.000000000Z"},"status":{"$in":["banned"]}}}`
+	if query != expected {
+		t.Errorf("expected query %s, got %s", expected, query)
+	}
+}
+
+func TestPersonIndexes(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(1), "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "insertPerson", personArg(hashN(2), "trusted")))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(3), "banned")))
+	first := getPerson(t, stub, hashN(1))
+	oldKeys, _ := getPersonIndexKeys(stub, &first)
+	if len(oldKeys) != 3 {
+		t.Fatalf("expected status, company and date keys, got %q", oldKeys)
+	}
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(hashN(1), "banned")))
+	for _, key := range oldKeys[:1] {
+		if _, found := stub.State[key]; found {
+			t.Errorf("stale status key %q left after update", key)
+		}
+	}
+
+	list := func(function string, arg string) []string {
+		t.Helper()
+		var result PersonQueryResult
+		payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", function, arg))
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatalf("cannot unmarshal list %q: %s", payload, err)
+		}
+		return queryHashes(result)
+	}
+	tests := []struct {
+		function string
+		arg      string
+		hashes   []string
+	}{
+		{"listPersonsByStatus", `{"status":"banned"}`, []string{hashN(3), hashN(1)}},
+		{"listPersonsByStatus", `{"status":"trusted"}`, []string{hashN(2)}},
+		{"listPersonsByStatus", `{"status":"wrong-data"}`, []string{}},
+		{"listPersonsByCompany", `{"company":"acme"}`, []string{hashN(1), hashN(3)}},
+		{"listPersonsByCompany", `{"company":"acme","pageSize":1}`, []string{hashN(1)}},
+		{"listPersonsByCompany", `{"company":"initech"}`, []string{}},
+	}
+	for _, test := range tests {
+		if hashes := list(test.function, test.arg); !reflect.DeepEqual(hashes, test.hashes) {
+			t.Errorf("%s %s: expected %v, got %v", test.function, test.arg, test.hashes, hashes)
+		}
+	}
+	mustFail(t, stub.invokeAs("audrey", "regulator", "listPersonsByStatus", `{}`), "status is missing")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "listPersonsByCompany", `{"company":"acme corp"}`), "company may contain only")
+
+	//drift: a lost key, a stale key and a person written before the indexes
+	lostKey, _ := stub.CreateCompositeKey(personByCompanyObj, []string{"globex", hashN(2)})
+	staleKey, _ := stub.CreateCompositeKey(personByStatusObj, []string{"trusted", "2017-01-01T00:00:00.000000000Z", hashN(3)})
+	stub.MockTransactionStart("drift")
+	stub.MockStub.DelState(lostKey)
+	stub.MockStub.PutState(staleKey, indexValue)
+	stub.MockTransactionEnd("drift")
+	stub.seed(personPrfx+hashN(4), []byte(`{"hash":"`+hashN(4)+`","status":"trusted","modifyDate":"2016-01-01T00:00:00Z"}`))
+	if hashes := list("listPersonsByStatus", `{"status":"trusted"}`); !reflect.DeepEqual(hashes, []string{hashN(2)}) {
+		t.Errorf("stale key must be skipped, got %v", hashes)
+	}
+
+	mustFail(t, stub.invokeAs("alice", "acme", "rebuildPersonIndexes", `{"reason":"drift"}`), "access denied")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "rebuildPersonIndexes", `{}`), "reason is missing")
+	var result IndexRebuildResult
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "rebuildPersonIndexes", `{"reason":"drift"}`))
+	if err := json.Unmarshal(payload, &result); err != nil || result != (IndexRebuildResult{Persons: 4, Updated: 1, Added: 3, Removed: 1}) {
+		t.Errorf("unexpected rebuild result %s", payload)
+	}
+	if hashes := list("listPersonsByStatus", `{"status":"trusted"}`); !reflect.DeepEqual(hashes, []string{hashN(4), hashN(2)}) {
+		t.Errorf("expected rebuilt trusted list, got %v", hashes)
+	}
+	if hashes := list("listPersonsByCompany", `{"company":"globex"}`); !reflect.DeepEqual(hashes, []string{hashN(2)}) {
+		t.Errorf("expected rebuilt company list, got %v", hashes)
+	}
+	payload = mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "rebuildPersonIndexes", `{"reason":"check"}`))
+	if err := json.Unmarshal(payload, &result); err != nil || result != (IndexRebuildResult{Persons: 4}) {
+		t.Errorf("second rebuild must find nothing to repair, got %s", payload)
+	}
+}
+
+//returns registry stats for request arg
+func getStats(t *testing.T, stub *testStub, arg string) RegistryStats {
+	t.Helper()
+	var stats RegistryStats
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getRegistryStats", arg))
+	if err := json.Unmarshal(payload, &stats); err != nil {
+		t.Fatalf("cannot unmarshal stats %q: %s", payload, err)
+	}
+	return stats
+}
+
+func TestRegistryStats(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(1), "trusted")))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(2), "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", personArg(hashN(1), "banned")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(hashN(2))))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(hashN(3))))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "searchPersonAndReturn", hashArg(hashN(1))))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "deletePerson", hashArg(hashN(2))))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "batchInsertPersons", `{"persons":[{"hash":"`+hashN(4)+`","status":"trusted"},{"hash":"`+hashN(5)+`","status":"trusted"}]}`))
+
+	expected := RegistryStats{
+		Statuses: map[PersonStatus]int{STATUS_SUSP: 1, STATUS_NOT_FOUND: 1, STATUS_OK: 2},
+		Searches: map[string]map[string]int{"globex": {"2017-06": 2}, "acme": {"2017-06": 1}},
+		//the person registered by the search of globex is not counted for it
+		Inserts:  map[string]int{"acme": 4},
+		Updates:  map[string]int{"globex": 1},
+	}
+	if stats := getStats(t, stub, `{}`); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+	if stats := getStats(t, stub, `{"period":"2017-05"}`); len(stats.Searches) != 0 || stats.Inserts["acme"] != 4 {
+		t.Errorf("period must limit searches only, got %+v", stats)
+	}
+	mustFail(t, stub.invokeAs("audrey", "regulator", "getRegistryStats", `{"period":"June"}`), "period must be a month")
+	mustFail(t, stub.invokeAs("alice", "acme", "getRegistryStats", `{}`), "access denied")
+
+	//compaction keeps the counts and later writes add to the totals
+	mustFail(t, stub.invokeAs("alice", "acme", "compactRegistryStats", `{"reason":"monthly"}`), "access denied")
+	var compacted StatsCompactResult
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "compactRegistryStats", `{"reason":"monthly"}`))
+	if err := json.Unmarshal(payload, &compacted); err != nil || compacted.Deltas == 0 {
+		t.Errorf("unexpected compact result %s", payload)
+	}
+	if stats := getStats(t, stub, `{}`); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("compaction changed stats to %+v", stats)
+	}
+	mustSucceed(t, stub.invokeAs("bob", "globex", "restorePerson", hashArg(hashN(2))))
+	expected.Statuses[STATUS_OK] = 3
+	if stats := getStats(t, stub, `{}`); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %+v after restore, got %+v", expected, stats)
+	}
+
+	//persons written without the counters are counted by the index rebuild
+	stub.seed(personPrfx+hashN(6), []byte(`{"hash":"`+hashN(6)+`","status":"wrong-data","modifyDate":"2016-01-01T00:00:00Z"}`))
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "rebuildPersonIndexes", `{"reason":"recount"}`))
+	expected.Statuses[STATUS_WRONG_DATA] = 1
+	if stats := getStats(t, stub, `{}`); !reflect.DeepEqual(stats.Statuses, expected.Statuses) {
+		t.Errorf("expected recounted statuses %v, got %v", expected.Statuses, stats.Statuses)
+	}
+}
+
+func TestRegistryStatsWrites(t *testing.T) {
+	//person transactions only add changes, so concurrent ones do not conflict
+	stub := newInsuranceStub(t)
+	for i := 1; i <= 10; i++ {
+		mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hashN(i), "trusted")))
+		mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(hashN(i))))
+	}
+	batch := `{"persons":[{"hash":"` + hashN(11) + `","status":"banned"},{"hash":"` + hashN(12) + `","status":"banned"}]}`
+	mustSucceed(t, stub.invokeAs("alice", "acme", "batchInsertPersons", batch))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(hashN(1), "banned")))
+	deltas := 0
+	for key, modifications := range stub.history {
+		if strings.HasPrefix(key, compositeKeyNamespace+registryStatObj+"\x00") {
+			t.Errorf("person transactions wrote stat total %q", key)
+		}
+		if !strings.HasPrefix(key, compositeKeyNamespace+registryStatDeltaObj) {
+			continue
+		}
+		deltas++
+		if len(modifications) != 1 || modifications[0].IsDelete {
+			t.Errorf("stat change %q was written %d times", key, len(modifications))
+		}
+	}
+	//the search counters are in the regulator collection
+	for key := range stub.PvtState[regulatorSearchCollection] {
+		if strings.HasPrefix(key, compositeKeyNamespace+registryStatObj+"\x00") {
+			t.Errorf("searches wrote stat total %q", key)
+		}
+		if strings.HasPrefix(key, compositeKeyNamespace+registryStatDeltaObj) {
+			deltas++
+		}
+	}
+	expected := RegistryStats{
+		Statuses: map[PersonStatus]int{STATUS_OK: 9, STATUS_SUSP: 3},
+		Searches: map[string]map[string]int{"globex": {"2017-06": 10}},
+		Inserts:  map[string]int{"acme": 12},
+		Updates:  map[string]int{"acme": 1},
+	}
+	if stats := getStats(t, stub, `{}`); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+
+	//compaction folds all changes into the totals
+	var compacted StatsCompactResult
+	payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "compactRegistryStats", `{"reason":"monthly"}`))
+	if err := json.Unmarshal(payload, &compacted); err != nil || compacted.Deltas != deltas {
+		t.Errorf("expected %d compacted changes, got %s", deltas, payload)
+	}
+	for _, values := range []map[string][]byte{stub.State, stub.PvtState[regulatorSearchCollection]} {
+		for key := range values {
+			if strings.HasPrefix(key, compositeKeyNamespace+registryStatDeltaObj) {
+				t.Errorf("stat change %q left after compaction", key)
+			}
+		}
+	}
+	if stats := getStats(t, stub, `{}`); !reflect.DeepEqual(stats, expected) {
+		t.Errorf("compaction changed stats to %+v", stats)
+	}
+}
+
+func deriveHash(t *testing.T, stub *testStub, key string, personID string, version int) string {
+	t.Helper()
+	var derived DerivedHash
+	transient := map[string][]byte{transientHashKey: []byte(key), transientPersonID: []byte(personID)}
+	arg := `{}`
+	if version != 0 {
+		arg = fmt.Sprintf(`{"version":%d}`, version)
+	}
+	payload := mustSucceed(t, stub.invokeWithTransient("alice", "acme", transient, "derivePersonHash", arg))
+	if err := json.Unmarshal(payload, &derived); err != nil {
+		t.Fatalf("cannot unmarshal derived hash %q: %s", payload, err)
+	}
+	return derived.Hash
+}
+
+func TestHashScheme(t *testing.T) {
+	stub := newInsuranceStub(t)
+	key1 := "0123456789abcdef0123456789abcdef"
+	key2 := "fedcba9876543210fedcba9876543210"
+	passport := `{"type":"passport","country":"de","number":"C01X 00T-47"}`
+	license := `{"type":"driving-license","country":"DE","number":"B072RRE2I55"}`
+
+	//before a key is set new persons get bare hashes
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(testHash)))
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg("v1-"+otherHash, "trusted")), "no hash key is set")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", map[string][]byte{transientHashKey: []byte(key1)}, "derivePersonHash", `{}`), "no hash key is set")
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg("v0-"+otherHash, "trusted")), "optionally prefixed by its key version")
+
+	//registering keys
+	withKey := func(key string) map[string][]byte {
+		return map[string][]byte{transientHashKey: []byte(key)}
+	}
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withKey(key1), "setHashKey", `{"reason":"start"}`), "access denied")
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setHashKey", `{"reason":"start"}`), "hashKey is missing in the transient map")
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKey("short"), "setHashKey", `{"reason":"start"}`), "hashKey must be at least 32 bytes")
+	payload := mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKey(key1), "setHashKey", `{"reason":"start"}`))
+	var keyVersion HashKeyVersion
+	if err := json.Unmarshal(payload, &keyVersion); err != nil || keyVersion.Version != 1 || keyVersion.Company != adminCompany {
+		t.Errorf("unexpected key version %s", payload)
+	}
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKey(key1), "setHashKey", `{"reason":"again"}`), "registered as version 1 already")
+	schemeBytes := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getHashScheme", `{}`))
+	if strings.Contains(string(schemeBytes), key1) || !strings.Contains(string(schemeBytes), `"current":1`) {
+		t.Errorf("unexpected hash scheme %s", schemeBytes)
+	}
+
+	//hashes are HMACs of the normalized identifier
+	hash1 := deriveHash(t, stub, key1, passport, 0)
+	if hash1 != computePersonHash([]byte(key1), 1, "PASSPORT|DE|C01X00T47") || !strings.HasPrefix(hash1, "v1-") {
+		t.Errorf("unexpected hash %s", hash1)
+	}
+	if other := deriveHash(t, stub, key1, `{"type":"PASSPORT","country":"DE","number":"c01x00t47"}`, 1); other != hash1 {
+		t.Errorf("spellings of one identifier must give one hash, got %s and %s", hash1, other)
+	}
+	mustFail(t, stub.invokeWithTransient("alice", "acme", map[string][]byte{transientHashKey: []byte(key2), transientPersonID: []byte(passport)}, "derivePersonHash", `{}`), ERR_UNKNOWN_HASH_KEY)
+	mustFail(t, stub.invokeWithTransient("alice", "acme", map[string][]byte{transientHashKey: []byte(key1), transientPersonID: []byte(`{"type":"passport","country":"DE","number":" - "}`)}, "derivePersonHash", `{}`), "transient.personId.number is missing")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withKey(key1), "derivePersonHash", `{"version":2}`), "version must be at most the current key version 1")
+
+	//new persons need a hash of the current version, existing ones are kept
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(otherHash, "trusted")), ERR_HASH_VERSION)
+	mustFail(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg("v2-"+otherHash)), "new person needs a hash of key version 1, got version 2")
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(hash1, "banned")))
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(testHash, "banned")))
+
+	//moving the bare hash of the legacy person to the current key
+	hash2 := deriveHash(t, stub, key1, license, 0)
+	rekey := func(from int, transient map[string][]byte) pb.Response {
+		return stub.invokeWithTransient(adminUser, adminCompany, transient, "rekeyPersons", fmt.Sprintf(`{"fromVersion":%d,"reason":"rotation"}`, from))
+	}
+	mustFail(t, rekey(0, map[string][]byte{transientHashKey: []byte(key1), transientRekeyPersons: []byte(`[{"personId":` + license + `}]`)}), "persons[0].oldHash must be a hash without key version")
+	mustFail(t, rekey(1, withKey(key1)), "fromVersion must be below the current key version 1")
+	payload = mustSucceed(t, rekey(0, map[string][]byte{transientHashKey: []byte(key1), transientRekeyPersons: []byte(`[{"personId":` + license + `,"oldHash":"` + testHash + `"}]`)}))
+	var result RekeyResult
+	if err := json.Unmarshal(payload, &result); err != nil || len(result.Persons) != 1 || result.Persons[0] != (RekeyedPerson{OldHash: testHash, NewHash: hash2}) {
+		t.Fatalf("unexpected rekey result %s", payload)
+	}
+	if res := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", hashArg(testHash))); res != nil {
+		t.Errorf("old hash must be gone, got %s", res)
+	}
+	if person := getPerson(t, stub, hash2); person.Hash != hash2 || person.Status != STATUS_SUSP || person.CreatedBy != "acme" {
+		t.Errorf("unexpected moved person %+v", person)
+	}
+	history := getHistory(t, stub, hash2)
+	if len(history) != 3 || history[0].Method != ACTION_REKEY || history[0].Changes[0].Old != testHash || history[2].Method != ACTION_INSERT {
+		t.Errorf("unexpected history of moved person %+v", history)
+	}
+	if searches := getSearches(t, stub, hash2); len(searches) != 1 || searches[0].Company != "globex" {
+		t.Errorf("unexpected searches of moved person %+v", searches)
+	}
+	var listed PersonQueryResult
+	payload = mustSucceed(t, stub.invokeAs("alice", "acme", "listPersonsByStatus", `{"status":"banned"}`))
+	if err := json.Unmarshal(payload, &listed); err != nil || listed.Count != 2 {
+		t.Errorf("expected 2 banned persons, got %s", payload)
+	}
+	if stats := getStats(t, stub, `{}`); stats.Statuses[STATUS_SUSP] != 2 || len(stats.Statuses) != 1 {
+		t.Errorf("rekeying must keep the status counts, got %v", stats.Statuses)
+	}
+
+	//rotating the key moves persons of version 1 to version 2
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKey(key2), "setHashKey", `{"reason":"rotation"}`))
+	both := []byte(`[{"personId":` + passport + `,"oldHash":"` + hash1 + `"},{"personId":` + license + `}]`)
+	mustFail(t, rekey(1, map[string][]byte{transientHashKey: []byte(key2), transientRekeyPersons: both}), "oldHashKey is missing in the transient map")
+	mustFail(t, rekey(1, map[string][]byte{transientHashKey: []byte(key2), transientOldHashKey: []byte(key2), transientRekeyPersons: both}), "oldHashKey is not the hash key of version 1")
+	twice := []byte(`[{"personId":` + passport + `},{"personId":` + passport + `}]`)
+	mustFail(t, rekey(1, map[string][]byte{transientHashKey: []byte(key2), transientOldHashKey: []byte(key1), transientRekeyPersons: twice}), ERR_DUPLICATE_HASH)
+	mustSucceed(t, rekey(1, map[string][]byte{transientHashKey: []byte(key2), transientOldHashKey: []byte(key1), transientRekeyPersons: both}))
+	for _, personID := range []string{passport, license} {
+		hash := deriveHash(t, stub, key2, personID, 0)
+		if person := getPerson(t, stub, hash); person.Hash != hash || person.Status != STATUS_SUSP {
+			t.Errorf("unexpected person %+v under %s", person, hash)
+		}
+	}
+	if history := getHistory(t, stub, deriveHash(t, stub, key2, license, 0)); len(history) != 4 {
+		t.Errorf("expected 4 history records after second rekey, got %+v", history)
+	}
+}
+
+func TestLegacyHash(t *testing.T) {
+	stub := newInsuranceStub(t)
+	//persons stored before the scheme kept the hashes the callers chose
+	legacy := "DE passport C01X00T47"
+	stub.seed(personPrfx+legacy, []byte(`{"hash":"`+legacy+`","status":"trusted","createdBy":"acme","modifyDate":"2016-01-01T00:00:00Z"}`))
+	stub.seed(personHistoryPrfx+legacy, []byte(`[{"company":"acme","user":"alice","date":"2016-01-01T00:00:00Z","status":"trusted","method":"create"}]`))
+
+	if person := getPerson(t, stub, legacy); person.Hash != legacy || person.Status != STATUS_OK {
+		t.Errorf("unexpected legacy person %+v", person)
+	}
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", personArg(legacy, "banned")))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg(legacy)))
+	mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "migratePersonHistory", hashArg(legacy)))
+	if history := getHistory(t, stub, legacy); len(history) != 2 || history[1].Method != "create" {
+		t.Errorf("unexpected migrated history %+v", history)
+	}
+	//new persons need the format of the scheme
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", personArg("another legacy hash", "trusted")), "must be a lowercase hex SHA-256")
+	mustFail(t, stub.invokeAs("bob", "globex", "searchPerson", hashArg("another legacy hash")), "must be a lowercase hex SHA-256")
+	mustFail(t, stub.invokeAs("alice", "acme", "getPersonInfo", `{"hash":"bell\u0007"}`), "hash must not contain control characters")
+
+	//rekeying moves the legacy person to the scheme
+	key := "0123456789abcdef0123456789abcdef"
+	passport := `{"type":"passport","country":"DE","number":"C01X00T47"}`
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, map[string][]byte{transientHashKey: []byte(key)}, "setHashKey", `{"reason":"start"}`))
+	rekeyed := []byte(`[{"personId":` + passport + `,"oldHash":"` + legacy + `"}]`)
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, map[string][]byte{transientHashKey: []byte(key), transientRekeyPersons: rekeyed}, "rekeyPersons", `{"fromVersion":0,"reason":"rotation"}`))
+	newHash := deriveHash(t, stub, key, passport, 0)
+	if person := getPerson(t, stub, newHash); person.Status != STATUS_SUSP || person.CreatedBy != "acme" {
+		t.Errorf("unexpected rekeyed person %+v", person)
+	}
+	if payload := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonInfo", hashArg(legacy))); len(payload) != 0 {
+		t.Errorf("legacy hash must be gone, got %s", payload)
+	}
+}
+
+func getSearchEntries(t *testing.T, stub *testStub, user string, company string, hash string) []SearchEntry {
+	t.Helper()
+	var entries []SearchEntry
+	payload := mustSucceed(t, stub.invokeAs(user, company, "getPersonSearches", hashArg(hash)))
+	if err := json.Unmarshal(payload, &entries); err != nil {
+		t.Fatalf("cannot unmarshal searches %q: %s", payload, err)
+	}
+	return entries
+}
+
+func TestPrivateSearches(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", personArg(testHash, "trusted")))
+
+	//nothing a search writes in public or names a collection by tells the searcher
+	search := func(user string, company string, function string, hash string) {
+		t.Helper()
+		mustSucceed(t, stub.invokeAs(user, company, function, hashArg(hash)))
+		txID := fmt.Sprintf("tx%d", stub.txSeq)
+		for key, modifications := range stub.history {
+			for _, modification := range modifications {
+				if modification.TxId != txID {
+					continue
+				}
+				for _, searcher := range []string{user, company} {
+					if strings.Contains(key, searcher) || strings.Contains(string(modification.Value), searcher) {
+						t.Errorf("search of %s wrote %q = %s", searcher, key, modification.Value)
+					}
+				}
+			}
+		}
+		for collection := range stub.PvtState {
+			if collection != regulatorSearchCollection {
+				t.Errorf("search wrote to collection %s", collection)
+			}
+		}
+		if event := stub.events[len(stub.events)-1]; strings.Contains(string(event.Payload), company) {
+			t.Errorf("search event %s names %s", event.Payload, company)
+		}
+	}
+	search("alice", "acme", "searchPerson", testHash)
+	search("bob", "globex", "searchPersonAndReturn", testHash)
+	//a person registered by the search names no company either
+	search("bob", "globex", "searchPerson", otherHash)
+	search("carol", "initech", "searchPersonAndReturn", unknownHash)
+	if p := getPerson(t, stub, otherHash); p.CreatedBy != "" || p.Status != STATUS_NOT_FOUND {
+		t.Errorf("unexpected person registered by search %+v", p)
+	}
+	//search counters can not be linked to the search entries
+	for key := range stub.PvtState[regulatorSearchCollection] {
+		if !strings.HasPrefix(key, compositeKeyNamespace+registryStatDeltaObj) {
+			continue
+		}
+		_, attributes, _ := stub.SplitCompositeKey(key)
+		for _, attribute := range attributes {
+			if strings.HasPrefix(attribute, "tx") || strings.Contains(attribute, testHash) {
+				t.Errorf("search counter %v names the transaction or person", attributes)
+			}
+		}
+	}
+	if len(stub.PvtState[regulatorSearchCollection]) != 8 {
+		t.Errorf("expected 4 search details and 4 counter changes, got %v", stub.PvtState)
+	}
+
+	//the regulator sees the details, insurers and admins the digests
+	entries := getSearchEntries(t, stub, "audrey", "regulator", testHash)
+	if len(entries) != 2 || entries[0].User != "bob" || entries[0].Status != STATUS_OK || entries[1].Company != "acme" || entries[1].User != "alice" {
+		t.Errorf("unexpected searches for regulator %+v", entries)
+	}
+	for _, reader := range [][2]string{{"alice", "acme"}, {"bob", "globex"}, {adminUser, adminCompany}} {
+		for _, entry := range getSearchEntries(t, stub, reader[0], reader[1], testHash) {
+			if entry.Company != "" || entry.User != "" || entry.Status != "" || entry.Digest == "" {
+				t.Errorf("%s must get digests only, got %+v", reader[1], entry)
+			}
+		}
+	}
+	//insurers still see details searches used to write to their company collection
+	stub.PvtState[companySearchCollection("acme")] = make(map[string][]byte)
+	for key, value := range stub.PvtState[regulatorSearchCollection] {
+		if strings.Contains(string(value), `"alice"`) {
+			stub.PvtState[companySearchCollection("acme")][key] = value
+		}
+	}
+	entries = getSearchEntries(t, stub, "alice", "acme", testHash)
+	if len(entries) != 2 || entries[0].Company != "" || entries[1].User != "alice" {
+		t.Errorf("unexpected searches for acme %+v", entries)
+	}
+
+	//a detail that does not match its digest is not shown
+	for key, value := range stub.PvtState[regulatorSearchCollection] {
+		stub.PvtState[regulatorSearchCollection][key] = []byte(strings.Replace(string(value), `"bob"`, `"mallory"`, 1))
+	}
+	for _, entry := range getSearchEntries(t, stub, "audrey", "regulator", testHash) {
+		if entry.User == "mallory" {
+			t.Errorf("changed detail shown %+v", entry)
+		}
+	}
+}
+
+func TestTransientPersonInput(t *testing.T) {
+	stub := newInsuranceStub(t)
+	person := func(value string) map[string][]byte {
+		return map[string][]byte{transientPerson: []byte(value)}
+	}
+
+	//sensitive fields stay out of the argument
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", person(`{"notes":"fraud suspected","contact":"+49 30 123456"}`), "insertPerson", personArg(testHash, "trusted")))
+	if p := getPerson(t, stub, testHash); p.Notes != "fraud suspected" || p.Contact != "+49 30 123456" || p.Status != STATUS_OK {
+		t.Errorf("unexpected person %+v", p)
+	}
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", person(`{"hash":"`+testHash+`","notes":null}`), "updatePerson", `{}`))
+	if p := getPerson(t, stub, testHash); p.Notes != "" || p.Contact == "" {
+		t.Errorf("expected notes cleared, got %+v", p)
+	}
+	history := getHistory(t, stub, testHash)
+	if len(history) != 2 || len(history[0].Changes) != 1 || history[0].Changes[0].Field != "notes" {
+		t.Errorf("unexpected history %+v", history)
+	}
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"notes":"again"}`), "updatePerson", `{"hash":"`+testHash+`","notes":"twice"}`), "notes is sent in both the argument and the transient map")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"notes":5}`), "updatePerson", hashArg(testHash)), "transient.person.notes must be a string")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"email":"a@b.c"}`), "updatePerson", hashArg(testHash)), "transient.person.email is not a known field")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"hash":"`+otherHash+`"}`), "updatePerson", `{"hash":"`+testHash+`","notes":"x"}`), "hash of transient.person.hash does not match hash")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"notes":"x"}`), "updatePerson", `{}`), "hash is missing")
+	mustFail(t, stub.invokeWithTransient("bob", "globex", person(`{"status":"banned"}`), "searchPerson", hashArg(testHash)), "transient.person.status is not a known field")
+
+	//raw identifiers are hashed with the transient key, see TestHashScheme
+	passport := `{"type":"passport","country":"FR","number":"09AA12345"}`
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"personId":`+passport+`}`), "insertPerson", `{"status":"trusted"}`), "no hash key is set")
+	key := "0123456789abcdef0123456789abcdef"
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, map[string][]byte{transientHashKey: []byte(key)}, "setHashKey", `{"reason":"start"}`))
+	mustFail(t, stub.invokeWithTransient("alice", "acme", person(`{"personId":`+passport+`}`), "insertPerson", `{"status":"trusted"}`), "hashKey is missing in the transient map")
+	withID := map[string][]byte{transientHashKey: []byte(key), transientPerson: []byte(`{"personId":` + passport + `,"status":"banned"}`)}
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", withID, "insertPerson", `{}`))
+	hash := deriveHash(t, stub, key, passport, 0)
+	if p := getPerson(t, stub, hash); p.Status != STATUS_SUSP || p.Hash != hash {
+		t.Errorf("unexpected person %+v under %s", p, hash)
+	}
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withID, "updatePerson", hashArg(testHash)), "hash of transient.person.personId does not match hash")
+	withID[transientPerson] = []byte(`{"personId":` + passport + `}`)
+	mustSucceed(t, stub.invokeWithTransient("bob", "globex", withID, "searchPerson", `{}`))
+	if searches := getSearches(t, stub, hash); len(searches) != 1 || searches[0].Company != "globex" {
+		t.Errorf("unexpected searches %+v", searches)
+	}
+
+	//batch items do not see the transient map
+	payload := `{"persons":[{"status":"trusted"}],"mode":"bestEffort"}`
+	res := mustSucceed(t, stub.invokeWithTransient("alice", "acme", withID, "batchInsertPersons", payload))
+	if !strings.Contains(string(res), "hash is missing") {
+		t.Errorf("expected batch item to miss its hash, got %s", res)
+	}
+}
+
+//returns person from getPersonInfo called with transient
+func getPersonWith(t *testing.T, stub *testStub, transient map[string][]byte, hash string) Person {
+	t.Helper()
+	var person Person
+	payload := mustSucceed(t, stub.invokeWithTransient("audrey", "regulator", transient, "getPersonInfo", hashArg(hash)))
+	if err := json.Unmarshal(payload, &person); err != nil {
+		t.Fatalf("cannot unmarshal person %q: %s", payload, err)
+	}
+	return person
+}
+
+func TestFieldEncryption(t *testing.T) {
+	stub := newInsuranceStub(t)
+	key1 := "0123456789abcdef0123456789abcdef"
+	key2 := "fedcba9876543210fedcba9876543210"
+	withKeys := func(keys ...string) map[string][]byte {
+		transient := map[string][]byte{transientEncryptionKey: []byte(keys[0])}
+		if len(keys) > 1 {
+			transient[transientOldEncryptionKey] = []byte(keys[1])
+		}
+		return transient
+	}
+
+	//persons stored before a key is set stay plain
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"`+otherHash+`","status":"trusted","notes":"legacy note"}`))
+	mustFail(t, stub.invokeAs(adminUser, adminCompany, "setEncryptionKey", `{"reason":"start"}`), "encryptionKey is missing in the transient map")
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys("short"), "setEncryptionKey", `{"reason":"start"}`), "encryptionKey must be 32 bytes")
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key1), "setEncryptionKey", `{"reason":"start","fields":["status"]}`), "fields[0] must be one of")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withKeys(key1), "setEncryptionKey", `{"reason":"start"}`), "access denied")
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key1), "setEncryptionKey", `{"reason":"start"}`))
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key1), "setEncryptionKey", `{"reason":"again"}`), "registered as version 1 already")
+	var config FieldEncryption
+	configBytes := mustSucceed(t, stub.invokeAs("alice", "acme", "getFieldEncryption", `{}`))
+	if err := json.Unmarshal(configBytes, &config); err != nil || config.Current != 1 || !reflect.DeepEqual(config.Fields, defaultEncryptedFields) || strings.Contains(string(configBytes), key1) {
+		t.Errorf("unexpected config %s", configBytes)
+	}
+
+	//encrypted fields need the key, the state holds no plain value
+	person := `{"hash":"` + testHash + `","status":"trusted","notes":"fraud suspected","sourceCompany":"acme"}`
+	mustFail(t, stub.invokeAs("alice", "acme", "insertPerson", person), "encryptionKey is missing in the transient map")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withKeys(key2), "insertPerson", person), "holds no encryption key of version 1")
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", withKeys(key1), "insertPerson", person))
+	if state := string(stub.State[personPrfx+testHash]); strings.Contains(state, "fraud") || !strings.Contains(state, `"sourceCompany":"acme"`) {
+		t.Errorf("unexpected state %s", state)
+	}
+	stored := getPerson(t, stub, testHash)
+	if stored.Notes != "" || stored.Encrypted == nil || stored.Encrypted.KeyVersion != 1 || !reflect.DeepEqual(stored.Encrypted.Fields, []string{"notes"}) || stored.Encrypted.Data == "" {
+		t.Errorf("unexpected stored person %+v", stored)
+	}
+	if p := getPersonWith(t, stub, withKeys(key1), testHash); p.Notes != "fraud suspected" || p.Encrypted == nil || p.Encrypted.Data != "" {
+		t.Errorf("unexpected decrypted person %+v", p)
+	}
+	mustFail(t, stub.invokeWithTransient("audrey", "regulator", withKeys(key2), "getPersonInfo", hashArg(testHash)), ERR_UNKNOWN_ENCRYPTION_KEY)
+
+	//writes of other fields keep the encrypted fields as they are
+	mustSucceed(t, stub.invokeAs("alice", "acme", "updatePerson", `{"hash":"`+testHash+`","status":"banned"}`))
+	if p := getPerson(t, stub, testHash); p.Status != STATUS_SUSP || p.Encrypted == nil || p.Encrypted.Data != stored.Encrypted.Data {
+		t.Errorf("unexpected person after status update %+v", p)
+	}
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", withKeys(key1), "updatePerson", `{"hash":"`+testHash+`","contact":"+49 30 123456"}`))
+	if p := getPersonWith(t, stub, withKeys(key1), testHash); p.Notes != "fraud suspected" || p.Contact != "+49 30 123456" || !reflect.DeepEqual(p.Encrypted.Fields, []string{"notes", "contact"}) {
+		t.Errorf("unexpected person after contact update %+v", p)
+	}
+	history := getHistory(t, stub, testHash)
+	if change := history[0].Changes[0]; change.Field != "contact" || !change.Encrypted || change.Old != nil || change.New != nil {
+		t.Errorf("unexpected history change %+v", change)
+	}
+	if historyBytes := mustSucceed(t, stub.invokeAs(adminUser, adminCompany, "getPersonHistory", hashArg(testHash))); strings.Contains(string(historyBytes), "123456") {
+		t.Errorf("history reveals encrypted value %s", historyBytes)
+	}
+
+	//batch items get the keys
+	batch := `{"persons":[{"hash":"` + hashN(1) + `","status":"trusted","notes":"batch note"}]}`
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", withKeys(key1), "batchInsertPersons", batch))
+	if p := getPersonWith(t, stub, withKeys(key1), hashN(1)); p.Notes != "batch note" || p.Encrypted.KeyVersion != 1 {
+		t.Errorf("unexpected batch person %+v", p)
+	}
+
+	//plain persons are encrypted by reencryptPersons from version 0
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key1), "reencryptPersons", `{"fromVersion":1,"reason":"none"}`), "fromVersion must be below the current key version 1")
+	var result ReencryptResult
+	resultBytes := mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key1), "reencryptPersons", `{"fromVersion":0,"reason":"encrypt legacy"}`))
+	if err := json.Unmarshal(resultBytes, &result); err != nil || !result.Done || !reflect.DeepEqual(result.Persons, []string{otherHash}) {
+		t.Errorf("unexpected result %s", resultBytes)
+	}
+	if p := getPerson(t, stub, otherHash); p.Notes != "" || p.Encrypted == nil {
+		t.Errorf("legacy person is not encrypted %+v", p)
+	}
+
+	//rotation: persons of version 1 need the old key until they are encrypted again
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key2), "setEncryptionKey", `{"reason":"rotate","fields":["notes","contact","policyNumbers"]}`))
+	if p := getPersonWith(t, stub, withKeys(key1), testHash); p.Notes != "fraud suspected" {
+		t.Errorf("version 1 person is not readable with the old key %+v", p)
+	}
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withKeys(key2), "updatePerson", `{"hash":"`+testHash+`","notes":"confirmed"}`), "holds no encryption key of version 1")
+	mustFail(t, stub.invokeWithTransient("alice", "acme", withKeys(key1), "updatePerson", `{"hash":"`+testHash+`","notes":"confirmed"}`), "holds no encryption key of version 2")
+	mustSucceed(t, stub.invokeWithTransient("alice", "acme", withKeys(key2, key1), "updatePerson", `{"hash":"`+testHash+`","notes":"confirmed"}`))
+	if p := getPerson(t, stub, testHash); p.Encrypted.KeyVersion != 2 {
+		t.Errorf("updated person is not moved to version 2 %+v", p)
+	}
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key2), "reencryptPersons", `{"fromVersion":1,"reason":"rotate"}`), "holds no encryption key of version 1")
+	resultBytes = mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key2, key1), "reencryptPersons", `{"fromVersion":1,"limit":1,"reason":"rotate"}`))
+	if err := json.Unmarshal(resultBytes, &result); err != nil || result.Done || len(result.Persons) != 1 || result.ToVersion != 2 {
+		t.Errorf("unexpected first result %s", resultBytes)
+	}
+	resultBytes = mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key2, key1), "reencryptPersons", `{"fromVersion":1,"limit":1,"reason":"rotate"}`))
+	if err := json.Unmarshal(resultBytes, &result); err != nil || !result.Done || len(result.Persons) != 1 {
+		t.Errorf("unexpected second result %s", resultBytes)
+	}
+	for _, hash := range []string{testHash, otherHash, hashN(1)} {
+		p := getPersonWith(t, stub, withKeys(key2), hash)
+		if p.Encrypted == nil || p.Encrypted.KeyVersion != 2 || p.Notes == "" {
+			t.Errorf("person %s is not readable with the new key %+v", hash, p)
+		}
+	}
+	if p := getPersonWith(t, stub, withKeys(key2), testHash); p.Notes != "confirmed" || p.Contact != "+49 30 123456" {
+		t.Errorf("unexpected person after rotation %+v", p)
+	}
+
+	//the ciphertext of one person does not open as another
+	original := stub.State[personPrfx+otherHash]
+	moved := getPerson(t, stub, otherHash)
+	moved.Encrypted = getPerson(t, stub, testHash).Encrypted
+	movedBytes, _ := json.Marshal(&moved)
+	stub.seed(personPrfx+otherHash, movedBytes)
+	mustFail(t, stub.invokeWithTransient("audrey", "regulator", withKeys(key2), "getPersonInfo", hashArg(otherHash)), "Error decrypting fields of person "+otherHash)
+	stub.seed(personPrfx+otherHash, original)
+
+	//rekeyed persons are encrypted for the new hash
+	hashKey := "00112233445566778899aabbccddeeff"
+	license := `{"type":"driving-license","country":"DE","number":"B072RRE2I55"}`
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, map[string][]byte{transientHashKey: []byte(hashKey)}, "setHashKey", `{"reason":"start"}`))
+	rekey := map[string][]byte{transientHashKey: []byte(hashKey), transientRekeyPersons: []byte(`[{"personId":` + license + `,"oldHash":"` + testHash + `"}]`)}
+	mustFail(t, stub.invokeWithTransient(adminUser, adminCompany, rekey, "rekeyPersons", `{"fromVersion":0,"reason":"rotation"}`), "encryptionKey is missing in the transient map")
+	rekey[transientEncryptionKey] = []byte(key2)
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, rekey, "rekeyPersons", `{"fromVersion":0,"reason":"rotation"}`))
+	newHash := deriveHash(t, stub, hashKey, license, 0)
+	if p := getPersonWith(t, stub, withKeys(key2), newHash); p.Notes != "confirmed" || p.Contact != "+49 30 123456" {
+		t.Errorf("unexpected rekeyed person %+v", p)
+	}
+
+	//fields dropped from the config stay encrypted until the person is
+	//encrypted with the new version, which decrypts them
+	key3 := "00112233445566778899aabbccddeef0"
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key3), "setEncryptionKey", `{"reason":"shrink","fields":["notes"]}`))
+	if state := string(stub.State[personPrfx+newHash]); strings.Contains(state, "123456") {
+		t.Errorf("dropped field decrypted before the person is encrypted again %s", state)
+	}
+	resultBytes = mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, withKeys(key3, key2), "reencryptPersons", `{"fromVersion":2,"reason":"shrink"}`))
+	result = ReencryptResult{}
+	if err := json.Unmarshal(resultBytes, &result); err != nil || !result.Done || !reflect.DeepEqual(result.Decrypted, []string{"contact"}) {
+		t.Errorf("unexpected shrink result %s", resultBytes)
+	}
+	p := getPerson(t, stub, newHash)
+	if p.Contact != "+49 30 123456" || p.Notes != "" || p.Encrypted == nil || p.Encrypted.KeyVersion != 3 || !reflect.DeepEqual(p.Encrypted.Fields, []string{"notes"}) {
+		t.Errorf("unexpected person after shrink %+v", p)
+	}
+}
+
+func TestSealTwiceInOneTransaction(t *testing.T) {
+	stub := newInsuranceStub(t)
+	key := "0123456789abcdef0123456789abcdef"
+	transient := map[string][]byte{transientEncryptionKey: []byte(key)}
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, transient, "setEncryptionKey", `{"reason":"start"}`))
+
+	stub.MockTransactionStart("seal")
+	defer stub.MockTransactionEnd("seal")
+	stub.transient = transient
+	defer func() { stub.transient = nil }()
+	config, err := loadFieldEncryption(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonces := make(map[string]string)
+	for _, notes := range []string{"first", "second", "first"} {
+		person := &Person{Hash: testHash, Status: STATUS_OK, Notes: notes}
+		if err := sealPerson(stub, config, person); err != nil || person.Encrypted == nil {
+			t.Fatalf("cannot seal %q: %v", notes, err)
+		}
+		data, err := base64.StdEncoding.DecodeString(person.Encrypted.Data)
+		if err != nil || len(data) < 12 {
+			t.Fatalf("unexpected sealed data %q", person.Encrypted.Data)
+		}
+		nonce := string(data[:12])
+		if other, found := nonces[nonce]; found && other != notes {
+			t.Errorf("nonce of %q reused for %q", other, notes)
+		}
+		nonces[nonce] = notes
+		if err := openPerson(stub, config, person); err != nil || person.Notes != notes {
+			t.Errorf("expected %q after open, got %q, %v", notes, person.Notes, err)
+		}
+	}
+	if len(nonces) != 2 {
+		t.Errorf("expected a nonce per value, got %d", len(nonces))
+	}
+}
+
+//returns response of getPersonAsOf for hash at asOf
+func getAsOf(t *testing.T, stub *testStub, hash string, asOf time.Time) PersonAsOf {
+	t.Helper()
+	var result PersonAsOf
+	payload := mustSucceed(t, stub.invokeAs("audrey", "regulator", "getPersonAsOf", `{"hash":"`+hash+`","timestamp":"`+asOf.Format(time.RFC3339Nano)+`"}`))
+	if err := json.Unmarshal(payload, &result); err != nil {
+		t.Fatalf("cannot unmarshal person as of %q: %s", payload, err)
+	}
+	return result
+}
+
+func TestGetPersonAsOf(t *testing.T) {
+	stub := newInsuranceStub(t)
+	mustSucceed(t, stub.invokeAs("alice", "acme", "insertPerson", `{"hash":"`+testHash+`","status":"trusted","notes":"first"}`))
+	mustSucceed(t, stub.invokeAs("bob", "globex", "updatePerson", `{"hash":"`+testHash+`","status":"banned","riskScore":0.5}`))
+	versions := getVersions(t, stub, hashArg(testHash))
+	inserted, updated := versions[0].Timestamp, versions[1].Timestamp
+
+	//ledger history
+	if result := getAsOf(t, stub, testHash, inserted.Add(-time.Millisecond)); result.Person != nil || result.Transaction != nil || result.Source != "" {
+		t.Errorf("person must not exist before insert, got %+v", result)
+	}
+	result := getAsOf(t, stub, testHash, inserted.Add(500*time.Millisecond))
+	if result.Source != ASOF_SOURCE_LEDGER || result.Person == nil || result.Person.Status != STATUS_OK || result.Person.Notes != "first" {
+		t.Errorf("unexpected person after insert %+v", result)
+	}
+	if tx := result.Transaction; tx == nil || tx.TxID != versions[0].TxID || !tx.Timestamp.Equal(inserted) || tx.Action != ACTION_INSERT || tx.Company != "acme" || tx.User != "alice" {
+		t.Errorf("unexpected transaction %+v", result.Transaction)
+	}
+	result = getAsOf(t, stub, testHash, updated)
+	if result.Person == nil || result.Person.Status != STATUS_SUSP || result.Transaction.TxID != versions[1].TxID || result.Transaction.User != "bob" {
+		t.Errorf("unexpected person at update %+v", result)
+	}
+	mustFail(t, stub.invokeAs("audrey", "regulator", "getPersonAsOf", hashArg(testHash)), "timestamp is missing")
+	mustFail(t, stub.invokeAs("audrey", "regulator", "getPersonAsOf", `{"hash":"`+testHash+`","timestamp":"yesterday"}`), "timestamp")
+
+	//history actions where the ledger history of the hash starts later
+	key := "0123456789abcdef0123456789abcdef"
+	license := `{"type":"driving-license","country":"DE","number":"B072RRE2I55"}`
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, map[string][]byte{transientHashKey: []byte(key)}, "setHashKey", `{"reason":"start"}`))
+	newHash := deriveHash(t, stub, key, license, 0)
+	mustSucceed(t, stub.invokeWithTransient(adminUser, adminCompany, map[string][]byte{transientHashKey: []byte(key), transientRekeyPersons: []byte(`[{"personId":` + license + `,"oldHash":"` + testHash + `"}]`)}, "rekeyPersons", `{"fromVersion":0,"reason":"rotation"}`))
+	result = getAsOf(t, stub, newHash, updated.Add(time.Millisecond))
+	if result.Source != ASOF_SOURCE_ACTIONS || result.Person == nil || result.Person.Hash != testHash || result.Person.Status != STATUS_SUSP || result.Person.RiskScore == nil || *result.Person.RiskScore != 0.5 || result.Person.CreatedBy != "acme" {
+		t.Errorf("unexpected person from actions %+v", result.Person)
+	}
+	if tx := result.Transaction; tx == nil || tx.TxID != versions[1].TxID || tx.Action != ACTION_UPDATE || tx.Company != "globex" {
+		t.Errorf("unexpected transaction from actions %+v", result.Transaction)
+	}
+	rekeyed := getAsOf(t, stub, newHash, stub.clock)
+	if rekeyed.Source != ASOF_SOURCE_LEDGER || rekeyed.Person.Hash != newHash || rekeyed.Transaction.Action != ACTION_REKEY {
+		t.Errorf("unexpected rekeyed person %+v", rekeyed)
+	}
+	//the old hash was deleted by the rekey
+	if moved := getAsOf(t, stub, testHash, stub.clock); moved.Person != nil || moved.Transaction == nil || !moved.Transaction.IsDelete || moved.Transaction.Action != "" {
+		t.Errorf("unexpected old hash %+v", moved)
+	}
+
+	//peers without history database use the actions
+	stub.noHistory = true
+	defer func() { stub.noHistory = false }()
+	result = getAsOf(t, stub, newHash, stub.clock)
+	if result.Source != ASOF_SOURCE_ACTIONS || result.Person.Hash != newHash || result.Transaction.Action != ACTION_REKEY {
+		t.Errorf("unexpected person without history database %+v", result)
+	}
+	mustSucceed(t, stub.invokeAs("alice", "acme", "deletePerson", `{"hash":"`+newHash+`","reason":"duplicate"}`))
+	result = getAsOf(t, stub, newHash, stub.clock)
+	if result.Person == nil || result.Person.Deleted == nil || result.Person.Deleted.User != "alice" || result.Transaction.Action != ACTION_DELETE {
+		t.Errorf("unexpected deleted person %+v", result)
+	}
+	if result := getAsOf(t, stub, hashN(7), stub.clock); result.Person != nil || result.Transaction != nil {
+		t.Errorf("unknown person must be null, got %+v", result)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Maintenance functions give admins raw access to state keys. Every use is
+// recorded in the maintenance log. Keys of person data can only be changed
+// while repair mode is enabled, keys of access control and of the
+// maintenance log itself never.
+
+const MAINTENANCE_READ = "read"
+const MAINTENANCE_WRITE = "write"
+const MAINTENANCE_DELETE = "delete"
+const MAINTENANCE_REPAIR_MODE = "repairMode"
+const MAINTENANCE_PURGE = "purge"
+const MAINTENANCE_REBUILD_INDEXES = "rebuildIndexes"
+const MAINTENANCE_COMPACT_STATS = "compactStats"
+const MAINTENANCE_SET_HASH_KEY = "setHashKey"
+const MAINTENANCE_REKEY = "rekeyPersons"
+const MAINTENANCE_SET_ENCRYPTION_KEY = "setEncryptionKey"
+const MAINTENANCE_REENCRYPT = "reencryptPersons"
+
+// first character of composite keys, see shim.CreateCompositeKey
+const compositeKeyNamespace = "\x00"
+
+var (
+	// key of repair mode flag
+	repairModeKey = "Maintenance:repairMode"
+	// composite key type for maintenance log records
+	maintenanceLogObj = "MaintenanceLog"
+	// prefixes of simple keys that can be changed only in repair mode
+	repairOnlyPrfxs = []string{personPrfx, personHistoryPrfx, personSearchPrfx}
+	// prefixes of simple keys that can never be changed
+	protectedPrfxs = []string{"Maintenance:", "Config:"}
+	// composite key types that can never be changed, all others only in repair mode
+	protectedObjs = []string{roleObj, maintenanceLogObj}
+)
+
+//type for audit record of maintenance function use
+type MaintenanceRecord struct {
+	Company string    `json:"company"`
+	User    string    `json:"user"`
+	Date    time.Time `json:"date"`
+	TxID    string    `json:"txId"`
+	Method  string    `json:"method"`
+	Key     string    `json:"key"`
+	Reason  string    `json:"reason"`
+	Repair  bool      `json:"repair"`
+}
+
+//type for repair mode flag
+type RepairMode struct {
+	Enabled bool      `json:"enabled"`
+	Company string    `json:"company"`
+	User    string    `json:"user"`
+	Date    time.Time `json:"date"`
+	Reason  string    `json:"reason"`
+}
+
+func getRepairMode(stub shim.ChaincodeStubInterface) (*RepairMode, error) {
+	mode := &RepairMode{}
+	modeBytes, err := stub.GetState(repairModeKey)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting repair mode", err)
+	}
+	if len(modeBytes) == 0 {
+		return mode, nil
+	}
+	err = json.Unmarshal(modeBytes, mode)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling repair mode", err)
+	}
+	return mode, nil
+}
+
+//checks that key may be changed by maintenance functions
+func checkMaintenanceKey(stub shim.ChaincodeStubInterface, key string, repair bool) error {
+	if strings.HasPrefix(key, compositeKeyNamespace) {
+		objectType, _, err := stub.SplitCompositeKey(key)
+		if err != nil {
+			return wrapError(ERR_INVALID_FIELD, "invalid composite key", err)
+		}
+		for _, obj := range protectedObjs {
+			if objectType == obj {
+				return newError(ERR_ACCESS_DENIED, "key", "key of "+obj+" can not be changed")
+			}
+		}
+		if !repair {
+			return newError(ERR_REPAIR_MODE_REQUIRED, "key", "key of "+objectType+" can be changed only in repair mode")
+		}
+		return nil
+	}
+	for _, prfx := range protectedPrfxs {
+		if strings.HasPrefix(key, prfx) {
+			return newError(ERR_ACCESS_DENIED, "key", "key with prefix "+prfx+" can not be changed")
+		}
+	}
+	for _, prfx := range repairOnlyPrfxs {
+		if strings.HasPrefix(key, prfx) && !repair {
+			return newError(ERR_REPAIR_MODE_REQUIRED, "key", "key with prefix "+prfx+" can be changed only in repair mode")
+		}
+	}
+	return nil
+}
+
+//records use of maintenance function by the transaction creator
+func addMaintenanceRecord(stub shim.ChaincodeStubInterface, method string, key string, reason string, repair bool) error {
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
+	}
+	record := &MaintenanceRecord{
+		Company: company,
+		User:    user,
+		Date:    txTime,
+		TxID:    stub.GetTxID(),
+		Method:  method,
+		Key:     key,
+		Reason:  reason,
+		Repair:  repair,
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error marshalling maintenance record", err)
+	}
+	logKey, err := stub.CreateCompositeKey(maintenanceLogObj, []string{txTime.Format(entryTimeLayout), stub.GetTxID(), method})
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(logKey, recordBytes)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error putting maintenance record", err)
+	}
+	logger.Noticef("maintenance %s of %q by %s of %s: %s", method, key, user, company, reason)
+	return nil
+}
+
+func (t *SimpleChaincode) maintenanceRead(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req MaintenanceRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, reason := req.Key, req.Reason
+	//reads are recorded only when the call is submitted as transaction
+	err = addMaintenanceRecord(stub, MAINTENANCE_READ, key, reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	response, err := stub.GetState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(response)
+}
+
+func (t *SimpleChaincode) maintenanceWrite(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req MaintenanceWriteRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, reason := req.Key, req.Reason
+	mode, err := getRepairMode(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = checkMaintenanceKey(stub, key, mode.Enabled)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addMaintenanceRecord(stub, MAINTENANCE_WRITE, key, reason, mode.Enabled)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(key, []byte(*req.Value))
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) maintenanceDelete(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req MaintenanceRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	key, reason := req.Key, req.Reason
+	mode, err := getRepairMode(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = checkMaintenanceKey(stub, key, mode.Enabled)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addMaintenanceRecord(stub, MAINTENANCE_DELETE, key, reason, mode.Enabled)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.DelState(key)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) setRepairMode(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var arg RepairModeRequest
+	err := decodeRequest(args, &arg)
+	if err != nil {
+		return errorResponse(err)
+	}
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	mode := &RepairMode{Enabled: *arg.Enabled, Company: company, User: user, Date: txTime, Reason: arg.Reason}
+	modeBytes, err := json.Marshal(mode)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = addMaintenanceRecord(stub, MAINTENANCE_REPAIR_MODE, repairModeKey, arg.Reason, mode.Enabled)
+	if err != nil {
+		return errorResponse(err)
+	}
+	err = stub.PutState(repairModeKey, modeBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+//returns maintenance log, LIFO order or paged
+func (t *SimpleChaincode) getMaintenanceLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var records []json.RawMessage
+	var req ListRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(maintenanceLogObj, []string{})
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return errorResponse(err)
+		}
+		records = append(records, json.RawMessage(kv.Value))
+	}
+	res, err := entriesAsBytes(records, req.pageRequest(), nil)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(res)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+	"github.com/hyperledger/fabric/protos/msp"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+//testStub is an in-memory stand-in for shim.ChaincodeStubInterface.
+//It wraps shim.MockStub and adds what MockStub lacks: control over the
+//invocation arguments and creator, a deterministic transaction clock and
+//key history.
+//Like on a real peer, writes of a transaction are buffered until it ends:
+//reads see only committed state, and the writes are committed to state and
+//history only when the transaction succeeds.
+type testStub struct {
+	*shim.MockStub
+	cc      shim.Chaincode
+	args    [][]byte
+	creator []byte
+	clock   time.Time
+	txSeq   int
+	pending []*pendingWrite
+	history map[string][]*queryresult.KeyModification
+	event   *pb.ChaincodeEvent
+	//events of successful transactions, oldest first
+	events []*pb.ChaincodeEvent
+	//answers GetQueryResultWithPagination like CouchDB; when nil rich
+	//queries fail like on LevelDB
+	richQuery func(query string, pageSize int32, bookmark string) ([]*queryresult.KV, string)
+	//transient map of the next transactions
+	transient map[string][]byte
+	//proposal of the running transaction
+	signedProposal *pb.SignedProposal
+	//makes GetHistoryForKey fail like on a peer without history database
+	noHistory bool
+	//number of GetPrivateData calls
+	privateReads int
+	//number of keys returned by paginated range queries
+	pagedReads int
+}
+
+//write done by the running transaction, not yet committed
+type pendingWrite struct {
+	//private data collection, empty for public state
+	collection string
+	key        string
+	value      []byte
+	isDelete   bool
+}
+
+func newTestStub(cc shim.Chaincode) *testStub {
+	return &testStub{
+		MockStub: shim.NewMockStub("insurance", cc),
+		cc:       cc,
+		clock:    time.Date(2017, time.June, 1, 12, 0, 0, 0, time.UTC),
+		history:  make(map[string][]*queryresult.KeyModification),
+	}
+}
+
+//invoke runs one transaction against the chaincode; every call advances
+//the transaction clock by one second
+func (s *testStub) invoke(function string, args ...string) pb.Response {
+	return s.run(false, function, args)
+}
+
+//initAs runs chaincode Init submitted by user of the company MSP
+func (s *testStub) initAs(user string, company string, args ...string) pb.Response {
+	s.setCreator(user, company)
+	return s.run(true, "init", args)
+}
+
+func (s *testStub) run(init bool, function string, args []string) pb.Response {
+	var res pb.Response
+	s.txSeq++
+	s.clock = s.clock.Add(time.Second)
+	txID := fmt.Sprintf("tx%d", s.txSeq)
+	s.args = [][]byte{[]byte(function)}
+	for _, arg := range args {
+		s.args = append(s.args, []byte(arg))
+	}
+	s.pending = nil
+	s.event = nil
+	s.MockTransactionStart(txID)
+	//endorsers share the signature of the proposal
+	s.signedProposal = &pb.SignedProposal{Signature: []byte("signature of " + txID)}
+	s.TxTimestamp = &timestamp.Timestamp{Seconds: s.clock.Unix(), Nanos: int32(s.clock.Nanosecond())}
+	if init {
+		res = s.cc.Init(s)
+	} else {
+		res = s.cc.Invoke(s)
+	}
+	if res.Status == shim.OK {
+		if s.event != nil {
+			s.events = append(s.events, s.event)
+		}
+		for _, w := range s.pending {
+			s.commit(w)
+			if w.collection != "" {
+				continue
+			}
+			s.addHistory(w.key, &queryresult.KeyModification{
+				TxId:      txID,
+				Value:     w.value,
+				Timestamp: s.TxTimestamp,
+				IsDelete:  w.isDelete,
+			})
+		}
+	}
+	s.pending = nil
+	s.MockTransactionEnd(txID)
+	return res
+}
+
+//invokeAs runs one transaction submitted by user of the company MSP
+func (s *testStub) invokeAs(user string, company string, function string, args ...string) pb.Response {
+	s.setCreator(user, company)
+	return s.invoke(function, args...)
+}
+
+//setCreator makes user of the company MSP the creator of next transactions
+func (s *testStub) setCreator(user string, company string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: user, Organization: []string{company}},
+		NotBefore:    s.clock.Add(-time.Hour),
+		NotAfter:     s.clock.Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	identity := &msp.SerializedIdentity{
+		Mspid:   company,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+	s.creator, err = proto.Marshal(identity)
+	if err != nil {
+		panic(err)
+	}
+}
+
+//SetEvent keeps the event of the running transaction, a later call replaces it
+func (s *testStub) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return errors.New("event name can not be nil string")
+	}
+	s.event = &pb.ChaincodeEvent{TxId: s.TxID, EventName: name, Payload: payload}
+	return nil
+}
+
+//commit applies a buffered write of a successful transaction
+func (s *testStub) commit(w *pendingWrite) {
+	switch {
+	case w.collection != "" && w.isDelete:
+		delete(s.PvtState[w.collection], w.key)
+	case w.collection != "":
+		s.MockStub.PutPrivateData(w.collection, w.key, w.value)
+	case w.isDelete:
+		s.MockStub.DelState(w.key)
+	default:
+		s.MockStub.PutState(w.key, w.value)
+	}
+}
+
+//addHistory appends a simulated modification to the history of key
+func (s *testStub) addHistory(key string, mod *queryresult.KeyModification) {
+	s.history[key] = append(s.history[key], mod)
+}
+
+//seed puts value to state outside of any chaincode transaction
+func (s *testStub) seed(key string, value []byte) {
+	s.MockTransactionStart("seed")
+	s.MockStub.PutState(key, value)
+	s.MockTransactionEnd("seed")
+}
+
+//invokeWithTransient runs one transaction of user of the company MSP with
+//the transient map, later transactions get none
+func (s *testStub) invokeWithTransient(user string, company string, transient map[string][]byte, function string, args ...string) pb.Response {
+	s.transient = transient
+	defer func() { s.transient = nil }()
+	return s.invokeAs(user, company, function, args...)
+}
+
+func (s *testStub) GetTransient() (map[string][]byte, error) {
+	return s.transient, nil
+}
+
+func (s *testStub) GetSignedProposal() (*pb.SignedProposal, error) {
+	return s.signedProposal, nil
+}
+
+func (s *testStub) GetPrivateData(collection string, key string) ([]byte, error) {
+	s.privateReads++
+	return s.MockStub.GetPrivateData(collection, key)
+}
+
+func (s *testStub) PutPrivateData(collection string, key string, value []byte) error {
+	if s.TxID == "" {
+		return errors.New("PutPrivateData called outside of a transaction")
+	}
+	s.pending = append(s.pending, &pendingWrite{collection: collection, key: key, value: value})
+	return nil
+}
+
+//DelPrivateData buffers removal of key of collection, MockStub does not
+//implement it
+func (s *testStub) DelPrivateData(collection string, key string) error {
+	if s.TxID == "" {
+		return errors.New("DelPrivateData called outside of a transaction")
+	}
+	s.pending = append(s.pending, &pendingWrite{collection: collection, key: key, isDelete: true})
+	return nil
+}
+
+//GetPrivateDataByPartialCompositeKey returns the committed keys of collection
+//in key order, MockStub does not implement it
+func (s *testStub) GetPrivateDataByPartialCompositeKey(collection string, objectType string, keys []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := s.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	var matching []string
+	for key := range s.PvtState[collection] {
+		if strings.HasPrefix(key, prefix) {
+			matching = append(matching, key)
+		}
+	}
+	sort.Strings(matching)
+	var kvs []*queryresult.KV
+	for _, key := range matching {
+		kvs = append(kvs, &queryresult.KV{Key: key, Value: s.PvtState[collection][key]})
+	}
+	return &testKVIterator{kvs: kvs}, nil
+}
+
+func (s *testStub) GetCreator() ([]byte, error) {
+	return s.creator, nil
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	strargs := make([]string, 0, len(s.args))
+	for _, barg := range s.args {
+		strargs = append(strargs, string(barg))
+	}
+	return strargs
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	allargs := s.GetStringArgs()
+	if len(allargs) == 0 {
+		return "", []string{}
+	}
+	return allargs[0], allargs[1:]
+}
+
+//PutState buffers the write until the transaction ends, GetState keeps
+//returning the committed value
+func (s *testStub) PutState(key string, value []byte) error {
+	if s.TxID == "" {
+		return errors.New("PutState called outside of a transaction")
+	}
+	if len(value) == 0 {
+		return s.DelState(key)
+	}
+	s.pending = append(s.pending, &pendingWrite{key: key, value: value})
+	return nil
+}
+
+func (s *testStub) DelState(key string) error {
+	if s.TxID == "" {
+		return errors.New("DelState called outside of a transaction")
+	}
+	s.pending = append(s.pending, &pendingWrite{key: key, isDelete: true})
+	return nil
+}
+
+func (s *testStub) GetHistoryForKey(key string) (shim.HistoryQueryIteratorInterface, error) {
+	if s.TxID == "" {
+		return nil, errors.New("GetHistoryForKey called outside of a transaction")
+	}
+	if s.noHistory {
+		return nil, errors.New("history database not enabled")
+	}
+	return &testHistoryIterator{mods: s.history[key]}, nil
+}
+
+//testHistoryIterator iterates over the recorded history of one key,
+//oldest modification first
+type testHistoryIterator struct {
+	mods   []*queryresult.KeyModification
+	pos    int
+	closed bool
+}
+
+func (it *testHistoryIterator) HasNext() bool {
+	return !it.closed && it.pos < len(it.mods)
+}
+
+func (it *testHistoryIterator) Next() (*queryresult.KeyModification, error) {
+	if !it.HasNext() {
+		return nil, errors.New("history iterator exhausted")
+	}
+	mod := it.mods[it.pos]
+	it.pos++
+	return mod, nil
+}
+
+func (it *testHistoryIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
+func (s *testStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	if s.richQuery == nil {
+		return nil, nil, errors.New("ExecuteQuery not supported for leveldb")
+	}
+	kvs, next := s.richQuery(query, pageSize, bookmark)
+	return &testKVIterator{kvs: kvs}, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(kvs)), Bookmark: next}, nil
+}
+
+//GetStateByPartialCompositeKeyWithPagination reads up to pageSize keys from
+//the bookmark on; like on a peer the bookmark of the response is the key to
+//continue at, empty after the last key
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	resultsIterator, err := s.MockStub.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resultsIterator.Close()
+	var kvs []*queryresult.KV
+	next := ""
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if kv.Key < bookmark {
+			continue
+		}
+		if len(kvs) == int(pageSize) {
+			next = kv.Key
+			break
+		}
+		kvs = append(kvs, kv)
+	}
+	s.pagedReads += len(kvs)
+	return &testKVIterator{kvs: kvs}, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(kvs)), Bookmark: next}, nil
+}
+
+//testKVIterator iterates over the results of a rich, paginated or private query
+type testKVIterator struct {
+	kvs []*queryresult.KV
+	pos int
+}
+
+func (it *testKVIterator) HasNext() bool {
+	return it.pos < len(it.kvs)
+}
+
+func (it *testKVIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, errors.New("query iterator exhausted")
+	}
+	kv := it.kvs[it.pos]
+	it.pos++
+	return kv, nil
+}
+
+func (it *testKVIterator) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strconv"
+)
+
+const (
+	ORDER_NEWEST = "newest"
+	ORDER_OLDEST = "oldest"
+
+	defaultPageSize = 100
+)
+
+//type for paging parameters of list functions
+type PageRequest struct {
+	PageSize int    `json:"pageSize"`
+	Bookmark string `json:"bookmark"`
+	Order    string `json:"order"`
+}
+
+//type for one page of list response
+type Page struct {
+	Records  interface{} `json:"records"`
+	Bookmark string      `json:"bookmark"`
+	// number of all records; pages of person entries keep the number counted
+	// for the first page, see getEntriesPage
+	Total int `json:"total,omitempty"`
+}
+
+// Returns paging parameters, nil when the caller asked for none. Without
+// paging parameters list functions keep returning the bare list. The validate
+// tags of PageArgs keep page size and order in range.
+func (a *PageArgs) pageRequest() *PageRequest {
+	if a.PageSize == nil && a.Bookmark == nil && a.Order == nil {
+		return nil
+	}
+	res := &PageRequest{PageSize: defaultPageSize, Order: ORDER_NEWEST}
+	if a.PageSize != nil {
+		res.PageSize = *a.PageSize
+	}
+	if a.Bookmark != nil {
+		res.Bookmark = *a.Bookmark
+	}
+	if a.Order != nil {
+		res.Order = *a.Order
+	}
+	return res
+}
+
+// Returns positions of the requested page within a list of total items kept
+// oldest first, in response order, and the bookmark of the next page.
+// The bookmark is the position of the next item, so it stays valid when new
+// items are appended between calls.
+func (p *PageRequest) positions(total int) ([]int, string, error) {
+	var positions []int
+	start := 0
+	step := 1
+	if p.Order == ORDER_NEWEST {
+		start = total - 1
+		step = -1
+	}
+	if p.Bookmark != "" {
+		pos, err := strconv.Atoi(p.Bookmark)
+		if err != nil || pos < 0 || pos >= total {
+			return nil, "", newError(ERR_INVALID_FIELD, "bookmark", "invalid bookmark "+p.Bookmark)
+		}
+		start = pos
+	}
+	pos := start
+	for ; pos >= 0 && pos < total && len(positions) < p.PageSize; pos += step {
+		positions = append(positions, pos)
+	}
+	if pos < 0 || pos >= total {
+		return positions, "", nil
+	}
+	return positions, strconv.Itoa(pos), nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+)
+
+// Person fields clients can set, see PersonRequest. insertPerson takes them
+// all, updatePerson and upsertPerson change only the fields present in the
+// argument or the transient map; a field sent as null is cleared.
+var personFields = []string{"status", "policyNumbers", "riskScore", "sourceCompany", "notes", "contact"}
+
+//type for changed person field, recorded in history
+type FieldChange struct {
+	Field string      `json:"field"`
+	Old   interface{} `json:"old"`
+	New   interface{} `json:"new"`
+	// set for encrypted fields, whose values are not recorded
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+//returns value of person field as it is marshalled
+func personFieldValue(person *Person, field string) interface{} {
+	switch field {
+	case "status":
+		return person.Status
+	case "policyNumbers":
+		if person.PolicyNumbers == nil {
+			return nil
+		}
+		return person.PolicyNumbers
+	case "riskScore":
+		if person.RiskScore == nil {
+			return nil
+		}
+		return *person.RiskScore
+	case "sourceCompany":
+		return person.SourceCompany
+	case "notes":
+		return person.Notes
+	case "contact":
+		return person.Contact
+	}
+	return nil
+}
+
+//copies fields from patch to person, returns changed fields
+func mergePerson(person *Person, patch *Person, fields []string) []FieldChange {
+	var changes []FieldChange
+	for _, field := range fields {
+		oldValue := personFieldValue(person, field)
+		newValue := personFieldValue(patch, field)
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		switch field {
+		case "status":
+			person.Status = patch.Status
+		case "policyNumbers":
+			person.PolicyNumbers = patch.PolicyNumbers
+		case "riskScore":
+			person.RiskScore = patch.RiskScore
+		case "sourceCompany":
+			person.SourceCompany = patch.SourceCompany
+		case "notes":
+			person.Notes = patch.Notes
+		case "contact":
+			person.Contact = patch.Contact
+		}
+		changes = append(changes, FieldChange{Field: field, Old: oldValue, New: newValue})
+	}
+	return changes
+}
+
+func containsField(fields []string, field string) bool {
+	for _, v := range fields {
+		if v == field {
+			return true
+		}
+	}
+	return false
+}
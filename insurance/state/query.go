@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// queryPersons finds persons by status, modify date and creating company.
+// With CouchDB as state database the filter becomes a selector for
+// GetQueryResultWithPagination, backed by the indexes in
+// META-INF/statedb/couchdb/indexes. Dates are compared on modifyKey, which
+// holds the modify date in the fixed width entryTimeLayout. LevelDB has no rich queries, so there
+// the persons are read through the composite key indexes of indexes.go.
+// Deleted persons are never returned.
+
+// docType of person documents, used by the CouchDB selector
+const DOC_TYPE_PERSON = "person"
+
+//type for one page of queryPersons and the person list functions
+type PersonQueryResult struct {
+	Persons  []Person `json:"persons"`
+	Bookmark string   `json:"bookmark"`
+	Count    int      `json:"count"`
+}
+
+
+//returns true if person matches the filter of the request
+func (r *PersonQueryRequest) matches(person *Person) bool {
+	if person.Deleted != nil {
+		return false
+	}
+	if len(r.Statuses) != 0 && !containsStatus(r.Statuses, person.Status) {
+		return false
+	}
+	if r.CreatedBy != "" && person.CreatedBy != r.CreatedBy {
+		return false
+	}
+	if r.ModifiedFrom != nil && person.ModifyDate.Before(*r.ModifiedFrom) {
+		return false
+	}
+	if r.ModifiedTo != nil && !person.ModifyDate.Before(*r.ModifiedTo) {
+		return false
+	}
+	return true
+}
+
+//returns CouchDB query of the request
+func (r *PersonQueryRequest) selector() ([]byte, error) {
+	selector := map[string]interface{}{
+		"docType": DOC_TYPE_PERSON,
+		"deleted": map[string]interface{}{"$exists": false},
+	}
+	if len(r.Statuses) != 0 {
+		selector["status"] = map[string]interface{}{"$in": r.Statuses}
+	}
+	if r.CreatedBy != "" {
+		selector["createdBy"] = r.CreatedBy
+	}
+	//CouchDB compares text, RFC 3339 dates of varying width do not sort
+	if r.ModifiedFrom != nil || r.ModifiedTo != nil {
+		dateRange := make(map[string]interface{})
+		if r.ModifiedFrom != nil {
+			dateRange["$gte"] = r.ModifiedFrom.UTC().Format(entryTimeLayout)
+		}
+		if r.ModifiedTo != nil {
+			dateRange["$lt"] = r.ModifiedTo.UTC().Format(entryTimeLayout)
+		}
+		selector["modifyKey"] = dateRange
+	}
+	return json.Marshal(map[string]interface{}{"selector": selector})
+}
+
+//returns persons matching the filter, one page at a time
+func (t *SimpleChaincode) queryPersons(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req PersonQueryRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	pageSize := req.pageSize()
+	query, err := req.selector()
+	if err != nil {
+		return errorResponse(wrapError(ERR_INTERNAL, "Error marshalling query", err))
+	}
+	logger.Debugf("query persons %s", string(query))
+	var result *PersonQueryResult
+	resultsIterator, metadata, err := stub.GetQueryResultWithPagination(string(query), int32(pageSize), req.Bookmark)
+	if err == nil {
+		result, err = readQueryResult(resultsIterator, metadata, pageSize)
+	} else {
+		//no rich queries, LevelDB
+		logger.Debugf("rich query failed, using indexes: %s", err)
+		result, err = queryPersonIndexes(stub, &req, pageSize)
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
+
+//returns page of CouchDB query, with bookmark only if the page is full
+func readQueryResult(resultsIterator shim.StateQueryIteratorInterface, metadata *pb.QueryResponseMetadata, pageSize int) (*PersonQueryResult, error) {
+	result := &PersonQueryResult{Persons: []Person{}}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error reading query result", err)
+		}
+		var person Person
+		err = json.Unmarshal(kv.Value, &person)
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error unmarshalling person "+kv.Key, err)
+		}
+		result.Persons = append(result.Persons, person)
+	}
+	result.Count = len(result.Persons)
+	if metadata != nil && result.Count == pageSize {
+		result.Bookmark = metadata.Bookmark
+	}
+	return result, nil
+}
+
+// Reads persons through the composite key indexes, a page of index keys at a
+// time from the bookmark on, so a call reads about as many keys as it
+// returns. The bookmark is the index key to continue at, base64 encoded. On
+// the date and status indexes the date range of the request bounds the keys
+// read.
+func queryPersonIndexes(stub shim.ChaincodeStubInterface, req *PersonQueryRequest, pageSize int) (*PersonQueryResult, error) {
+	result := &PersonQueryResult{Persons: []Person{}}
+	objectType, attributes := personByDateObj, []string{}
+	if len(req.Statuses) == 1 {
+		objectType, attributes = personByStatusObj, []string{string(req.Statuses[0])}
+	} else if req.CreatedBy != "" {
+		objectType, attributes = personByCompanyObj, []string{req.CreatedBy}
+	}
+	prefix, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error creating person index key", err)
+	}
+	//the date follows the attributes in the keys of both dated indexes
+	dateKey := func(date time.Time) (string, error) {
+		return stub.CreateCompositeKey(objectType, append(append([]string{}, attributes...), date.UTC().Format(entryTimeLayout)))
+	}
+	start, end := "", ""
+	if objectType != personByCompanyObj && req.ModifiedFrom != nil {
+		start, err = dateKey(*req.ModifiedFrom)
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error creating person index key", err)
+		}
+	}
+	if objectType != personByCompanyObj && req.ModifiedTo != nil {
+		end, err = dateKey(*req.ModifiedTo)
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error creating person index key", err)
+		}
+	}
+	if req.Bookmark != "" {
+		startBytes, err := base64.RawURLEncoding.DecodeString(req.Bookmark)
+		if err != nil || !strings.HasPrefix(string(startBytes), prefix) {
+			return nil, newError(ERR_INVALID_FIELD, "bookmark", "invalid bookmark "+req.Bookmark)
+		}
+		start = string(startBytes)
+	}
+	//pages of keys are read until the page of persons is full, stale keys and
+	//persons outside the filter are skipped
+	for len(result.Persons) < pageSize {
+		want := pageSize - len(result.Persons)
+		resultsIterator, metadata, err := stub.GetStateByPartialCompositeKeyWithPagination(objectType, attributes, int32(want), start)
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error reading person index", err)
+		}
+		read, done := 0, false
+		for resultsIterator.HasNext() {
+			kv, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, wrapError(ERR_INTERNAL, "Error reading person index", err)
+			}
+			read++
+			if end != "" && kv.Key >= end {
+				done = true
+				break
+			}
+			person, err := readIndexedPerson(stub, req, kv.Key)
+			if err != nil {
+				resultsIterator.Close()
+				return nil, err
+			}
+			if person != nil {
+				result.Persons = append(result.Persons, *person)
+			}
+		}
+		resultsIterator.Close()
+		if done || read < want || metadata == nil || metadata.Bookmark == "" {
+			start = ""
+			break
+		}
+		start = metadata.Bookmark
+	}
+	if start != "" {
+		result.Bookmark = base64.RawURLEncoding.EncodeToString([]byte(start))
+	}
+	result.Count = len(result.Persons)
+	return result, nil
+}
+
+// Returns person of index key if it matches the filter of req, nil for keys
+// left over from writes that bypassed the indexes.
+func readIndexedPerson(stub shim.ChaincodeStubInterface, req *PersonQueryRequest, key string) (*Person, error) {
+	_, keyParts, err := stub.SplitCompositeKey(key)
+	if err != nil || len(keyParts) == 0 {
+		return nil, wrapError(ERR_INTERNAL, "Error splitting person index key", err)
+	}
+	person, err := getPersonFromState(stub, keyParts[len(keyParts)-1])
+	if err != nil {
+		return nil, err
+	}
+	if person == nil || !req.matches(person) {
+		return nil, nil
+	}
+	keys, err := getPersonIndexKeys(stub, person)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error creating person index key", err)
+	}
+	if !containsField(keys, key) {
+		return nil, nil
+	}
+	return person, nil
+}
+
+//checks the date range, the validate tags check the other fields
+func (r *PersonQueryRequest) validate() []FieldError {
+	if r.ModifiedFrom != nil && r.ModifiedTo != nil && !r.ModifiedFrom.Before(*r.ModifiedTo) {
+		return []FieldError{{Field: "modifiedTo", Code: ERR_INVALID_FIELD, Message: "modifiedTo must be after modifiedFrom"}}
+	}
+	return nil
+}
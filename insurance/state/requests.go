@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Request structs of the Invoke functions, decoded with decodeRequest.
+// See validation.go for the rules of the validate and items tags.
+
+//caller fields clients may send, checked against the transaction creator by getCaller
+type CallerArgs struct {
+	User    string `json:"user" validate:"max=64,name"`
+	Company string `json:"company" validate:"max=64,name"`
+}
+
+//paging fields of list functions, see PageArgs.pageRequest
+type PageArgs struct {
+	PageSize *int    `json:"pageSize" validate:"min=1,max=1000"`
+	Bookmark *string `json:"bookmark" validate:"max=1024"`
+	Order    *string `json:"order" validate:"oneof=newest|oldest"`
+}
+
+//request of functions that take only a person hash
+type HashRequest struct {
+	Hash string `json:"hash" validate:"required,hash"`
+}
+
+//request of getPersonInfo
+type PersonInfoRequest struct {
+	Hash           string `json:"hash" validate:"required,hash"`
+	IncludeDeleted bool   `json:"includeDeleted"`
+}
+
+//request of person list functions
+type HistoryRequest struct {
+	PageArgs
+	Hash string `json:"hash" validate:"required,hash"`
+}
+
+//request of getPersonHistoryIter
+type HistoryIterRequest struct {
+	HistoryRequest
+	// adds the changes since the version before to every version
+	Diff bool `json:"diff"`
+}
+
+//request of getPersonAsOf
+type AsOfRequest struct {
+	Hash      string     `json:"hash" validate:"required,hash"`
+	Timestamp *time.Time `json:"timestamp" validate:"required"`
+}
+
+//person fields clients can set, see personFields
+type PersonFields struct {
+	Status        PersonStatus `json:"status" validate:"status"`
+	PolicyNumbers []string     `json:"policyNumbers" validate:"max=100" items:"required,max=64,name"`
+	RiskScore     *float64     `json:"riskScore"`
+	SourceCompany string       `json:"sourceCompany" validate:"max=64,name"`
+	Notes         string       `json:"notes" validate:"max=1024,text"`
+	Contact       string       `json:"contact" validate:"max=256,text"`
+}
+
+//request of insertPerson, updatePerson and upsertPerson; fields sent as null are cleared
+type PersonRequest struct {
+	requestFields
+	CallerArgs
+	// may be left out if the transient map identifies the person
+	Hash string `json:"hash" validate:"hash"`
+	PersonFields
+}
+
+func (r *PersonRequest) validate() []FieldError {
+	if r.has("status") && r.Status == "" {
+		return []FieldError{{Field: "status", Code: ERR_INVALID_FIELD, Message: "status can not be cleared"}}
+	}
+	return nil
+}
+
+//person identity that may be sent in the transient map instead of the hash argument
+type HashTransient struct {
+	Hash string `json:"hash" validate:"hash"`
+	// hashed with the current key of the transient map, see hashscheme.go
+	PersonID *PersonIdentifier `json:"personId"`
+}
+
+//transient map entry of insertPerson, updatePerson and upsertPerson
+type PersonTransient struct {
+	requestFields
+	HashTransient
+	PersonFields
+}
+
+func (r *PersonTransient) validate() []FieldError {
+	if r.has("status") && r.Status == "" {
+		return []FieldError{{Field: "status", Code: ERR_INVALID_FIELD, Message: "status can not be cleared"}}
+	}
+	return nil
+}
+
+// Decodes the argument and the transient person entry into req. Person fields
+// may be sent in either, but not in both. The hash is resolved with
+// resolvePersonHash.
+func decodePersonRequest(stub shim.ChaincodeStubInterface, args []string, req *PersonRequest) error {
+	var tr PersonTransient
+	err := decodeRequest(args, req)
+	if err != nil {
+		return err
+	}
+	found, err := decodeTransient(stub, transientPerson, &tr)
+	if err != nil {
+		return err
+	}
+	if !found {
+		req.Hash, err = resolvePersonHash(stub, req.Hash, nil)
+		return err
+	}
+	present := make(map[string]bool)
+	for field := range req.present {
+		present[field] = true
+	}
+	for _, field := range personFields {
+		if !tr.has(field) {
+			continue
+		}
+		if req.has(field) {
+			return newError(ERR_INVALID_FIELD, field, field+" is sent in both the argument and the transient map")
+		}
+		present[field] = true
+		switch field {
+		case "status":
+			req.Status = tr.Status
+		case "policyNumbers":
+			req.PolicyNumbers = tr.PolicyNumbers
+		case "riskScore":
+			req.RiskScore = tr.RiskScore
+		case "sourceCompany":
+			req.SourceCompany = tr.SourceCompany
+		case "notes":
+			req.Notes = tr.Notes
+		case "contact":
+			req.Contact = tr.Contact
+		}
+	}
+	req.setPresent(present)
+	req.Hash, err = resolvePersonHash(stub, req.Hash, &tr.HashTransient)
+	return err
+}
+
+//returns person fields of the request and the list of their names
+func (r *PersonRequest) patch() (Person, []string) {
+	var fields []string
+	for _, field := range personFields {
+		if r.has(field) {
+			fields = append(fields, field)
+		}
+	}
+	patch := Person{
+		Hash:          r.Hash,
+		Status:        r.Status,
+		PolicyNumbers: r.PolicyNumbers,
+		RiskScore:     r.RiskScore,
+		SourceCompany: r.SourceCompany,
+		Notes:         r.Notes,
+		Contact:       r.Contact,
+	}
+	return patch, fields
+}
+
+//paging fields of person queries, the bookmark is opaque to clients
+type CursorArgs struct {
+	PageSize *int   `json:"pageSize" validate:"min=1,max=1000"`
+	Bookmark string `json:"bookmark" validate:"max=1024"`
+}
+
+func (a *CursorArgs) pageSize() int {
+	if a.PageSize == nil {
+		return defaultPageSize
+	}
+	return *a.PageSize
+}
+
+//request of queryPersons, modifiedFrom is inclusive and modifiedTo exclusive
+type PersonQueryRequest struct {
+	CursorArgs
+	Statuses     []PersonStatus `json:"statuses" validate:"max=10" items:"required,status"`
+	CreatedBy    string         `json:"createdBy" validate:"max=64,name"`
+	ModifiedFrom *time.Time     `json:"modifiedFrom"`
+	ModifiedTo   *time.Time     `json:"modifiedTo"`
+}
+
+//request of listPersonsByStatus
+type StatusListRequest struct {
+	CursorArgs
+	Status PersonStatus `json:"status" validate:"required,status"`
+}
+
+//request of listPersonsByCompany
+type CompanyListRequest struct {
+	CursorArgs
+	Company string `json:"company" validate:"required,max=64,name"`
+}
+
+//request of searchPerson and searchPersonAndReturn
+type SearchRequest struct {
+	CallerArgs
+	// may be left out if the transient map identifies the person
+	Hash string `json:"hash" validate:"hash"`
+}
+
+//decodes the argument and the transient person entry, which only identifies the person, into req
+func decodeSearchRequest(stub shim.ChaincodeStubInterface, args []string, req *SearchRequest) error {
+	var tr HashTransient
+	err := decodeRequest(args, req)
+	if err != nil {
+		return err
+	}
+	found, err := decodeTransient(stub, transientPerson, &tr)
+	if err != nil {
+		return err
+	}
+	if !found {
+		req.Hash, err = resolvePersonHash(stub, req.Hash, nil)
+		return err
+	}
+	req.Hash, err = resolvePersonHash(stub, req.Hash, &tr)
+	return err
+}
+
+//request of deletePerson and restorePerson
+type TombstoneRequest struct {
+	CallerArgs
+	Hash   string `json:"hash" validate:"required,hash"`
+	Reason string `json:"reason" validate:"max=256,text"`
+}
+
+//request of purgePerson
+type PurgeRequest struct {
+	Hash   string `json:"hash" validate:"required,hash"`
+	Reason string `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of getRegistryStats, period limits searches to one month
+type StatsRequest struct {
+	Period string `json:"period" validate:"max=7"`
+}
+
+func (r *StatsRequest) validate() []FieldError {
+	if r.Period == "" {
+		return nil
+	}
+	if _, err := time.Parse(statPeriodLayout, r.Period); err != nil {
+		return []FieldError{{Field: "period", Code: ERR_INVALID_FIELD, Message: "period must be a month like 2006-01"}}
+	}
+	return nil
+}
+
+//request of admin functions that take only a reason, kept in the maintenance log
+type ReasonRequest struct {
+	Reason string `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of derivePersonHash, identifier and key are sent in the transient map
+type DeriveHashRequest struct {
+	Version *int `json:"version" validate:"min=1"`
+}
+
+//request of rekeyPersons, keys and persons are sent in the transient map
+type RekeyRequest struct {
+	FromVersion *int   `json:"fromVersion" validate:"required,min=0"`
+	Reason      string `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of setEncryptionKey, the key is sent in the transient map
+type EncryptionKeyRequest struct {
+	// fields to encrypt, the configured ones if left out
+	Fields []string `json:"fields" validate:"max=5" items:"required,oneof=policyNumbers|riskScore|sourceCompany|notes|contact"`
+	Reason string   `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of reencryptPersons, keys are sent in the transient map
+type ReencryptRequest struct {
+	FromVersion *int   `json:"fromVersion" validate:"required,min=0"`
+	Limit       *int   `json:"limit" validate:"min=1,max=1000"`
+	Reason      string `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of batch functions, persons are requests of the single function
+type BatchRequest struct {
+	Persons []json.RawMessage `json:"persons" validate:"required,max=1000"`
+	Mode    string            `json:"mode" validate:"oneof=allOrNothing|bestEffort"`
+}
+
+//request of setLoggingLevel
+type LogLevelRequest struct {
+	Level string `json:"logLevel" validate:"required,oneof=DEBUG|INFO|NOTICE|WARNING|ERROR|CRITICAL"`
+}
+
+//request of setEventNames, empty name turns the event of an action off
+type EventNamesRequest struct {
+	Create  *string `json:"create" validate:"max=128,name"`
+	Update  *string `json:"update" validate:"max=128,name"`
+	Delete  *string `json:"delete" validate:"max=128,name"`
+	Restore *string `json:"restore" validate:"max=128,name"`
+	Search  *string `json:"search" validate:"max=128,name"`
+	Batch   *string `json:"batch" validate:"max=128,name"`
+}
+
+//returns event names of the request by action, nil for actions not sent
+func (r *EventNamesRequest) names() map[string]*string {
+	return map[string]*string{
+		ACTION_INSERT:  r.Create,
+		ACTION_UPDATE:  r.Update,
+		ACTION_DELETE:  r.Delete,
+		ACTION_RESTORE: r.Restore,
+		ACTION_SEARCH:  r.Search,
+		ACTION_BATCH:   r.Batch,
+	}
+}
+
+//request of getRoles
+type IdentityRequest struct {
+	User    string `json:"user" validate:"required,max=64,name"`
+	Company string `json:"company" validate:"required,max=64,name"`
+}
+
+//request of grantRole and revokeRole
+type RoleRequest struct {
+	User    string `json:"user" validate:"required,max=64,name"`
+	Company string `json:"company" validate:"required,max=64,name"`
+	Role    string `json:"role" validate:"required,oneof=admin|insurer|auditor"`
+}
+
+//request of maintenanceRead and maintenanceDelete
+type MaintenanceRequest struct {
+	Key    string `json:"key" validate:"required,max=1024"`
+	Reason string `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of maintenanceWrite, value may be empty
+type MaintenanceWriteRequest struct {
+	MaintenanceRequest
+	Value *string `json:"value" validate:"required"`
+}
+
+//request of setRepairMode
+type RepairModeRequest struct {
+	Enabled *bool  `json:"enabled" validate:"required"`
+	Reason  string `json:"reason" validate:"required,max=256,text"`
+}
+
+//request of getMaintenanceLog
+type ListRequest struct {
+	PageArgs
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const ROLE_ADMIN = "admin"
+const ROLE_INSURER = "insurer"
+const ROLE_AUDITOR = "auditor"
+
+// composite key type for role assignments, keyed by company (MSP ID) and user
+const roleObj = "Role"
+
+// Roles allowed to call each Invoke function. Functions missing here can not
+// be called at all.
+var functionRoles = map[string][]string{
+	"init":                  {ROLE_ADMIN},
+	"insertPerson":          {ROLE_INSURER, ROLE_ADMIN},
+	"updatePerson":          {ROLE_INSURER, ROLE_ADMIN},
+	"upsertPerson":          {ROLE_INSURER, ROLE_ADMIN},
+	"searchPerson":          {ROLE_INSURER, ROLE_ADMIN},
+	"searchPersonAndReturn": {ROLE_INSURER, ROLE_ADMIN},
+	"batchInsertPersons":    {ROLE_INSURER, ROLE_ADMIN},
+	"batchUpdatePersons":    {ROLE_INSURER, ROLE_ADMIN},
+	"batchSearchPersons":    {ROLE_INSURER, ROLE_ADMIN},
+	"deletePerson":          {ROLE_INSURER, ROLE_ADMIN},
+	"restorePerson":         {ROLE_INSURER, ROLE_ADMIN},
+	"purgePerson":           {ROLE_ADMIN},
+	"getPersonInfo":         {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"getPersonHistory":      {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"getPersonHistoryIter":  {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"getPersonAsOf":         {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"getPersonSearches":     {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"queryPersons":          {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"listPersonsByStatus":   {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"listPersonsByCompany":  {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"rebuildPersonIndexes":  {ROLE_ADMIN},
+	"getRegistryStats":      {ROLE_AUDITOR, ROLE_ADMIN},
+	"compactRegistryStats":  {ROLE_ADMIN},
+	"migratePersonHistory":  {ROLE_ADMIN},
+	"setLoggingLevel":       {ROLE_ADMIN},
+	"grantRole":             {ROLE_ADMIN},
+	"revokeRole":            {ROLE_ADMIN},
+	"getRoles":              {ROLE_AUDITOR, ROLE_ADMIN},
+	"maintenanceRead":       {ROLE_ADMIN},
+	"maintenanceWrite":      {ROLE_ADMIN},
+	"maintenanceDelete":     {ROLE_ADMIN},
+	"setRepairMode":         {ROLE_ADMIN},
+	"getMaintenanceLog":     {ROLE_AUDITOR, ROLE_ADMIN},
+	"setStatusTransitions":  {ROLE_ADMIN},
+	"getStatusTransitions":  {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"setEventNames":         {ROLE_ADMIN},
+	"getEventNames":         {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"setHashKey":            {ROLE_ADMIN},
+	"getHashScheme":         {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"derivePersonHash":      {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"rekeyPersons":          {ROLE_ADMIN},
+	"setEncryptionKey":      {ROLE_ADMIN},
+	"getFieldEncryption":    {ROLE_INSURER, ROLE_AUDITOR, ROLE_ADMIN},
+	"reencryptPersons":      {ROLE_ADMIN},
+}
+
+//type for roles of one identity
+type RoleAssignment struct {
+	User    string   `json:"user"`
+	Company string   `json:"company"`
+	Roles   []string `json:"roles"`
+}
+
+func (r *RoleAssignment) hasRole(role string) bool {
+	for _, v := range r.Roles {
+		if v == role {
+			return true
+		}
+	}
+	return false
+}
+
+//returns roles of identity, empty assignment if it has none
+func getRoleAssignment(stub shim.ChaincodeStubInterface, user string, company string) (*RoleAssignment, error) {
+	assignment := &RoleAssignment{User: user, Company: company}
+	key, err := stub.CreateCompositeKey(roleObj, []string{company, user})
+	if err != nil {
+		return nil, err
+	}
+	assignmentBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting roles of "+user, err)
+	}
+	if len(assignmentBytes) == 0 {
+		return assignment, nil
+	}
+	err = json.Unmarshal(assignmentBytes, assignment)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling roles of "+user, err)
+	}
+	return assignment, nil
+}
+
+func putRoleAssignment(stub shim.ChaincodeStubInterface, assignment *RoleAssignment) error {
+	key, err := stub.CreateCompositeKey(roleObj, []string{assignment.Company, assignment.User})
+	if err != nil {
+		return err
+	}
+	if len(assignment.Roles) == 0 {
+		return stub.DelState(key)
+	}
+	assignmentBytes, err := json.Marshal(assignment)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error marshalling roles of "+assignment.User, err)
+	}
+	return stub.PutState(key, assignmentBytes)
+}
+
+//grants role to identity, granting a role twice is a no-op
+func grantRoleTo(stub shim.ChaincodeStubInterface, user string, company string, role string) error {
+	assignment, err := getRoleAssignment(stub, user, company)
+	if err != nil {
+		return err
+	}
+	if assignment.hasRole(role) {
+		return nil
+	}
+	assignment.Roles = append(assignment.Roles, role)
+	return putRoleAssignment(stub, assignment)
+}
+
+//checks that the transaction creator holds a role allowed to call function
+func checkPermission(stub shim.ChaincodeStubInterface, function string) error {
+	roles, found := functionRoles[function]
+	if !found {
+		return newError(ERR_UNKNOWN_FUNCTION, "", "Received unknown function invocation")
+	}
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+	assignment, err := getRoleAssignment(stub, user, company)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if assignment.hasRole(role) {
+			return nil
+		}
+	}
+	logger.Warningf("access denied to %s for %s of %s", function, user, company)
+	return newError(ERR_ACCESS_DENIED, "", fmt.Sprintf("access denied: %s requires one of roles %v", function, roles))
+}
+
+// Checks that company may change person: a person belongs to the company
+// that created it, admins may change every person. Persons stored before
+// CreatedBy was kept belong to no company and may be changed by every insurer.
+func checkPersonOwner(stub shim.ChaincodeStubInterface, person *Person, company string) error {
+	if person.CreatedBy == "" || person.CreatedBy == company {
+		return nil
+	}
+	user, creatorCompany, err := getCreatorIdentity(stub)
+	if err != nil {
+		return err
+	}
+	assignment, err := getRoleAssignment(stub, user, creatorCompany)
+	if err != nil {
+		return err
+	}
+	if assignment.hasRole(ROLE_ADMIN) {
+		return nil
+	}
+	logger.Warningf("access denied to person %s of %s for %s of %s", person.Hash, person.CreatedBy, user, company)
+	return &PersonError{Code: ERR_ACCESS_DENIED, Message: "access denied: person belongs to " + person.CreatedBy, Field: "hash", Hash: person.Hash}
+}
+
+func (t *SimpleChaincode) grantRole(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req RoleRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	user, company, role := req.User, req.Company, req.Role
+	logger.Infof("grant role %s to %s of %s", role, user, company)
+	err = grantRoleTo(stub, user, company, role)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) revokeRole(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req RoleRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	user, company, role := req.User, req.Company, req.Role
+	callerUser, callerCompany, err := getCreatorIdentity(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if role == ROLE_ADMIN && user == callerUser && company == callerCompany {
+		return errorResponse(newError(ERR_ACCESS_DENIED, "role", "admin can not revoke own admin role"))
+	}
+	logger.Infof("revoke role %s from %s of %s", role, user, company)
+	assignment, err := getRoleAssignment(stub, user, company)
+	if err != nil {
+		return errorResponse(err)
+	}
+	var roles []string
+	for _, v := range assignment.Roles {
+		if v != role {
+			roles = append(roles, v)
+		}
+	}
+	assignment.Roles = roles
+	err = putRoleAssignment(stub, assignment)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) getRoles(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req IdentityRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	assignment, err := getRoleAssignment(stub, req.User, req.Company)
+	if err != nil {
+		return errorResponse(err)
+	}
+	assignmentBytes, err := json.Marshal(assignment)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(assignmentBytes)
+}
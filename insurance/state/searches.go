@@ -0,0 +1,256 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Which company searched which person is commercially sensitive, so the
+// detail of a search (company, user and status) is kept in the private data
+// collection regulatorSearchCollection, see the example in
+// collections_config.json given at instantiation. A search writes no public
+// key, value or collection name that names the searching company: the public
+// search entry of the person holds only the date and a salted digest of the
+// detail, the search counters of stats.go are kept in the same collection
+// and a person registered by the search names no company, see searchPerson.
+// The salt comes from the proposal signature, which the endorsers share but
+// the ledger does not keep, so the digest can not be brute-forced from the
+// few companies, users and statuses there are.
+// getPersonSearches shows the detail to auditors, who read the regulator
+// collection; others get the digests.
+// Searches used to be written to a collection per company as well, named by
+// companySearchCollection and listed in state under
+// <searchCollectionObj, collection>. Insurers still read the details of their
+// company from there and purgePerson deletes them; chaincode upgrades keep
+// those collections in the collection config.
+// Block readers still see the creator of every transaction.
+
+const (
+	// collection of search details readable by the regulator
+	regulatorSearchCollection = "searchesRegulator"
+	// composite key type of search details in collections, keyed by digest
+	privateSearchObj = "PrivateSearch"
+	// composite key type of company collections searches were written to
+	searchCollectionObj = "SearchCollection"
+)
+
+//type for search entry kept on the public ledger
+type SearchDigest struct {
+	Date   time.Time `json:"date"`
+	Digest string    `json:"digest"`
+}
+
+//type for search detail kept in private data collections
+type PrivateSearch struct {
+	Hash string `json:"hash"`
+	SearchResult
+	Salt string `json:"salt"`
+}
+
+//type for entry of getPersonSearches, company, user and status only for readers of the detail
+type SearchEntry struct {
+	Date    time.Time    `json:"date"`
+	Digest  string       `json:"digest"`
+	Company string       `json:"company,omitempty"`
+	User    string       `json:"user,omitempty"`
+	Status  PersonStatus `json:"status,omitempty"`
+}
+
+//returns the private data collection searches of company were written to
+func companySearchCollection(company string) string {
+	return "searches" + company
+}
+
+//returns salt of search detail of person, secret to the endorsers of the transaction
+func searchSalt(stub shim.ChaincodeStubInterface, hash string) (string, error) {
+	proposal, err := stub.GetSignedProposal()
+	if err != nil || proposal == nil || len(proposal.Signature) == 0 {
+		return "", wrapError(ERR_INTERNAL, "signed proposal is not available", err)
+	}
+	salt := sha256.Sum256(append(append([]byte{}, proposal.Signature...), hash...))
+	return hex.EncodeToString(salt[:]), nil
+}
+
+//returns digest of search detail, kept on the public ledger
+func searchDigest(salt string, hash string, search *SearchResult) (string, error) {
+	searchBytes, err := json.Marshal(search)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(salt + "|" + hash + "|" + string(searchBytes)))
+	return hex.EncodeToString(digest[:]), nil
+}
+
+//puts search detail in the regulator collection, returns its public entry
+func putPrivateSearch(stub shim.ChaincodeStubInterface, hash string, search *SearchResult) ([]byte, error) {
+	salt, err := searchSalt(stub, hash)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := searchDigest(salt, hash, search)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error marshalling search for person "+hash, err)
+	}
+	privateBytes, err := json.Marshal(&PrivateSearch{Hash: hash, SearchResult: *search, Salt: salt})
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error marshalling search for person "+hash, err)
+	}
+	key, err := stub.CreateCompositeKey(privateSearchObj, []string{digest})
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error creating search key", err)
+	}
+	err = stub.PutPrivateData(regulatorSearchCollection, key, privateBytes)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error putting search to collection "+regulatorSearchCollection, err)
+	}
+	publicBytes, err := json.Marshal(&SearchDigest{Date: search.Date, Digest: digest})
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error marshalling search for person "+hash, err)
+	}
+	return publicBytes, nil
+}
+
+//returns collections of search details the transaction creator may read
+func readableSearchCollections(stub shim.ChaincodeStubInterface) ([]string, error) {
+	var collections []string
+	user, company, err := getCreatorIdentity(stub)
+	if err != nil {
+		return nil, err
+	}
+	assignment, err := getRoleAssignment(stub, user, company)
+	if err != nil {
+		return nil, err
+	}
+	//details of searches written before they went to the regulator only
+	if assignment.hasRole(ROLE_INSURER) {
+		collections = append(collections, companySearchCollection(company))
+	}
+	if assignment.hasRole(ROLE_AUDITOR) {
+		collections = append(collections, regulatorSearchCollection)
+	}
+	return collections, nil
+}
+
+// Returns search entry as SearchEntry, with the detail if one of
+// collections holds it. Entries stored before the collections are public and
+// returned as they are.
+func revealSearch(stub shim.ChaincodeStubInterface, entry json.RawMessage, collections []string) (json.RawMessage, error) {
+	var public SearchDigest
+	err := json.Unmarshal(entry, &public)
+	if err != nil || public.Digest == "" {
+		return entry, nil
+	}
+	key, err := stub.CreateCompositeKey(privateSearchObj, []string{public.Digest})
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error creating search key", err)
+	}
+	result := &SearchEntry{Date: public.Date, Digest: public.Digest}
+	for _, collection := range collections {
+		privateBytes, err := stub.GetPrivateData(collection, key)
+		if err != nil {
+			//peer is no member of the collection
+			logger.Debugf("search %s not readable from %s: %s", public.Digest, collection, err)
+			continue
+		}
+		if len(privateBytes) == 0 {
+			continue
+		}
+		var private PrivateSearch
+		err = json.Unmarshal(privateBytes, &private)
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error unmarshalling search "+public.Digest, err)
+		}
+		//the detail keeps the hash of the search, rekeyPersons may have moved the person since
+		digest, err := searchDigest(private.Salt, private.Hash, &private.SearchResult)
+		if err != nil || digest != public.Digest {
+			logger.Warningf("search %s in %s does not match its digest", public.Digest, collection)
+			continue
+		}
+		result.Company, result.User, result.Status = private.Company, private.User, private.Status
+		break
+	}
+	return json.Marshal(result)
+}
+
+// Returns collections that may hold search details: the regulator collection,
+// the company collections searches were written to and, for searches written
+// before the collections were listed, those of the companies with the
+// insurer role.
+func searchCollections(stub shim.ChaincodeStubInterface) ([]string, error) {
+	collections := []string{regulatorSearchCollection}
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(searchCollectionObj, []string{})
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error reading search collections", err)
+	}
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return nil, wrapError(ERR_INTERNAL, "Error reading search collections", err)
+		}
+		_, attributes, err := stub.SplitCompositeKey(kv.Key)
+		if err != nil || len(attributes) != 1 {
+			continue
+		}
+		if !containsField(collections, attributes[0]) {
+			collections = append(collections, attributes[0])
+		}
+	}
+	resultsIterator.Close()
+	resultsIterator, err = stub.GetStateByPartialCompositeKey(roleObj, []string{})
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error reading roles", err)
+	}
+	for resultsIterator.HasNext() {
+		kv, err := resultsIterator.Next()
+		if err != nil {
+			resultsIterator.Close()
+			return nil, wrapError(ERR_INTERNAL, "Error reading roles", err)
+		}
+		var assignment RoleAssignment
+		err = json.Unmarshal(kv.Value, &assignment)
+		if err != nil {
+			resultsIterator.Close()
+			return nil, wrapError(ERR_INTERNAL, "Error unmarshalling roles "+kv.Key, err)
+		}
+		collection := companySearchCollection(assignment.Company)
+		if assignment.hasRole(ROLE_INSURER) && !containsField(collections, collection) {
+			collections = append(collections, collection)
+		}
+	}
+	resultsIterator.Close()
+	return collections, nil
+}
+
+// Deletes search details of person from every collection of searchCollections.
+func deletePrivateSearches(stub shim.ChaincodeStubInterface, hash string) error {
+	entries, err := getEntries(stub, personSearchObj, personSearchPrfx, hash)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error reading searches of person "+hash, err)
+	}
+	collections, err := searchCollections(stub)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		var public SearchDigest
+		if json.Unmarshal(entry, &public) != nil || public.Digest == "" {
+			continue
+		}
+		key, err := stub.CreateCompositeKey(privateSearchObj, []string{public.Digest})
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error creating search key", err)
+		}
+		for _, collection := range collections {
+			err = stub.DelPrivateData(collection, key)
+			if err != nil {
+				return wrapError(ERR_INTERNAL, "Error deleting search from collection "+collection, err)
+			}
+		}
+	}
+	return nil
+}
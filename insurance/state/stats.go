@@ -0,0 +1,369 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Registry statistics are counted in the write paths: persons per status in
+// putPersonInState, inserts and updates per company in addHistoryRecord and
+// searches per company and month in addSearchRecord. The search counters
+// name the searching company, so they are kept in regulatorSearchCollection
+// instead of state, see searches.go; only auditors read them.
+// A single key per counter would make every two concurrent writes conflict,
+// so like history entries each write puts its change under its own key
+// <registryStatDeltaObj, kind, names..., writeID>. The writeID is derived
+// from the proposal signature, which the ledger does not keep, and the
+// person; it tells the writes of one transaction, like a batch, apart but
+// links the key neither to the transaction nor to the person. So the search
+// counter of a company does not tell whom it searched, and purgePerson leaves
+// no key of the person. getRegistryStats adds
+// the changes to the totals kept under <registryStatObj, kind, names...>.
+// Person transactions only add changes: reading them or the totals would make
+// concurrent writes of a counter fail validation. So getRegistryStats reads
+// more the more changes there are, until an admin runs compactRegistryStats,
+// which folds the changes into the totals; run it regularly, like monthly.
+// rebuildPersonIndexes recounts the persons per status.
+
+const (
+	// composite key type of counter totals
+	registryStatObj = "RegistryStat"
+	// composite key type of counter changes of single writes
+	registryStatDeltaObj = "RegistryStatDelta"
+
+	STAT_STATUS   = "status"
+	STAT_SEARCHES = "searches"
+	STAT_INSERTS  = "inserts"
+	STAT_UPDATES  = "updates"
+
+	// layout of the month searches are counted in
+	statPeriodLayout = "2006-01"
+)
+
+//type for response of getRegistryStats
+type RegistryStats struct {
+	// persons per status, deleted persons not included
+	Statuses map[PersonStatus]int `json:"statuses"`
+	// searches per company and month
+	Searches map[string]map[string]int `json:"searches"`
+	Inserts  map[string]int            `json:"inserts"`
+	Updates  map[string]int            `json:"updates"`
+}
+
+//type for result of compactRegistryStats
+type StatsCompactResult struct {
+	Deltas   int `json:"deltas"`
+	Counters int `json:"counters"`
+}
+
+//returns ID of the counter change of person hash, secret to the endorsers of the transaction
+func statWriteID(stub shim.ChaincodeStubInterface, hash string) (string, error) {
+	proposal, err := stub.GetSignedProposal()
+	if err != nil || proposal == nil || len(proposal.Signature) == 0 {
+		return "", wrapError(ERR_INTERNAL, "signed proposal is not available", err)
+	}
+	writeID := sha256.Sum256(append(append([]byte("stat|"), proposal.Signature...), hash...))
+	return hex.EncodeToString(writeID[:16]), nil
+}
+
+//adds delta to counter kind/names of collection, state if empty, for the write of person hash
+func addStat(stub shim.ChaincodeStubInterface, collection string, hash string, delta int, kind string, names ...string) error {
+	writeID, err := statWriteID(stub, hash)
+	if err != nil {
+		return err
+	}
+	attributes := append(append([]string{kind}, names...), writeID)
+	key, err := stub.CreateCompositeKey(registryStatDeltaObj, attributes)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error creating stat key", err)
+	}
+	err = putStat(stub, collection, key, delta)
+	if err != nil {
+		return wrapError(ERR_INTERNAL, "Error putting stat "+kind, err)
+	}
+	return nil
+}
+
+//puts value of stat key to collection, state if empty
+func putStat(stub shim.ChaincodeStubInterface, collection string, key string, value int) error {
+	if collection == "" {
+		return stub.PutState(key, []byte(strconv.Itoa(value)))
+	}
+	return stub.PutPrivateData(collection, key, []byte(strconv.Itoa(value)))
+}
+
+//deletes stat key from collection, state if empty
+func delStat(stub shim.ChaincodeStubInterface, collection string, key string) error {
+	if collection == "" {
+		return stub.DelState(key)
+	}
+	return stub.DelPrivateData(collection, key)
+}
+
+//returns stat keys of objectType starting with attributes from collection, state if empty
+func getStatsByPartialKey(stub shim.ChaincodeStubInterface, collection string, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	if collection == "" {
+		return stub.GetStateByPartialCompositeKey(objectType, attributes)
+	}
+	return stub.GetPrivateDataByPartialCompositeKey(collection, objectType, attributes)
+}
+
+//moves person from the status count of old to that of new, either may be nil
+func updateStatusCounts(stub shim.ChaincodeStubInterface, old *Person, new *Person) error {
+	var oldStatus, newStatus PersonStatus
+	if old != nil && old.Deleted == nil {
+		oldStatus = old.Status
+	}
+	if new != nil && new.Deleted == nil {
+		newStatus = new.Status
+	}
+	if oldStatus == newStatus {
+		return nil
+	}
+	if oldStatus != "" {
+		err := addStat(stub, "", old.Hash, -1, STAT_STATUS, string(oldStatus))
+		if err != nil {
+			return err
+		}
+	}
+	if newStatus != "" {
+		return addStat(stub, "", new.Hash, 1, STAT_STATUS, string(newStatus))
+	}
+	return nil
+}
+
+//counts history action of company, only inserts and updates are counted
+func countAction(stub shim.ChaincodeStubInterface, hash string, action string, company string) error {
+	//persons registered by searches name no company
+	if company == "" {
+		return nil
+	}
+	if action == ACTION_INSERT {
+		return addStat(stub, "", hash, 1, STAT_INSERTS, company)
+	}
+	if action == ACTION_UPDATE {
+		return addStat(stub, "", hash, 1, STAT_UPDATES, company)
+	}
+	return nil
+}
+
+//counts search of company in the month of date, in the regulator collection
+func countSearch(stub shim.ChaincodeStubInterface, hash string, company string, date time.Time) error {
+	return addStat(stub, regulatorSearchCollection, hash, 1, STAT_SEARCHES, company, date.UTC().Format(statPeriodLayout))
+}
+
+//stores of the counters, state and the collection of the search counters
+var statCollections = []string{"", regulatorSearchCollection}
+
+//type for value of one counter
+type statCounter struct {
+	kind  string
+	names []string
+	value int
+}
+
+//returns counters of collection, state if empty, keyed by their total key, changes added to the totals
+func readStatCounters(stub shim.ChaincodeStubInterface, collection string) (map[string]*statCounter, []string, error) {
+	counters := make(map[string]*statCounter)
+	var deltaKeys []string
+	for _, objectType := range []string{registryStatObj, registryStatDeltaObj} {
+		resultsIterator, err := getStatsByPartialKey(stub, collection, objectType, []string{})
+		if err != nil {
+			return nil, nil, wrapError(ERR_INTERNAL, "Error reading stats", err)
+		}
+		for resultsIterator.HasNext() {
+			kv, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return nil, nil, wrapError(ERR_INTERNAL, "Error reading stats", err)
+			}
+			_, attributes, err := stub.SplitCompositeKey(kv.Key)
+			if err == nil && objectType == registryStatDeltaObj {
+				deltaKeys = append(deltaKeys, kv.Key)
+				//drop writeID
+				if len(attributes) < 2 {
+					attributes = nil
+				} else {
+					attributes = attributes[:len(attributes)-1]
+				}
+			}
+			var value int
+			if err == nil {
+				value, err = strconv.Atoi(string(kv.Value))
+			}
+			if err != nil || len(attributes) == 0 {
+				resultsIterator.Close()
+				return nil, nil, newError(ERR_INTERNAL, "", "invalid stat "+kv.Key)
+			}
+			totalKey, err := stub.CreateCompositeKey(registryStatObj, attributes)
+			if err != nil {
+				resultsIterator.Close()
+				return nil, nil, wrapError(ERR_INTERNAL, "Error creating stat key", err)
+			}
+			counter, found := counters[totalKey]
+			if !found {
+				counter = &statCounter{kind: attributes[0], names: attributes[1:]}
+				counters[totalKey] = counter
+			}
+			counter.value += value
+		}
+		resultsIterator.Close()
+	}
+	return counters, deltaKeys, nil
+}
+
+//returns person counts per status, searches, inserts and updates per company
+func (t *SimpleChaincode) getRegistryStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req StatsRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	stats := &RegistryStats{
+		Statuses: make(map[PersonStatus]int),
+		Searches: make(map[string]map[string]int),
+		Inserts:  make(map[string]int),
+		Updates:  make(map[string]int),
+	}
+	//search counters written before they moved to the collection are in state
+	var counters []*statCounter
+	for _, collection := range statCollections {
+		collectionCounters, _, err := readStatCounters(stub, collection)
+		if err != nil {
+			return errorResponse(err)
+		}
+		for _, counter := range collectionCounters {
+			counters = append(counters, counter)
+		}
+	}
+	for _, counter := range counters {
+		if counter.value == 0 {
+			continue
+		}
+		switch {
+		case counter.kind == STAT_STATUS && len(counter.names) == 1:
+			stats.Statuses[PersonStatus(counter.names[0])] += counter.value
+		case counter.kind == STAT_INSERTS && len(counter.names) == 1:
+			stats.Inserts[counter.names[0]] += counter.value
+		case counter.kind == STAT_UPDATES && len(counter.names) == 1:
+			stats.Updates[counter.names[0]] += counter.value
+		case counter.kind == STAT_SEARCHES && len(counter.names) == 2:
+			company, period := counter.names[0], counter.names[1]
+			if req.Period != "" && period != req.Period {
+				continue
+			}
+			if stats.Searches[company] == nil {
+				stats.Searches[company] = make(map[string]int)
+			}
+			stats.Searches[company][period] += counter.value
+		}
+	}
+	statsBytes, err := json.Marshal(stats)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(statsBytes)
+}
+
+// Adds the counter changes to the totals and deletes them. The search
+// counters are in regulatorSearchCollection, so the admin must be a member of
+// it and the transaction endorsed by its peers.
+func (t *SimpleChaincode) compactRegistryStats(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req ReasonRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	result := &StatsCompactResult{}
+	for _, collection := range statCollections {
+		counters, deltaKeys, err := readStatCounters(stub, collection)
+		if err != nil {
+			return errorResponse(err)
+		}
+		var totalKeys []string
+		for key := range counters {
+			totalKeys = append(totalKeys, key)
+		}
+		sort.Strings(totalKeys)
+		for _, key := range totalKeys {
+			err = putStat(stub, collection, key, counters[key].value)
+			if err != nil {
+				return errorResponse(wrapError(ERR_INTERNAL, "Error putting stat total", err))
+			}
+		}
+		for _, key := range deltaKeys {
+			err = delStat(stub, collection, key)
+			if err != nil {
+				return errorResponse(wrapError(ERR_INTERNAL, "Error deleting stat change", err))
+			}
+		}
+		result.Deltas += len(deltaKeys)
+		result.Counters += len(totalKeys)
+	}
+	logger.Infof("compacted %d stat changes into %d counters", result.Deltas, result.Counters)
+	err = addMaintenanceRecord(stub, MAINTENANCE_COMPACT_STATS, registryStatObj, req.Reason, false)
+	if err != nil {
+		return errorResponse(err)
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
+
+//replaces totals and changes of the status counters with counts
+func resetStatusCounts(stub shim.ChaincodeStubInterface, counts map[PersonStatus]int) error {
+	var stale []string
+	for _, objectType := range []string{registryStatObj, registryStatDeltaObj} {
+		resultsIterator, err := stub.GetStateByPartialCompositeKey(objectType, []string{STAT_STATUS})
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error reading stats", err)
+		}
+		for resultsIterator.HasNext() {
+			kv, err := resultsIterator.Next()
+			if err != nil {
+				resultsIterator.Close()
+				return wrapError(ERR_INTERNAL, "Error reading stats", err)
+			}
+			stale = append(stale, kv.Key)
+		}
+		resultsIterator.Close()
+	}
+	totals := make(map[string]int)
+	for status, count := range counts {
+		key, err := stub.CreateCompositeKey(registryStatObj, []string{STAT_STATUS, string(status)})
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error creating stat key", err)
+		}
+		totals[key] = count
+	}
+	for _, key := range stale {
+		if _, found := totals[key]; found {
+			continue
+		}
+		err := stub.DelState(key)
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error deleting stat", err)
+		}
+	}
+	var keys []string
+	for key := range totals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := stub.PutState(key, []byte(strconv.Itoa(totals[key])))
+		if err != nil {
+			return wrapError(ERR_INTERNAL, "Error putting stat total", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Person status can change only along the status transition table. The table
+// kept in state under statusTransitionsKey overrides defaultStatusTransitions.
+// Keeping the same status is always allowed.
+
+// key of configured status transition table
+var statusTransitionsKey = "Config:statusTransitions"
+
+var knownStatuses = []PersonStatus{STATUS_OK, STATUS_SUSP, STATUS_WRONG_DATA, STATUS_NOT_FOUND}
+
+//type for status transition table
+type StatusTransitions struct {
+	// statuses a new person can get
+	Initial []PersonStatus `json:"initial" validate:"required" items:"status"`
+	// statuses each status can change to
+	Allowed map[PersonStatus][]PersonStatus `json:"allowed"`
+}
+
+var defaultStatusTransitions = StatusTransitions{
+	Initial: []PersonStatus{STATUS_OK, STATUS_SUSP, STATUS_WRONG_DATA, STATUS_NOT_FOUND},
+	Allowed: map[PersonStatus][]PersonStatus{
+		STATUS_NOT_FOUND:  {STATUS_OK, STATUS_SUSP, STATUS_WRONG_DATA},
+		STATUS_OK:         {STATUS_SUSP, STATUS_WRONG_DATA},
+		STATUS_SUSP:       {STATUS_OK, STATUS_WRONG_DATA},
+		STATUS_WRONG_DATA: {STATUS_OK, STATUS_SUSP},
+	},
+}
+
+//type for rejected status, returned to the client as JSON
+type StatusError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Field   string       `json:"field"`
+	From    PersonStatus `json:"from,omitempty"`
+	To      PersonStatus `json:"to"`
+}
+
+func (e *StatusError) Error() string {
+	errBytes, _ := json.Marshal(e)
+	return string(errBytes)
+}
+
+//checks statuses of allowed, the validate tags check initial
+func (s *StatusTransitions) validate() []FieldError {
+	var errs []FieldError
+	var froms []string
+	for from := range s.Allowed {
+		froms = append(froms, string(from))
+	}
+	sort.Strings(froms)
+	for _, from := range froms {
+		field := "allowed." + from
+		errs = append(errs, checkRules(field, reflect.ValueOf(from), "status", true)...)
+		for i, to := range s.Allowed[PersonStatus(from)] {
+			errs = append(errs, checkRules(fmt.Sprintf("%s[%d]", field, i), reflect.ValueOf(string(to)), "required,status", true)...)
+		}
+	}
+	return errs
+}
+
+func isKnownStatus(status PersonStatus) bool {
+	for _, v := range knownStatuses {
+		if v == status {
+			return true
+		}
+	}
+	return false
+}
+
+func containsStatus(statuses []PersonStatus, status PersonStatus) bool {
+	for _, v := range statuses {
+		if v == status {
+			return true
+		}
+	}
+	return false
+}
+
+//returns status param as PersonStatus, error if it is unknown
+func parsePersonStatus(status string) (PersonStatus, error) {
+	if !isKnownStatus(PersonStatus(status)) {
+		return "", &StatusError{
+			Code:    ERR_UNKNOWN_STATUS,
+			Message: fmt.Sprintf("unknown status %q, expecting one of %v", status, knownStatuses),
+			Field:   "status",
+			To:      PersonStatus(status),
+		}
+	}
+	return PersonStatus(status), nil
+}
+
+//returns configured status transition table, the default if none is configured
+func loadStatusTransitions(stub shim.ChaincodeStubInterface) (*StatusTransitions, error) {
+	transitionsBytes, err := stub.GetState(statusTransitionsKey)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error getting status transitions", err)
+	}
+	if len(transitionsBytes) == 0 {
+		return &defaultStatusTransitions, nil
+	}
+	transitions := &StatusTransitions{}
+	err = json.Unmarshal(transitionsBytes, transitions)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error unmarshalling status transitions", err)
+	}
+	return transitions, nil
+}
+
+//checks change of person status, from is empty for a new person
+func checkStatusTransition(stub shim.ChaincodeStubInterface, from PersonStatus, to PersonStatus) error {
+	if !isKnownStatus(to) {
+		_, err := parsePersonStatus(string(to))
+		return err
+	}
+	if from != "" && from == to {
+		return nil
+	}
+	transitions, err := loadStatusTransitions(stub)
+	if err != nil {
+		return err
+	}
+	allowed := transitions.Initial
+	if from != "" {
+		allowed = transitions.Allowed[from]
+	}
+	if containsStatus(allowed, to) {
+		return nil
+	}
+	message := fmt.Sprintf("new person can not get status %q", to)
+	if from != "" {
+		message = fmt.Sprintf("status can not change from %q to %q", from, to)
+	}
+	return &StatusError{
+		Code:    ERR_ILLEGAL_STATUS_TRANSITION,
+		Message: message,
+		Field:   "status",
+		From:    from,
+		To:      to,
+	}
+}
+
+//replaces the status transition table
+func (t *SimpleChaincode) setStatusTransitions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var transitions StatusTransitions
+	err := decodeRequest(args, &transitions)
+	if err != nil {
+		return errorResponse(err)
+	}
+	transitionsBytes, err := json.Marshal(&transitions)
+	if err != nil {
+		return errorResponse(err)
+	}
+	logger.Infof("set status transitions %s", string(transitionsBytes))
+	err = stub.PutState(statusTransitionsKey, transitionsBytes)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(nil)
+}
+
+func (t *SimpleChaincode) getStatusTransitions(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	transitions, err := loadStatusTransitions(stub)
+	if err != nil {
+		return errorResponse(err)
+	}
+	transitionsBytes, err := json.Marshal(transitions)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(transitionsBytes)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Invoke functions decode their argument into a request struct with
+// decodeRequest. Decoding is strict: the argument must be one JSON object and
+// fields unknown to the struct or holding a value of the wrong type are
+// rejected. Fields are then checked against the rules of their validate tag,
+// the elements of slices against the rules of their items tag:
+//
+//	required   present and not empty, for pointers present and not null
+//	min=N      number at least N
+//	max=N      at most N characters, N elements or, for numbers, at most N
+//	hash       person hash, at most 256 characters without control characters;
+//	           new persons need the format of hashscheme.go, see checkNewPersonHash
+//	name       letters, digits and . _ @ - only
+//	text       no control characters but tab and newline
+//	status     known person status
+//	oneof=a|b  one of the listed values
+//
+// Rules other than required are skipped for fields that are empty. Requests
+// with further checks implement requestValidator. All invalid fields are
+// reported at once as ERR_VALIDATION_FAILED with a FieldError per field.
+
+//longest hash a request may name, legacy hashes included
+const maxHashLength = 256
+
+var (
+	hashPattern = regexp.MustCompile(`^(v[1-9][0-9]{0,8}-)?[0-9a-f]{64}$`)
+	namePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+)
+
+//type for invalid field of request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//request with checks beyond the validate tags
+type requestValidator interface {
+	validate() []FieldError
+}
+
+//embedded in requests that need to know which fields the argument contained
+type requestFields struct {
+	present map[string]bool
+}
+
+func (r *requestFields) has(field string) bool {
+	return r.present[field]
+}
+
+func (r *requestFields) setPresent(present map[string]bool) {
+	r.present = present
+}
+
+//field of request struct with its JSON name
+type requestField struct {
+	name  string
+	value reflect.Value
+	tag   reflect.StructTag
+}
+
+//returns error listing all invalid fields
+func validationError(errs []FieldError) error {
+	var messages []string
+	for _, e := range errs {
+		messages = append(messages, e.Message)
+	}
+	return &ChaincodeError{
+		Code:    ERR_VALIDATION_FAILED,
+		Message: strings.Join(messages, "; "),
+		Field:   errs[0].Field,
+		Details: errs,
+	}
+}
+
+//decodes args[0] into req, a pointer to request struct, and validates it
+func decodeRequest(args []string, req interface{}) error {
+	return decodeRequestAs(args, req, "")
+}
+
+// Like decodeRequest, with prefix before the field names of errors, for
+// requests sent in other places than the argument, like the transient map.
+func decodeRequestAs(args []string, req interface{}, prefix string) error {
+	var event interface{}
+	var raw map[string]json.RawMessage
+	var errs []FieldError
+	if len(args) != 1 {
+		return newError(ERR_INVALID_ARGUMENT, "", "Expecting one JSON event object")
+	}
+	err := json.Unmarshal([]byte(args[0]), &event)
+	if err != nil {
+		return wrapError(ERR_INVALID_ARGUMENT, "failed to unmarshal arg", err)
+	}
+	if event == nil {
+		return newError(ERR_INVALID_ARGUMENT, "", "unmarshal arg created nil event")
+	}
+	if _, found := event.(map[string]interface{}); !found {
+		return newError(ERR_INVALID_ARGUMENT, "", "arg is not a map shape")
+	}
+	err = json.Unmarshal([]byte(args[0]), &raw)
+	if err != nil {
+		return wrapError(ERR_INVALID_ARGUMENT, "failed to unmarshal arg", err)
+	}
+	fields := getRequestFields(reflect.ValueOf(req).Elem())
+	known := make(map[string]bool)
+	for _, f := range fields {
+		known[f.name] = true
+	}
+	var names []string
+	for name := range raw {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			errs = append(errs, FieldError{Field: name, Code: ERR_UNKNOWN_FIELD, Message: name + " is not a known field"})
+		}
+	}
+	present := make(map[string]bool)
+	for _, f := range fields {
+		value, found := raw[f.name]
+		if found {
+			present[f.name] = true
+			err = json.Unmarshal(value, f.value.Addr().Interface())
+			if err != nil {
+				f.value.Set(reflect.Zero(f.value.Type()))
+				errs = append(errs, FieldError{Field: f.name, Code: ERR_INVALID_FIELD, Message: f.name + " must be " + describeType(f.value.Type())})
+				continue
+			}
+		}
+		errs = append(errs, checkRules(f.name, f.value, f.tag.Get("validate"), found)...)
+		if f.value.Kind() == reflect.Slice && f.tag.Get("items") != "" {
+			for i := 0; i < f.value.Len(); i++ {
+				errs = append(errs, checkRules(fmt.Sprintf("%s[%d]", f.name, i), f.value.Index(i), f.tag.Get("items"), true)...)
+			}
+		}
+	}
+	if recorder, found := req.(interface{ setPresent(map[string]bool) }); found {
+		recorder.setPresent(present)
+	}
+	if validator, found := req.(requestValidator); found {
+		errs = append(errs, validator.validate()...)
+	}
+	if len(errs) != 0 {
+		return validationError(prefixFieldErrors(errs, prefix))
+	}
+	return nil
+}
+
+//returns errs with prefix before field names, in messages too
+func prefixFieldErrors(errs []FieldError, prefix string) []FieldError {
+	if prefix == "" {
+		return errs
+	}
+	for i := range errs {
+		if strings.HasPrefix(errs[i].Message, errs[i].Field) {
+			errs[i].Message = prefix + errs[i].Message
+		}
+		errs[i].Field = prefix + errs[i].Field
+	}
+	return errs
+}
+
+//returns JSON fields of request struct, fields of embedded structs included
+func getRequestFields(v reflect.Value) []requestField {
+	var fields []requestField
+	for i := 0; i < v.NumField(); i++ {
+		sf := v.Type().Field(i)
+		if sf.PkgPath != "" {
+			//unexported
+			continue
+		}
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			fields = append(fields, getRequestFields(v.Field(i))...)
+			continue
+		}
+		name := strings.Split(sf.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields = append(fields, requestField{name: name, value: v.Field(i), tag: sf.Tag})
+	}
+	return fields
+}
+
+func describeType(t reflect.Type) string {
+	if t == reflect.TypeOf(json.RawMessage{}) {
+		return "JSON"
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return "an RFC 3339 time"
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return describeType(t.Elem())
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String {
+			return "an array of strings"
+		}
+		return "an array"
+	}
+	return "an object"
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return false
+}
+
+//checks value of field against comma separated rules
+func checkRules(name string, v reflect.Value, rules string, present bool) []FieldError {
+	var errs []FieldError
+	if rules == "" {
+		return nil
+	}
+	empty := !present || isEmptyValue(v)
+	if !empty && v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	for _, rule := range strings.Split(rules, ",") {
+		if rule == "required" {
+			if empty {
+				return []FieldError{{Field: name, Code: ERR_MISSING_FIELD, Message: name + " is missing"}}
+			}
+			continue
+		}
+		//a pointer to an empty value, like an empty string, passes too
+		if empty || isEmptyValue(v) {
+			return nil
+		}
+		message := checkRule(name, v, rule)
+		if message == "" {
+			continue
+		}
+		code := ERR_INVALID_FIELD
+		if rule == "status" {
+			code = ERR_UNKNOWN_STATUS
+		}
+		errs = append(errs, FieldError{Field: name, Code: code, Message: message})
+	}
+	return errs
+}
+
+//returns message if value violates rule, empty if it does not
+func checkRule(name string, v reflect.Value, rule string) string {
+	ruleName, param := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		ruleName, param = rule[:i], rule[i+1:]
+	}
+	switch ruleName {
+	case "min", "max":
+		limit, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			panic("invalid rule " + rule)
+		}
+		var size float64
+		var unit string
+		switch v.Kind() {
+		case reflect.String:
+			size, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+		case reflect.Slice, reflect.Map:
+			size, unit = float64(v.Len()), " items"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			size = float64(v.Int())
+		case reflect.Float32, reflect.Float64:
+			size = v.Float()
+		}
+		if ruleName == "min" && size < limit {
+			return fmt.Sprintf("%s must be at least %s%s", name, param, unit)
+		}
+		if ruleName == "max" && size > limit {
+			return fmt.Sprintf("%s must be at most %s%s", name, param, unit)
+		}
+	case "hash":
+		//hashes of legacy persons were chosen by the callers
+		if utf8.RuneCountInString(v.String()) > maxHashLength {
+			return fmt.Sprintf("%s must be at most %d characters", name, maxHashLength)
+		}
+		for _, r := range v.String() {
+			if unicode.IsControl(r) {
+				return name + " must not contain control characters"
+			}
+		}
+	case "name":
+		if !namePattern.MatchString(v.String()) {
+			return name + " may contain only letters, digits and . _ @ -"
+		}
+	case "text":
+		for _, r := range v.String() {
+			if unicode.IsControl(r) && r != '\t' && r != '\n' {
+				return name + " must not contain control characters"
+			}
+		}
+	case "status":
+		if !isKnownStatus(PersonStatus(v.String())) {
+			return fmt.Sprintf("unknown status %q, expecting one of %v", v.String(), knownStatuses)
+		}
+	case "oneof":
+		for _, allowed := range strings.Split(param, "|") {
+			if v.String() == allowed {
+				return ""
+			}
+		}
+		return name + " must be one of " + strings.Replace(param, "|", ", ", -1)
+	default:
+		panic("unknown rule " + rule)
+	}
+	return ""
+}
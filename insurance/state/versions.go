@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The ledger keeps every value a key ever had. getPersonHistoryIter reads
+// the versions of Person:<hash> with GetHistoryForKey, oldest first, and
+// returns each with the transaction that wrote it. Deletes, like purgePerson,
+// are versions without a person. With diff set every version carries the
+// fields changed since the version before; encrypted fields can not be
+// compared, a change of them is reported once as field "encrypted".
+// Versions before purgePerson are left out, the ledger history starts with
+// the delete of the purge; so are the history actions, which the purge
+// removed from state.
+// getPersonAsOf returns the version that was current at a given time. Where
+// the ledger history has none, because the history database of the peer is
+// disabled or rekeyPersons moved the person to a new key since, the person is
+// rebuilt from the history actions of its entries. Actions record the status
+// but only the fields updates changed and no encrypted values, so such a
+// person may lack fields.
+
+const (
+	// sources of getPersonAsOf
+	ASOF_SOURCE_LEDGER  = "ledger"
+	ASOF_SOURCE_ACTIONS = "actions"
+)
+
+//type for one version of person, Person is nil for a delete
+type PersonVersion struct {
+	TxID      string    `json:"txId"`
+	Timestamp time.Time `json:"timestamp"`
+	IsDelete  bool      `json:"isDelete"`
+	Person    *Person   `json:"person"`
+	// changes since the version before, only if requested
+	Changes []FieldChange `json:"changes,omitempty"`
+}
+
+//type for response of getPersonAsOf, Person is nil if it did not exist at the time
+type PersonAsOf struct {
+	Hash   string    `json:"hash"`
+	AsOf   time.Time `json:"asOf"`
+	Source string    `json:"source,omitempty"`
+	Person *Person   `json:"person"`
+	// transaction that wrote the person, nil if there is none
+	Transaction *PersonTransaction `json:"transaction"`
+}
+
+//type for transaction that wrote a person version
+type PersonTransaction struct {
+	// empty for actions of legacy lists
+	TxID      string    `json:"txId,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	IsDelete  bool      `json:"isDelete"`
+	// taken from the history action of the transaction, if it has one
+	Action  string `json:"action,omitempty"`
+	Company string `json:"company,omitempty"`
+	User    string `json:"user,omitempty"`
+}
+
+//type for history action of person with the transaction that added it
+type actionRecord struct {
+	Action
+	txID string
+}
+
+//returns history actions of person, oldest first
+func getActionRecords(stub shim.ChaincodeStubInterface, hash string) ([]actionRecord, error) {
+	entries, txIDs, err := getEntriesWithTxIDs(stub, personHistoryObj, personHistoryPrfx, hash)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error reading history of person "+hash, err)
+	}
+	records := make([]actionRecord, len(entries))
+	for i, entry := range entries {
+		err = json.Unmarshal(entry, &records[i].Action)
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error unmarshalling history of person "+hash, err)
+		}
+		records[i].txID = txIDs[i]
+	}
+	return records, nil
+}
+
+//sets the field of change to its new value, encrypted fields have none
+func applyChange(person *Person, change FieldChange) {
+	if change.Encrypted || !containsField(personFields, change.Field) {
+		return
+	}
+	valueBytes, err := json.Marshal(map[string]interface{}{change.Field: change.New})
+	if err != nil {
+		return
+	}
+	var patch Person
+	if json.Unmarshal(valueBytes, &patch) == nil {
+		mergePerson(person, &patch, []string{change.Field})
+	}
+}
+
+// Rebuilds person hash as it was at asOf from its history actions. Returns
+// nil if no action is that old, else the person and the last action applied.
+func replayActions(hash string, records []actionRecord, asOf time.Time) (*Person, *actionRecord) {
+	var person *Person
+	var last *actionRecord
+	for i := range records {
+		record := &records[i]
+		if record.Date.After(asOf) {
+			break
+		}
+		if person == nil {
+			person = &Person{Hash: hash}
+		}
+		switch record.Method {
+		case ACTION_INSERT:
+			person.CreatedBy = record.Company
+		case ACTION_DELETE:
+			person.Deleted = &Tombstone{Company: record.Company, User: record.User, Date: record.Date}
+		case ACTION_RESTORE:
+			person.Deleted = nil
+		}
+		if record.Method != ACTION_REKEY {
+			person.ModifyDate = record.Date
+		}
+		person.Status = record.Status
+		for _, change := range record.Changes {
+			applyChange(person, change)
+		}
+		last = record
+	}
+	if person == nil {
+		return nil, nil
+	}
+	//until a later rekey the person had the hash it moved from
+	for i := len(records) - 1; i >= 0 && records[i].Date.After(asOf); i-- {
+		if records[i].Method != ACTION_REKEY {
+			continue
+		}
+		for _, change := range records[i].Changes {
+			if old, ok := change.Old.(string); ok && change.Field == "hash" {
+				person.Hash = old
+			}
+		}
+	}
+	return person, last
+}
+
+// Returns the person as it was at the requested time with the transaction
+// that wrote it, from the ledger history or else from the history actions.
+// Encrypted fields are decrypted for callers that send the key.
+func (t *SimpleChaincode) getPersonAsOf(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req AsOfRequest
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hash := req.Hash
+	asOf := req.Timestamp.UTC()
+	logger.Infof("get person %s as of %s", hash, asOf.Format(time.RFC3339))
+	versions, err := getPersonVersions(stub, hash)
+	if err != nil {
+		logger.Warningf("ledger history of person %s not available, using history actions: %s", hash, err)
+		versions = nil
+	}
+	records, err := getActionRecords(stub, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	result := &PersonAsOf{Hash: hash, AsOf: asOf}
+	var current *PersonVersion
+	for i := range versions {
+		if !versions[i].Timestamp.After(asOf) {
+			current = &versions[i]
+		}
+	}
+	if current != nil {
+		result.Source = ASOF_SOURCE_LEDGER
+		result.Person = current.Person
+		result.Transaction = &PersonTransaction{TxID: current.TxID, Timestamp: current.Timestamp, IsDelete: current.IsDelete}
+		for _, record := range records {
+			if record.txID == current.TxID {
+				result.Transaction.Action, result.Transaction.Company, result.Transaction.User = record.Method, record.Company, record.User
+			}
+		}
+	} else if person, record := replayActions(hash, records, asOf); person != nil {
+		result.Source = ASOF_SOURCE_ACTIONS
+		result.Person = person
+		result.Transaction = &PersonTransaction{
+			TxID:      record.txID,
+			Timestamp: record.Date,
+			Action:    record.Method,
+			Company:   record.Company,
+			User:      record.User,
+		}
+	}
+	if result.Person != nil {
+		_, err = revealPerson(stub, result.Person)
+		if err != nil {
+			return errorResponse(err)
+		}
+	}
+	resultBytes, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(resultBytes)
+}
+
+//returns versions of person from the ledger history since its last purge, oldest first
+func getPersonVersions(stub shim.ChaincodeStubInterface, hash string) ([]PersonVersion, error) {
+	versions := []PersonVersion{}
+	resultsIterator, err := stub.GetHistoryForKey(personPrfx + hash)
+	if err != nil {
+		return nil, wrapError(ERR_INTERNAL, "Error reading history of person "+hash, err)
+	}
+	defer resultsIterator.Close()
+	for resultsIterator.HasNext() {
+		historicValue, err := resultsIterator.Next()
+		if err != nil {
+			return nil, wrapError(ERR_INTERNAL, "Error reading history of person "+hash, err)
+		}
+		version := PersonVersion{TxID: historicValue.TxId, IsDelete: historicValue.IsDelete}
+		if historicValue.Timestamp != nil {
+			version.Timestamp = time.Unix(historicValue.Timestamp.Seconds, int64(historicValue.Timestamp.Nanos)).UTC()
+		}
+		if !historicValue.IsDelete && len(historicValue.Value) != 0 {
+			version.Person = &Person{}
+			err = json.Unmarshal(historicValue.Value, version.Person)
+			if err != nil {
+				return nil, wrapError(ERR_INTERNAL, "Error unmarshalling person "+hash+" of transaction "+historicValue.TxId, err)
+			}
+		}
+		versions = append(versions, version)
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		if !versions[i].IsDelete {
+			continue
+		}
+		purged, err := isPurge(stub, hash, &versions[i])
+		if err != nil {
+			return nil, err
+		}
+		if purged {
+			return versions[i:], nil
+		}
+	}
+	return versions, nil
+}
+
+//tells if delete version of person was written by purgePerson, looked up in the maintenance log
+func isPurge(stub shim.ChaincodeStubInterface, hash string, version *PersonVersion) (bool, error) {
+	logKey, err := stub.CreateCompositeKey(maintenanceLogObj, []string{version.Timestamp.Format(entryTimeLayout), version.TxID, MAINTENANCE_PURGE})
+	if err != nil {
+		return false, wrapError(ERR_INTERNAL, "Error creating maintenance log key", err)
+	}
+	recordBytes, err := stub.GetState(logKey)
+	if err != nil {
+		return false, wrapError(ERR_INTERNAL, "Error reading maintenance log", err)
+	}
+	if len(recordBytes) == 0 {
+		return false, nil
+	}
+	var record MaintenanceRecord
+	err = json.Unmarshal(recordBytes, &record)
+	if err != nil {
+		return false, wrapError(ERR_INTERNAL, "Error unmarshalling maintenance record "+logKey, err)
+	}
+	return record.Key == personPrfx+hash, nil
+}
+
+//returns fields changed from old to new person, either may be nil
+func diffPersons(old *Person, new *Person) []FieldChange {
+	var base, next Person
+	if old != nil {
+		base = *old
+	}
+	if new != nil {
+		next = *new
+	}
+	changes := mergePerson(&base, &next, personFields)
+	var oldData, newData string
+	if old != nil && old.Encrypted != nil {
+		oldData = old.Encrypted.Data
+	}
+	if new != nil && new.Encrypted != nil {
+		newData = new.Encrypted.Data
+	}
+	if oldData != newData {
+		changes = append(changes, FieldChange{Field: "encrypted", Encrypted: true})
+	}
+	return changes
+}
+
+//returns versions of person from the ledger history, optionally paged and with changes
+func (t *SimpleChaincode) getPersonHistoryIter(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	var req HistoryIterRequest
+	//parse parameters  - need 1
+	err := decodeRequest(args, &req)
+	if err != nil {
+		return errorResponse(err)
+	}
+	hash := req.Hash
+	logger.Debugf("search history for %s", personPrfx+hash)
+	versions, err := getPersonVersions(stub, hash)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if req.Diff {
+		for i := range versions {
+			var previous *Person
+			if i > 0 {
+				previous = versions[i-1].Person
+			}
+			versions[i].Changes = diffPersons(previous, versions[i].Person)
+		}
+	}
+	page := req.pageRequest()
+	if page == nil {
+		historyAsBytes, err := json.Marshal(versions)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return shim.Success(historyAsBytes)
+	}
+	positions, bookmark, err := page.positions(len(versions))
+	if err != nil {
+		return errorResponse(err)
+	}
+	records := []PersonVersion{}
+	for _, pos := range positions {
+		records = append(records, versions[pos])
+	}
+	pageAsBytes, err := json.Marshal(&Page{Records: records, Bookmark: bookmark, Total: len(versions)})
+	if err != nil {
+		return errorResponse(err)
+	}
+	return shim.Success(pageAsBytes)
+}
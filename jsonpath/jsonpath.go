@@ -0,0 +1,295 @@
+// Package jsonpath reads values out of JSON decoded into interface{} values,
+// as json.Unmarshal does, by a path like a.items[2].id. Chaincodes use it to
+// pick fields of their arguments without declaring a struct for them.
+//
+// A path is a list of map keys separated by dots, each followed by any number
+// of array indexes in brackets. A path may start with an index when the root
+// is an array. Keys can not contain dots or brackets.
+//
+// Lookups fail with an *Error telling whether a level of the path does not
+// exist (NotFound) or holds a value of another type than needed (WrongType).
+package jsonpath
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//kind of lookup error
+type ErrorKind int
+
+const (
+	// a map key or array index of the path does not exist
+	NotFound ErrorKind = iota
+	// the value or a level of the path has another type than needed
+	WrongType
+	// the path can not be parsed
+	InvalidPath
+)
+
+//lookup error, Path is the part of the path up to the failed level
+type Error struct {
+	Kind    ErrorKind
+	Path    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+//returns true if err is an *Error of kind NotFound
+func IsNotFound(err error) bool {
+	e, found := err.(*Error)
+	return found && e.Kind == NotFound
+}
+
+//returns true if err is an *Error of kind WrongType
+func IsWrongType(err error) bool {
+	e, found := err.(*Error)
+	return found && e.Kind == WrongType
+}
+
+//one level of a path, a map key or, if Key is empty, an array index
+type Step struct {
+	Key   string
+	Index int
+}
+
+//splits path into its steps
+func Parse(path string) ([]Step, error) {
+	var steps []Step
+	if path == "" {
+		return nil, invalidPath(path, "path is empty")
+	}
+	for i, part := range strings.Split(path, ".") {
+		key := part
+		rest := ""
+		if open := strings.Index(part, "["); open >= 0 {
+			key, rest = part[:open], part[open:]
+		}
+		if key == "" && (i > 0 || rest == "") {
+			return nil, invalidPath(path, "empty key in path "+path)
+		}
+		if key != "" {
+			steps = append(steps, Step{Key: key})
+		}
+		for rest != "" {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, invalidPath(path, "unbalanced brackets in path "+path)
+			}
+			index, err := strconv.Atoi(rest[1:end])
+			if err != nil || index < 0 {
+				return nil, invalidPath(path, fmt.Sprintf("invalid index %q in path %s", rest[1:end], path))
+			}
+			steps = append(steps, Step{Index: index})
+			rest = rest[end+1:]
+		}
+	}
+	return steps, nil
+}
+
+func invalidPath(path string, message string) error {
+	return &Error{Kind: InvalidPath, Path: path, Message: message}
+}
+
+//returns the value at path within obj
+func Get(obj interface{}, path string) (interface{}, error) {
+	steps, err := Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	current := obj
+	walked := ""
+	for _, step := range steps {
+		parent := walked
+		if parent == "" {
+			parent = "root"
+		}
+		if step.Key != "" {
+			if walked != "" {
+				walked += "."
+			}
+			walked += step.Key
+			m, found := asMap(current)
+			if !found {
+				return nil, wrongType(parent, "an object")
+			}
+			current, found = m[step.Key]
+			if !found {
+				return nil, &Error{Kind: NotFound, Path: walked, Message: walked + " is missing"}
+			}
+			continue
+		}
+		walked += fmt.Sprintf("[%d]", step.Index)
+		a, found := asArray(current)
+		if !found {
+			return nil, wrongType(parent, "an array")
+		}
+		if step.Index >= len(a) {
+			return nil, &Error{Kind: NotFound, Path: walked, Message: walked + " is missing"}
+		}
+		current = a[step.Index]
+	}
+	return current, nil
+}
+
+//returns obj as map, maps of named types like map[string]interface{} included
+func asMap(obj interface{}) (map[string]interface{}, bool) {
+	if m, found := obj.(map[string]interface{}); found {
+		return m, true
+	}
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Map || v.Type().Key().Kind() != reflect.String {
+		return nil, false
+	}
+	m := make(map[string]interface{}, v.Len())
+	for _, key := range v.MapKeys() {
+		m[key.String()] = v.MapIndex(key).Interface()
+	}
+	return m, true
+}
+
+//returns obj as array, slices of any element type included
+func asArray(obj interface{}) ([]interface{}, bool) {
+	if a, found := obj.([]interface{}); found {
+		return a, true
+	}
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Slice {
+		return nil, false
+	}
+	a := make([]interface{}, v.Len())
+	for i := range a {
+		a[i] = v.Index(i).Interface()
+	}
+	return a, true
+}
+
+func wrongType(path string, expected string) error {
+	return &Error{Kind: WrongType, Path: path, Message: path + " must be " + expected}
+}
+
+func GetString(obj interface{}, path string) (string, error) {
+	value, err := Get(obj, path)
+	if err != nil {
+		return "", err
+	}
+	s, found := value.(string)
+	if !found {
+		return "", wrongType(path, "a string")
+	}
+	return s, nil
+}
+
+//range of int, 32 or 64 bits wide depending on the platform
+const (
+	maxInt = int(^uint(0) >> 1)
+	minInt = -maxInt - 1
+)
+
+// Returns number at path. JSON numbers decode as float64, so it must be a
+// whole number within the range of int; floats above 2^53 are not exact but
+// are taken as they decoded.
+func GetInt(obj interface{}, path string) (int, error) {
+	value, err := Get(obj, path)
+	if err != nil {
+		return 0, err
+	}
+	switch n := value.(type) {
+	case int:
+		return n, nil
+	case int64:
+		if n >= int64(minInt) && n <= int64(maxInt) {
+			return int(n), nil
+		}
+	case float64:
+		//-float64(minInt) is 2^31 or 2^63, float64(maxInt) would round up to it
+		if n == math.Trunc(n) && n >= float64(minInt) && n < -float64(minInt) {
+			return int(n), nil
+		}
+	case interface{ Int64() (int64, error) }:
+		//json.Number
+		i, err := n.Int64()
+		if err == nil && i >= int64(minInt) && i <= int64(maxInt) {
+			return int(i), nil
+		}
+	}
+	return 0, wrongType(path, "an integer")
+}
+
+func GetFloat(obj interface{}, path string) (float64, error) {
+	value, err := Get(obj, path)
+	if err != nil {
+		return 0, err
+	}
+	switch n := value.(type) {
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case interface{ Float64() (float64, error) }:
+		//json.Number
+		f, err := n.Float64()
+		if err == nil {
+			return f, nil
+		}
+	}
+	return 0, wrongType(path, "a number")
+}
+
+func GetBool(obj interface{}, path string) (bool, error) {
+	value, err := Get(obj, path)
+	if err != nil {
+		return false, err
+	}
+	b, found := value.(bool)
+	if !found {
+		return false, wrongType(path, "a boolean")
+	}
+	return b, nil
+}
+
+//returns time at path, given as RFC 3339 string like time.Time marshals to JSON
+func GetTime(obj interface{}, path string) (time.Time, error) {
+	value, err := Get(obj, path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	s, found := value.(string)
+	if found {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, wrongType(path, "an RFC 3339 time")
+}
+
+//returns array of strings at path, every element must be a string
+func GetStringSlice(obj interface{}, path string) ([]string, error) {
+	value, err := Get(obj, path)
+	if err != nil {
+		return nil, err
+	}
+	if s, found := value.([]string); found {
+		return s, nil
+	}
+	a, found := asArray(value)
+	if !found {
+		return nil, wrongType(path, "an array of strings")
+	}
+	result := make([]string, len(a))
+	for i, element := range a {
+		result[i], found = element.(string)
+		if !found {
+			return nil, wrongType(fmt.Sprintf("%s[%d]", path, i), "a string")
+		}
+	}
+	return result, nil
+}
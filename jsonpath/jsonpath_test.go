@@ -0,0 +1,167 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testDoc = `{
+	"id": "order-1",
+	"count": 3,
+	"ratio": 0.5,
+	"paid": true,
+	"created": "2019-03-01T10:00:00Z",
+	"tags": ["a", "b"],
+	"mixed": ["a", 1],
+	"customer": {"name": "alice", "address": null},
+	"items": [{"id": "i0"}, {"id": "i1", "sizes": [[38, 39], [40]]}]
+}`
+
+func decode(t *testing.T, doc string) interface{} {
+	t.Helper()
+	var obj interface{}
+	if err := json.Unmarshal([]byte(doc), &obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func TestGet(t *testing.T) {
+	obj := decode(t, testDoc)
+	tests := []struct {
+		path  string
+		value interface{}
+	}{
+		{"id", "order-1"},
+		{"customer.name", "alice"},
+		{"customer.address", nil},
+		{"items[1].id", "i1"},
+		{"items[1].sizes[0][1]", float64(39)},
+		{"tags", []interface{}{"a", "b"}},
+	}
+	for _, test := range tests {
+		value, err := Get(obj, test.path)
+		if err != nil || !reflect.DeepEqual(value, test.value) {
+			t.Errorf("%s: expected %v, got %v, %v", test.path, test.value, value, err)
+		}
+	}
+	if value, err := Get(decode(t, `[{"id":"x"}]`), "[0].id"); err != nil || value != "x" {
+		t.Errorf("expected x from root array, got %v, %v", value, err)
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	obj := decode(t, testDoc)
+	tests := []struct {
+		path    string
+		kind    ErrorKind
+		errPath string
+	}{
+		{"missing", NotFound, "missing"},
+		//a missing intermediate level is not searched for further down
+		{"customer.missing.name", NotFound, "customer.missing"},
+		{"items[2].id", NotFound, "items[2]"},
+		{"items[0].sizes[0]", NotFound, "items[0].sizes"},
+		{"id.length", WrongType, "id"},
+		{"customer[0]", WrongType, "customer"},
+		{"customer.address.street", WrongType, "customer.address"},
+		{"", InvalidPath, ""},
+		{"a..b", InvalidPath, "a..b"},
+		{"items[x]", InvalidPath, "items[x]"},
+		{"items[-1]", InvalidPath, "items[-1]"},
+		{"items[0", InvalidPath, "items[0"},
+		{"items[0]id", InvalidPath, "items[0]id"},
+	}
+	for _, test := range tests {
+		_, err := Get(obj, test.path)
+		e, found := err.(*Error)
+		if !found || e.Kind != test.kind || e.Path != test.errPath {
+			t.Errorf("%s: expected error kind %d at %q, got %#v", test.path, test.kind, test.errPath, err)
+		}
+	}
+	if _, err := Get(obj, "missing"); !IsNotFound(err) || IsWrongType(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	obj := decode(t, testDoc)
+	if s, err := GetString(obj, "items[0].id"); err != nil || s != "i0" {
+		t.Errorf("GetString: got %q, %v", s, err)
+	}
+	if i, err := GetInt(obj, "count"); err != nil || i != 3 {
+		t.Errorf("GetInt: got %d, %v", i, err)
+	}
+	if f, err := GetFloat(obj, "ratio"); err != nil || f != 0.5 {
+		t.Errorf("GetFloat: got %v, %v", f, err)
+	}
+	if b, err := GetBool(obj, "paid"); err != nil || !b {
+		t.Errorf("GetBool: got %v, %v", b, err)
+	}
+	if tm, err := GetTime(obj, "created"); err != nil || !tm.Equal(time.Date(2019, 3, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("GetTime: got %v, %v", tm, err)
+	}
+	if s, err := GetStringSlice(obj, "tags"); err != nil || !reflect.DeepEqual(s, []string{"a", "b"}) {
+		t.Errorf("GetStringSlice: got %v, %v", s, err)
+	}
+
+	wrong := []struct {
+		get     func() error
+		message string
+	}{
+		{func() error { _, err := GetString(obj, "count"); return err }, "count must be a string"},
+		{func() error { _, err := GetInt(obj, "ratio"); return err }, "ratio must be an integer"},
+		{func() error { _, err := GetFloat(obj, "id"); return err }, "id must be a number"},
+		{func() error { _, err := GetBool(obj, "id"); return err }, "id must be a boolean"},
+		{func() error { _, err := GetTime(obj, "id"); return err }, "id must be an RFC 3339 time"},
+		{func() error { _, err := GetStringSlice(obj, "mixed"); return err }, "mixed[1] must be a string"},
+		{func() error { _, err := GetStringSlice(obj, "customer"); return err }, "customer must be an array of strings"},
+	}
+	for i, test := range wrong {
+		err := test.get()
+		if !IsWrongType(err) || err.Error() != test.message {
+			t.Errorf("case %d: expected %q, got %v", i, test.message, err)
+		}
+	}
+	if _, err := GetInt(obj, "items[5]"); !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestGetIntRange(t *testing.T) {
+	obj := decode(t, `{"small":-2147483649,"large":4294967296,"huge":1e19,"fraction":2.5}`)
+	if maxInt > math.MaxInt32 {
+		if i, err := GetInt(obj, "small"); err != nil || int64(i) != -2147483649 {
+			t.Errorf("expected -2147483649, got %d, %v", i, err)
+		}
+		if i, err := GetInt(obj, "large"); err != nil || int64(i) != 4294967296 {
+			t.Errorf("expected 4294967296, got %d, %v", i, err)
+		}
+	}
+	for _, path := range []string{"huge", "fraction"} {
+		if _, err := GetInt(obj, path); !IsWrongType(err) {
+			t.Errorf("%s: expected wrong type, got %v", path, err)
+		}
+	}
+	var number interface{}
+	dec := json.NewDecoder(strings.NewReader(`{"n":9223372036854775807}`))
+	dec.UseNumber()
+	if err := dec.Decode(&number); err != nil {
+		t.Fatal(err)
+	}
+	if i, err := GetInt(number, "n"); maxInt > math.MaxInt32 && (err != nil || i != maxInt) {
+		t.Errorf("expected max int from json.Number, got %d, %v", i, err)
+	}
+}
+
+func TestNamedMapAndSliceTypes(t *testing.T) {
+	type argsMap map[string]interface{}
+	obj := argsMap{"user": argsMap{"roles": []string{"admin"}}}
+	if role, err := GetString(obj, "user.roles[0]"); err != nil || role != "admin" {
+		t.Errorf("expected admin, got %q, %v", role, err)
+	}
+}